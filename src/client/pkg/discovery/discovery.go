@@ -4,8 +4,44 @@ import (
 	"github.com/pachyderm/pachyderm/src/client/pkg/errors"
 )
 
-// ErrCancelled is returned when an action is cancelled by the user
-var ErrCancelled = errors.Errorf("pachyderm: cancelled by user")
+var (
+	// ErrCancelled is returned when an action is cancelled by the user
+	ErrCancelled = errors.Errorf("pachyderm: cancelled by user")
+	// ErrNotFound is matched, with errors.Is, by errors for keys that don't
+	// exist
+	ErrNotFound = errors.Errorf("pachyderm: key not found")
+	// ErrConflict is matched, with errors.Is, by errors from Create and
+	// CheckAndSet when the key doesn't hold the value they expect
+	ErrConflict = errors.Errorf("pachyderm: key was modified")
+	// ErrUnavailable is matched, with errors.Is, by errors from failing to
+	// reach the key-value store. Operations that fail with it may succeed if
+	// they're retried.
+	ErrUnavailable = errors.Errorf("pachyderm: key-value store unavailable")
+)
+
+// kindError is an error from a key-value store that's been classified as
+// one of the errors above, so that callers can branch on it without knowing
+// which store it came from
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+// Errors from a Client may be matched against ErrNotFound, ErrConflict and
+// ErrUnavailable with errors.Is. Other errors, such as permission errors,
+// aren't classified.
 
 // Client defines Pachyderm's interface to key-value stores such as etcd.
 type Client interface {
@@ -13,7 +49,7 @@ type Client interface {
 	Close() error
 	// Get gets the value of a key
 	// Keys can be directories of the form a/b/c, see etcd for details.
-	// the error will be non-nil if the key does not exist.
+	// the error will match ErrNotFound if the key does not exist.
 	Get(key string) (string, error)
 	// GetAll returns all of the keys in a directory and its subdirectories as
 	// a map from absolute keys to values.
@@ -26,10 +62,12 @@ type Client interface {
 	Set(key string, value string, ttl uint64) error
 	// Delete deletes a key.
 	Delete(key string) error
-	// Create is like Set but only succeeds if the key doesn't already exist.
+	// Create is like Set but only succeeds if the key doesn't already exist,
+	// and otherwise fails with an error matching ErrConflict.
 	// ttl is in seconds.
 	Create(key string, value string, ttl uint64) error
-	// CheckAndSet is like Set but only succeeds if the key is already set to oldValue.
+	// CheckAndSet is like Set but only succeeds if the key is already set to oldValue,
+	// and otherwise fails with an error matching ErrConflict.
 	// ttl is in seconds.
 	CheckAndSet(key string, value string, ttl uint64, oldValue string) error
 }
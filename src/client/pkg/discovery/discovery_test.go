@@ -5,6 +5,7 @@ import (
 	"os"
 	"testing"
 
+	"github.com/coreos/go-etcd/etcd"
 	"github.com/pachyderm/pachyderm/src/client/pkg/errors"
 	"github.com/pachyderm/pachyderm/src/client/pkg/require"
 )
@@ -81,3 +82,21 @@ func getEtcdAddress() (string, error) {
 	}
 	return fmt.Sprintf("http://%s:2379", etcdAddr), nil
 }
+
+func TestClassifyEtcdError(t *testing.T) {
+	err := classifyEtcdError(&etcd.EtcdError{ErrorCode: 100, Message: "Key not found"})
+	require.True(t, errors.Is(err, ErrNotFound))
+	require.False(t, errors.Is(err, ErrConflict))
+	etcdErr := &etcd.EtcdError{}
+	require.True(t, errors.As(err, &etcdErr))
+	require.Equal(t, 100, etcdErr.ErrorCode)
+
+	require.True(t, errors.Is(classifyEtcdError(&etcd.EtcdError{ErrorCode: 101}), ErrConflict))
+	require.True(t, errors.Is(classifyEtcdError(&etcd.EtcdError{ErrorCode: 105}), ErrConflict))
+	require.True(t, errors.Is(classifyEtcdError(&etcd.EtcdError{ErrorCode: etcd.ErrCodeEtcdNotReachable}), ErrUnavailable))
+
+	// errors that aren't classified are left alone
+	err = classifyEtcdError(&etcd.EtcdError{ErrorCode: 110})
+	require.False(t, errors.Is(err, ErrNotFound) || errors.Is(err, ErrConflict) || errors.Is(err, ErrUnavailable))
+	require.Equal(t, ErrCancelled, classifyEtcdError(ErrCancelled))
+}
@@ -80,7 +80,7 @@ func (c *etcdClient) Close() error {
 func (c *etcdClient) Get(key string) (string, error) {
 	response, err := c.client.Get(key, false, false)
 	if err != nil {
-		return "", err
+		return "", classifyEtcdError(err)
 	}
 	return response.Node.Value, nil
 }
@@ -92,7 +92,7 @@ func (c *etcdClient) GetAll(key string) (map[string]string, error) {
 		if strings.HasPrefix(err.Error(), "100: Key not found") {
 			return result, nil
 		}
-		return nil, err
+		return nil, classifyEtcdError(err)
 	}
 	nodeToMap(response.Node, result)
 	return result, nil
@@ -111,7 +111,7 @@ func (c *etcdClient) WatchAll(key string, cancel chan bool, callBack func(map[st
 				}
 			}
 
-			return err
+			return classifyEtcdError(err)
 		}
 	}
 }
@@ -119,7 +119,7 @@ func (c *etcdClient) WatchAll(key string, cancel chan bool, callBack func(map[st
 func (c *etcdClient) Set(key string, value string, ttl uint64) error {
 	_, err := c.client.Set(key, value, ttl)
 	if err != nil {
-		return err
+		return classifyEtcdError(err)
 	}
 	return nil
 }
@@ -127,7 +127,7 @@ func (c *etcdClient) Set(key string, value string, ttl uint64) error {
 func (c *etcdClient) Create(key string, value string, ttl uint64) error {
 	_, err := c.client.Create(key, value, ttl)
 	if err != nil {
-		return err
+		return classifyEtcdError(err)
 	}
 	return nil
 }
@@ -135,7 +135,7 @@ func (c *etcdClient) Create(key string, value string, ttl uint64) error {
 func (c *etcdClient) Delete(key string) error {
 	_, err := c.client.Delete(key, false)
 	if err != nil {
-		return err
+		return classifyEtcdError(err)
 	}
 	return nil
 }
@@ -148,11 +148,30 @@ func (c *etcdClient) CheckAndSet(key string, value string, ttl uint64, oldValue
 		_, err = c.client.CompareAndSwap(key, value, ttl, oldValue, 0)
 	}
 	if err != nil {
-		return err
+		return classifyEtcdError(err)
 	}
 	return nil
 }
 
+// classifyEtcdError wraps the errors that etcd reports for missing keys,
+// failed comparisons and unreachable members, so that they match
+// ErrNotFound, ErrConflict and ErrUnavailable
+func classifyEtcdError(err error) error {
+	etcdErr := &etcd.EtcdError{}
+	if !errors.As(err, &etcdErr) {
+		return err
+	}
+	switch etcdErr.ErrorCode {
+	case 100: // key not found
+		return &kindError{kind: ErrNotFound, err: err}
+	case 101, 105: // compare failed, node exists
+		return &kindError{kind: ErrConflict, err: err}
+	case etcd.ErrCodeEtcdNotReachable, etcd.ErrCodeUnhandledHTTPStatus:
+		return &kindError{kind: ErrUnavailable, err: err}
+	}
+	return err
+}
+
 // nodeToMap translates the contents of a node into a map
 // nodeToMap can be called on the same map with successive results from watch
 // to accumulate a value
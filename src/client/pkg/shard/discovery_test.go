@@ -0,0 +1,182 @@
+package shard
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/pachyderm/pachyderm/src/client/pkg/discovery"
+	"github.com/pachyderm/pachyderm/src/client/pkg/errors"
+)
+
+// testDiscoveryClient is an in-memory discovery.Client. TTLs are ignored.
+type testDiscoveryClient struct {
+	mu      sync.Mutex
+	values  map[string]string
+	changed chan struct{}
+}
+
+func newTestDiscoveryClient() *testDiscoveryClient {
+	return &testDiscoveryClient{
+		values:  make(map[string]string),
+		changed: make(chan struct{}),
+	}
+}
+
+// notify wakes up watchers; c.mu must be held.
+func (c *testDiscoveryClient) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *testDiscoveryClient) Close() error {
+	return nil
+}
+
+func (c *testDiscoveryClient) Get(key string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, ok := c.values[key]
+	if !ok {
+		return "", errors.Wrapf(discovery.ErrNotFound, "key %s", key)
+	}
+	return value, nil
+}
+
+func (c *testDiscoveryClient) GetAll(key string) (map[string]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.getAll(key), nil
+}
+
+func (c *testDiscoveryClient) getAll(key string) map[string]string {
+	result := make(map[string]string)
+	for k, v := range c.values {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+func (c *testDiscoveryClient) WatchAll(key string, cancel chan bool, callBack func(map[string]string) error) error {
+	var last map[string]string
+	for {
+		c.mu.Lock()
+		values := c.getAll(key)
+		changed := c.changed
+		c.mu.Unlock()
+		if last == nil || !sameValues(last, values) {
+			if err := callBack(values); err != nil {
+				return err
+			}
+			last = values
+		}
+		select {
+		case <-changed:
+		case <-cancel:
+			return discovery.ErrCancelled
+		}
+	}
+}
+
+func (c *testDiscoveryClient) Set(key string, value string, ttl uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] = value
+	c.notify()
+	return nil
+}
+
+func (c *testDiscoveryClient) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.values[key]; !ok {
+		return errors.Wrapf(discovery.ErrNotFound, "key %s", key)
+	}
+	delete(c.values, key)
+	c.notify()
+	return nil
+}
+
+func (c *testDiscoveryClient) Create(key string, value string, ttl uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.values[key]; ok {
+		return errors.Wrapf(discovery.ErrConflict, "key %s already exists", key)
+	}
+	c.values[key] = value
+	c.notify()
+	return nil
+}
+
+func (c *testDiscoveryClient) CheckAndSet(key string, value string, ttl uint64, oldValue string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	current, ok := c.values[key]
+	if oldValue != "" && !ok {
+		// etcd can't compare against a key that doesn't exist
+		return errors.Wrapf(discovery.ErrNotFound, "key %s not found", key)
+	}
+	if (oldValue == "" && ok) || (oldValue != "" && current != oldValue) {
+		return errors.Wrapf(discovery.ErrConflict, "key %s is not set to %s", key, oldValue)
+	}
+	c.values[key] = value
+	c.notify()
+	return nil
+}
+
+func sameValues(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if value, ok := b[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// flakyDiscoveryClient is a testDiscoveryClient whose first watchFailures
+// watches fail, as if the connection to discovery had dropped.
+type flakyDiscoveryClient struct {
+	*testDiscoveryClient
+	watchFailures int
+}
+
+func (c *flakyDiscoveryClient) WatchAll(key string, cancel chan bool, callBack func(map[string]string) error) error {
+	c.mu.Lock()
+	fail := c.watchFailures > 0
+	if fail {
+		c.watchFailures--
+	}
+	c.mu.Unlock()
+	if fail {
+		return errors.Wrap(discovery.ErrUnavailable, "connection lost")
+	}
+	return c.testDiscoveryClient.WatchAll(key, cancel, callBack)
+}
+
+// partitionedDiscoveryClient is a testDiscoveryClient that can be cut off,
+// after which it fails to renew locks, as if the process using it had lost
+// its connection to discovery.
+type partitionedDiscoveryClient struct {
+	*testDiscoveryClient
+	partitioned bool
+}
+
+func (c *partitionedDiscoveryClient) partition() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.partitioned = true
+}
+
+func (c *partitionedDiscoveryClient) CheckAndSet(key string, value string, ttl uint64, oldValue string) error {
+	c.mu.Lock()
+	partitioned := c.partitioned
+	c.mu.Unlock()
+	if partitioned {
+		return errors.Wrap(discovery.ErrUnavailable, "connection lost")
+	}
+	return c.testDiscoveryClient.CheckAndSet(key, value, ttl, oldValue)
+}
@@ -25,31 +25,11 @@ func newRouter(
 }
 
 func (r *router) GetShards(version int64) (map[uint64]bool, error) {
-	shardToAddress, err := r.sharder.GetShardToAddress(version)
-	if err != nil {
-		return nil, err
-	}
-	result := make(map[uint64]bool)
-	for shard, address := range shardToAddress {
-		if address == r.localAddress {
-			result[shard] = true
-		}
-	}
-	return result, nil
+	return r.sharder.GetShards(r.localAddress, version)
 }
 
 func (r *router) GetAllShards(version int64) (map[uint64]bool, error) {
-	shardToAddress, err := r.sharder.GetShardToAddress(version)
-	if err != nil {
-		return nil, err
-	}
-	result := make(map[uint64]bool)
-	for shard, address := range shardToAddress {
-		if address == r.localAddress {
-			result[shard] = true
-		}
-	}
-	return result, nil
+	return r.sharder.GetShards(r.localAddress, version)
 }
 
 func (r *router) GetClientConn(shard uint64, version int64) (*grpc.ClientConn, error) {
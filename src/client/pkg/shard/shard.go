@@ -1,24 +1,181 @@
 package shard
 
 import (
+	"encoding/json"
+	"time"
+
 	"github.com/pachyderm/pachyderm/src/client/pkg/discovery"
 	"github.com/pachyderm/pachyderm/src/client/pkg/grpcutil"
+	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 )
 
-// Sharder distributes shards between a set of servers.
+// Sharder distributes shards between a set of servers. Methods that take a
+// version also accept CurrentVersion, to use the most recent version.
 type Sharder interface {
 	GetAddress(shard uint64, version int64) (string, bool, error)
 	GetShardToAddress(version int64) (map[uint64]string, error)
+	// GetShards returns the shards held by address at version.
+	GetShards(address string, version int64) (map[uint64]bool, error)
+	// CurrentAddresses returns the most recent version and its addresses,
+	// both taken from the same read so that they're consistent.
+	CurrentAddresses() (int64, *Addresses, error)
+	// ListVersions returns the versions that have addresses stored in
+	// discovery, in increasing order.
+	ListVersions() ([]int64, error)
+	// Snapshot returns a view of the current role assignment, meant to be
+	// serialized as JSON for debugging.
+	Snapshot() (*Snapshot, error)
+	// Imbalance returns the ratio of the most shards held by any server to
+	// the fewest held by any server at version, so 1 is perfectly balanced.
+	// Only servers that hold at least one shard are counted.
+	Imbalance(version int64) (float64, error)
+	// ExportState returns a copy of the current role assignment, i.e. the
+	// most recent version's addresses and server roles, which ImportState
+	// can restore into another discovery backend.
+	ExportState() (*State, error)
+	// ImportState writes the role assignment in state to discovery, so that
+	// AssignRoles resumes from it rather than assigning roles from scratch.
+	// It fails if state is for a different number of shards, or if its
+	// version already exists.
+	ImportState(state *State) error
 
+	// Register announces servers at address and keeps their roles filled
+	// until it fails. It fails straight away if another live process has
+	// registered the same address.
 	Register(address string, servers []Server) error
 	RegisterFrontends(address string, frontends []Frontend) error
 	AssignRoles(address string) error
+	// ForceUnregister removes the state of the server at address, so that
+	// roles are reassigned without waiting for its TTL to expire. If the
+	// server is actually alive, it reappears when it next announces itself.
+	ForceUnregister(address string) error
+	// Validate checks that the addresses and server roles at version are
+	// consistent with each other, and returns a description of each
+	// inconsistency it finds. It doesn't modify anything.
+	Validate(version int64) ([]string, error)
+}
+
+// VirtualSharder is a Sharder whose shards are each split into virtual
+// nodes, which are distributed between servers individually.
+type VirtualSharder interface {
+	Sharder
+	// GetNodeAddress returns the address of the server holding virtual node
+	// node of shard at version. Callers that split a shard's requests
+	// between its virtual nodes, e.g. by hashing, spread them more evenly
+	// than GetAddress, which routes all of a shard's requests to the server
+	// holding its first virtual node.
+	GetNodeAddress(shard uint64, node uint64, version int64) (string, bool, error)
+}
+
+// A SharderOption configures a Sharder created with NewSharder or
+// NewVirtualSharder.
+type SharderOption func(*sharder)
+
+// WithServerGracePeriod sets how long AssignRoles waits after a server's
+// state disappears before it reassigns the server's shards, so that servers
+// which briefly miss a heartbeat don't cause a rebalance. Zero reassigns
+// immediately.
+func WithServerGracePeriod(gracePeriod time.Duration) SharderOption {
+	return func(a *sharder) {
+		a.serverGracePeriod = gracePeriod
+	}
+}
+
+// WithAssignRolesDebounce makes AssignRoles wait until server states have
+// been unchanged for window before it reassigns shards, so that a burst of
+// changes, e.g. from a rolling restart, is handled with one reassignment
+// rather than one per change. Zero, the default, reassigns on every change.
+func WithAssignRolesDebounce(window time.Duration) SharderOption {
+	return func(a *sharder) {
+		a.assignRolesDebounce = window
+	}
+}
+
+// WithPinnedShards makes AssignRoles give each shard in pinnedShards to the
+// server at the address it maps to, whenever that server is registered and
+// has room for it under the usual even division and WithMaxShardsPerServer.
+// Otherwise the shard is assigned as if it weren't pinned. Pins take effect
+// the next time the set of servers changes.
+func WithPinnedShards(pinnedShards map[uint64]string) SharderOption {
+	return func(a *sharder) {
+		a.pinnedShards = pinnedShards
+	}
+}
+
+// WithMaxShardsPerServer caps the number of shards that AssignRoles gives
+// each server, to protect servers that can't hold an even share. Shards that
+// don't fit under the cap are left unassigned and reported. Zero, the
+// default, divides shards evenly between servers without a cap.
+func WithMaxShardsPerServer(maxShards uint64) SharderOption {
+	return func(a *sharder) {
+		a.maxShardsPerServer = maxShards
+	}
+}
+
+// WithAnnounceJitter sets the most that servers and frontends shorten the
+// interval between refreshes of their state by, at random, so that a large
+// cluster's refreshes are spread out rather than hitting discovery at once.
+// It defaults to a tenth of the interval, and zero refreshes on a fixed
+// interval.
+func WithAnnounceJitter(jitter time.Duration) SharderOption {
+	return func(a *sharder) {
+		a.announceJitter = jitter
+	}
+}
+
+// WithIdentity sets the identity that a Sharder's logs carry, which defaults
+// to the hostname and process ID.
+func WithIdentity(identity string) SharderOption {
+	return func(a *sharder) {
+		a.logger = log.WithField("identity", identity)
+	}
+}
+
+// WithPreloadedAddresses makes a Sharder cache the addresses of the newest
+// version as soon as it's created, and again whenever a new version is
+// written, so that lookups at that version don't wait on discovery.
+// Preloading happens in the background and doesn't delay creation; it stops
+// when cancel is closed.
+func WithPreloadedAddresses(cancel chan bool) SharderOption {
+	return func(a *sharder) {
+		a.preloadCancel = cancel
+	}
 }
 
 // NewSharder creates a Sharder using a discovery client.
-func NewSharder(discoveryClient discovery.Client, numShards uint64, namespace string) Sharder {
-	return newSharder(discoveryClient, numShards, namespace)
+func NewSharder(discoveryClient discovery.Client, numShards uint64, namespace string, opts ...SharderOption) Sharder {
+	a := newSharder(discoveryClient, numShards, namespace)
+	for _, opt := range opts {
+		opt(a)
+	}
+	if a.preloadCancel != nil {
+		go a.preloadAddresses(a.preloadCancel)
+	}
+	return a
+}
+
+// NewVirtualSharder creates a VirtualSharder using a discovery client, which
+// splits each of numShards shards into virtualNodes virtual nodes and
+// distributes the virtual nodes between servers. Because the unit of
+// distribution is smaller, load that's routed by virtual node is spread more
+// evenly when the number of servers doesn't evenly divide numShards.
+//
+// Shards passed to and returned by the Sharder's routing methods, and given
+// to its servers, are the numShards shards. A server holds every shard that
+// it holds a virtual node of. Methods that describe the assignment as a
+// whole, i.e. CurrentAddresses, Snapshot, Imbalance, ExportState,
+// ImportState and Validate, and options that name shards, such as
+// WithPinnedShards, use virtual nodes, where virtual node i of shard s is
+// numbered s*virtualNodes+i.
+func NewVirtualSharder(discoveryClient discovery.Client, numShards uint64, virtualNodes uint64, namespace string, opts ...SharderOption) VirtualSharder {
+	if virtualNodes == 0 {
+		virtualNodes = 1
+	}
+	return &virtualSharder{
+		sharder:      NewSharder(discoveryClient, numShards*virtualNodes, namespace, opts...).(*sharder),
+		virtualNodes: virtualNodes,
+	}
 }
 
 // NewLocalSharder creates a Sharder user a list of addresses.
@@ -26,6 +183,30 @@ func NewLocalSharder(addresses []string, numShards uint64) Sharder {
 	return newLocalSharder(addresses, numShards)
 }
 
+// Snapshot is a JSON-serializable view of the role assignment at a version.
+type Snapshot struct {
+	Version int64           `json:"version"`
+	Shards  []ShardSnapshot `json:"shards"`
+}
+
+// ShardSnapshot is the assignment of a single shard in a Snapshot.
+type ShardSnapshot struct {
+	Shard   uint64 `json:"shard"`
+	Address string `json:"address,omitempty"`
+	// Unassigned is set if no server has a role for the shard.
+	Unassigned bool `json:"unassigned,omitempty"`
+}
+
+// State is a JSON-serializable copy of the role assignment at a version, as
+// stored in discovery, for backing up and restoring routing. The addresses
+// and server roles are encoded as they are in discovery.
+type State struct {
+	NumShards   uint64            `json:"num_shards"`
+	Version     int64             `json:"version"`
+	Addresses   json.RawMessage   `json:"addresses"`
+	ServerRoles []json.RawMessage `json:"server_roles,omitempty"`
+}
+
 // A Server represents a server that has roles for shards.
 type Server interface {
 	// AddShard tells the server it now has a role for a shard.
@@ -1,17 +1,25 @@
 package shard
 
 import (
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"math"
+	"math/rand"
+	"os"
 	"path"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gogo/protobuf/jsonpb"
+	"github.com/gogo/protobuf/proto"
 	"github.com/pachyderm/pachyderm/src/client/pkg/discovery"
 	"github.com/pachyderm/pachyderm/src/client/pkg/errors"
+	"github.com/pachyderm/pachyderm/src/server/pkg/backoff"
 	log "github.com/sirupsen/logrus"
 
 	"golang.org/x/sync/errgroup"
@@ -20,9 +28,25 @@ import (
 // InvalidVersion is defined as -1 since valid versions are non-negative.
 const InvalidVersion int64 = -1
 
+// CurrentVersion can be passed to the Sharder's getters in place of a version
+// to read the most recent version, so that callers don't route against a
+// stale one.
+const CurrentVersion = InvalidVersion
+
 var (
 	holdTTL   uint64 = 20
 	marshaler        = &jsonpb.Marshaler{}
+	// defaultServerGracePeriod is how long AssignRoles waits for a server
+	// whose state disappeared to come back, unless WithServerGracePeriod
+	// says otherwise
+	defaultServerGracePeriod = 5 * time.Second
+	// defaultAnnounceJitter is how much servers and frontends vary the
+	// interval between refreshes of their state, unless WithAnnounceJitter
+	// says otherwise. It's a tenth of the interval.
+	defaultAnnounceJitter = time.Second * time.Duration(holdTTL/2) / 10
+	// skewThreshold is how long WaitForAvailability waits for servers to
+	// agree on a version before it starts reporting the ones that don't.
+	skewThreshold = time.Minute
 	// ErrCancelled is returned when an action is cancelled by the user
 	ErrCancelled = errors.Errorf("cancelled by user")
 	errComplete  = errors.Errorf("COMPLETE")
@@ -33,11 +57,93 @@ type sharder struct {
 	numShards       uint64
 	namespace       string
 	addresses       map[int64]*Addresses
+	// addressToShards is the reverse index of addresses, built once per
+	// version
+	addressToShards map[int64]map[string]map[uint64]bool
 	addressesLock   sync.RWMutex
+	// events, if set, is sent a SetServerRole, DeleteServerRole or
+	// SetAddresses message for each change that role assignment makes, so
+	// that tests can observe the sequence of changes. It's nil in production.
+	events chan<- proto.Message
+	// reportSkew is called by WaitForAvailability, once per skewThreshold
+	// after the first, with the version of each server that's holding it up.
+	// Servers that haven't registered are reported at InvalidVersion.
+	reportSkew func(lagging map[string]int64)
+	// shuffle orders the servers that role assignment considers when a
+	// shard can go to any of them. It has the signature of rand.Shuffle,
+	// which it defaults to, so tests can make assignment reproducible with a
+	// seeded rand.Rand's.
+	shuffle func(n int, swap func(i, j int))
+	// serverGracePeriod is how long role assignment waits for a server that
+	// has gone missing to come back before it reassigns the server's shards.
+	serverGracePeriod time.Duration
+	// assignRolesDebounce is how long role assignment waits for server
+	// states to stop changing before it acts on them, or 0 to act on each
+	// change.
+	assignRolesDebounce time.Duration
+	// pinnedShards maps shards to the servers that role assignment gives
+	// them to whenever it can.
+	pinnedShards map[uint64]string
+	// maxShardsPerServer caps the shards that role assignment gives each
+	// server, or is 0 for no cap.
+	maxShardsPerServer uint64
+	// logger logs with the sharder's identity, so that the logs of different
+	// AssignRoles candidates can be told apart
+	logger *log.Entry
+	// announceJitter is the most that servers and frontends shorten the
+	// interval between refreshes of their state by, chosen at random for
+	// each refresh, so that their refreshes don't line up.
+	announceJitter time.Duration
+	// lockRenewInterval is how often AssignRoles renews the lock that makes
+	// it the leader, or tries to acquire it while standing by. It must be
+	// shorter than holdTTL, after which an unrenewed lock expires.
+	lockRenewInterval time.Duration
+	// claimGracePeriod is how long Register waits for another process's
+	// claim to its address to expire before it gives up. It's holdTTL by
+	// default, after which a claim that isn't being renewed has expired.
+	claimGracePeriod time.Duration
+	// preloadCancel, if set, stops the watch that keeps the newest version's
+	// addresses cached. It's nil if addresses aren't preloaded.
+	preloadCancel chan bool
 }
 
 func newSharder(discoveryClient discovery.Client, numShards uint64, namespace string) *sharder {
-	return &sharder{discoveryClient, numShards, namespace, make(map[int64]*Addresses), sync.RWMutex{}}
+	a := &sharder{
+		discoveryClient:   discoveryClient,
+		numShards:         numShards,
+		namespace:         namespace,
+		addresses:         make(map[int64]*Addresses),
+		addressToShards:   make(map[int64]map[string]map[uint64]bool),
+		shuffle:           rand.Shuffle,
+		serverGracePeriod: defaultServerGracePeriod,
+		lockRenewInterval: time.Second * time.Duration(holdTTL/2),
+		claimGracePeriod:  time.Second * time.Duration(holdTTL),
+		announceJitter:    defaultAnnounceJitter,
+		logger:            log.WithField("identity", defaultIdentity()),
+	}
+	a.reportSkew = a.logSkew
+	return a
+}
+
+// defaultIdentity identifies the process that a sharder runs in
+func defaultIdentity() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s/%d", hostname, os.Getpid())
+}
+
+func (a *sharder) logSkew(lagging map[string]int64) {
+	for address, version := range lagging {
+		a.logger.WithFields(log.Fields{"address": address, "version": version}).Warn("WaitForAvailability: server is lagging")
+	}
+}
+
+func (a *sharder) emit(event proto.Message) {
+	if a.events != nil {
+		a.events <- event
+	}
 }
 
 func (a *sharder) GetAddress(shard uint64, version int64) (result string, ok bool, retErr error) {
@@ -64,7 +170,218 @@ func (a *sharder) GetShardToAddress(version int64) (result map[uint64]string, re
 	return _result, nil
 }
 
+// CurrentAddresses returns the newest version's addresses. Only that
+// version is decoded, and not even that if it's already cached.
+func (a *sharder) CurrentAddresses() (int64, *Addresses, error) {
+	encodedAddresses, err := a.discoveryClient.GetAll(a.addressesDir())
+	if err != nil {
+		return InvalidVersion, nil, err
+	}
+	version, key := a.newestAddressesKey(encodedAddresses)
+	if version == InvalidVersion {
+		return InvalidVersion, nil, errors.Errorf("no addresses found")
+	}
+	a.addressesLock.Lock()
+	defer a.addressesLock.Unlock()
+	if addresses, ok := a.addresses[version]; ok {
+		return version, addresses, nil
+	}
+	var addresses Addresses
+	if err := jsonpb.UnmarshalString(encodedAddresses[key], &addresses); err != nil {
+		return InvalidVersion, nil, err
+	}
+	a.unsafeCacheAddresses(&addresses)
+	return version, &addresses, nil
+}
+
+func (a *sharder) Snapshot() (*Snapshot, error) {
+	version, addresses, err := a.CurrentAddresses()
+	if err != nil {
+		return nil, err
+	}
+	return newSnapshot(version, addresses, a.numShards), nil
+}
+
+func (a *sharder) ExportState() (*State, error) {
+	version, addresses, err := a.CurrentAddresses()
+	if err != nil {
+		return nil, err
+	}
+	encodedAddresses, err := marshaler.MarshalToString(addresses)
+	if err != nil {
+		return nil, err
+	}
+	result := &State{
+		NumShards: a.numShards,
+		Version:   version,
+		Addresses: json.RawMessage(encodedAddresses),
+	}
+	encodedServerRoles, err := a.discoveryClient.GetAll(a.serverRoleDir())
+	if err != nil {
+		return nil, err
+	}
+	var serverRoles []*ServerRole
+	for _, encodedServerRole := range encodedServerRoles {
+		serverRole, err := decodeServerRole(encodedServerRole)
+		if err != nil {
+			return nil, err
+		}
+		if serverRole.Version == version {
+			serverRoles = append(serverRoles, serverRole)
+		}
+	}
+	sort.Slice(serverRoles, func(i, j int) bool { return serverRoles[i].Address < serverRoles[j].Address })
+	for _, serverRole := range serverRoles {
+		encodedServerRole, err := marshaler.MarshalToString(serverRole)
+		if err != nil {
+			return nil, err
+		}
+		result.ServerRoles = append(result.ServerRoles, json.RawMessage(encodedServerRole))
+	}
+	return result, nil
+}
+
+func (a *sharder) ImportState(state *State) error {
+	if state.NumShards != a.numShards {
+		return errors.Errorf("state is for %d shards, but the sharder has %d", state.NumShards, a.numShards)
+	}
+	var addresses Addresses
+	if err := jsonpb.UnmarshalString(string(state.Addresses), &addresses); err != nil {
+		return errors.Wrapf(err, "could not decode addresses")
+	}
+	if addresses.Version != state.Version {
+		return errors.Errorf("addresses are for version %d, but state is for version %d", addresses.Version, state.Version)
+	}
+	for shard := range addresses.Addresses {
+		if shard >= a.numShards {
+			return errors.Errorf("addresses assign shard %d, which is out of range", shard)
+		}
+	}
+	var serverRoles []*ServerRole
+	for _, encodedServerRole := range state.ServerRoles {
+		serverRole, err := decodeServerRole(string(encodedServerRole))
+		if err != nil {
+			return errors.Wrapf(err, "could not decode server role")
+		}
+		if serverRole.Version != state.Version {
+			return errors.Errorf("server role of %s is for version %d, but state is for version %d", serverRole.Address, serverRole.Version, state.Version)
+		}
+		for shard := range serverRole.Shards {
+			if shard >= a.numShards {
+				return errors.Errorf("server role of %s has shard %d, which is out of range", serverRole.Address, shard)
+			}
+		}
+		serverRoles = append(serverRoles, serverRole)
+	}
+
+	// the addresses are created first, so that importing over an existing
+	// version fails before anything is written
+	encodedAddresses, err := marshaler.MarshalToString(&addresses)
+	if err != nil {
+		return err
+	}
+	if err := a.discoveryClient.Create(a.addressesKey(addresses.Version), encodedAddresses, 0); err != nil {
+		return errors.Wrapf(err, "could not write addresses of version %d", addresses.Version)
+	}
+	for _, serverRole := range serverRoles {
+		encodedServerRole, err := marshaler.MarshalToString(serverRole)
+		if err != nil {
+			return err
+		}
+		if err := a.discoveryClient.Set(a.serverRoleKeyVersion(serverRole.Address, serverRole.Version), encodedServerRole, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *sharder) Imbalance(version int64) (float64, error) {
+	addresses, err := a.getAddresses(version)
+	if err != nil {
+		return 0, err
+	}
+	return imbalance(addresses.Addresses), nil
+}
+
+// imbalance returns the ratio of the most shards that any address holds in
+// shardToAddress to the fewest, or 1 if there are no shards.
+func imbalance(shardToAddress map[uint64]string) float64 {
+	counts := make(map[string]int)
+	for _, address := range shardToAddress {
+		counts[address]++
+	}
+	if len(counts) == 0 {
+		return 1
+	}
+	min, max := math.MaxInt64, 0
+	for _, count := range counts {
+		if count < min {
+			min = count
+		}
+		if count > max {
+			max = count
+		}
+	}
+	return float64(max) / float64(min)
+}
+
+// newSnapshot builds a Snapshot of numShards shards from addresses.
+func newSnapshot(version int64, addresses *Addresses, numShards uint64) *Snapshot {
+	result := &Snapshot{Version: version}
+	for shard := uint64(0); shard < numShards; shard++ {
+		address, ok := addresses.Addresses[shard]
+		result.Shards = append(result.Shards, ShardSnapshot{
+			Shard:      shard,
+			Address:    address,
+			Unassigned: !ok,
+		})
+	}
+	return result
+}
+
+func (a *sharder) ListVersions() ([]int64, error) {
+	encodedAddresses, err := a.discoveryClient.GetAll(a.addressesDir())
+	if err != nil {
+		return nil, err
+	}
+	var result []int64
+	for key := range encodedAddresses {
+		version, err := strconv.ParseInt(path.Base(key), 10, 64)
+		if err != nil {
+			return nil, errors.Errorf("malformed addresses key %s", key)
+		}
+		result = append(result, version)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result, nil
+}
+
+func (a *sharder) GetShards(address string, version int64) (map[uint64]bool, error) {
+	addresses, err := a.getAddresses(version)
+	if err != nil {
+		return nil, err
+	}
+	a.addressesLock.RLock()
+	addressToShards, ok := a.addressToShards[addresses.Version]
+	a.addressesLock.RUnlock()
+	if !ok {
+		// the version has been evicted since it was read, so index it without
+		// caching it
+		addressToShards = indexAddresses(addresses)
+	}
+	result := make(map[uint64]bool)
+	for shard := range addressToShards[address] {
+		result[shard] = true
+	}
+	return result, nil
+}
+
 func (a *sharder) Register(address string, servers []Server) (retErr error) {
+	token, err := a.claimServer(address)
+	if err != nil {
+		return err
+	}
+	defer a.releaseServer(address, token)
 	var once sync.Once
 	versionChan := make(chan int64)
 	internalCancel := make(chan bool)
@@ -72,7 +389,7 @@ func (a *sharder) Register(address string, servers []Server) (retErr error) {
 	wg.Add(3)
 	go func() {
 		defer wg.Done()
-		if err := a.announceServers(address, servers, versionChan, internalCancel); err != nil {
+		if err := a.announceServers(address, token, servers, versionChan, internalCancel); err != nil {
 			once.Do(func() {
 				retErr = err
 				close(internalCancel)
@@ -96,6 +413,71 @@ func (a *sharder) Register(address string, servers []Server) (retErr error) {
 	return
 }
 
+// claimServer claims address for this process, with a random token that's
+// kept in the address's owner key until Register returns, so that two
+// processes that are misconfigured to share an address don't overwrite each
+// other's server state. A claim that's held by another process makes this
+// wait for up to claimGracePeriod for the claim to expire, as it does when
+// it was held by a previous run of this server, and fail if it doesn't, as
+// that means it's still being renewed by a live server.
+func (a *sharder) claimServer(address string) (string, error) {
+	tokenBytes := make([]byte, 16)
+	if _, err := cryptorand.Read(tokenBytes); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(tokenBytes)
+	deadline := time.Now().Add(a.claimGracePeriod)
+	for {
+		err := a.discoveryClient.Create(a.serverOwnerKey(address), token, holdTTL)
+		if err == nil {
+			// a server that was force-unregistered and has come back gets
+			// the grace period again
+			if err := a.discoveryClient.Delete(a.evictedKey(address)); err != nil && !errors.Is(err, discovery.ErrNotFound) {
+				return "", err
+			}
+			return token, nil
+		}
+		if !errors.Is(err, discovery.ErrConflict) {
+			return "", err
+		}
+		if time.Now().After(deadline) {
+			return "", errors.Errorf("%s is already registered by another live server", address)
+		}
+		a.logger.Infof("%s is registered by another server, waiting for its claim to expire", address)
+		time.Sleep(a.claimGracePeriod / 10)
+	}
+}
+
+// renewServerClaim renews this process's claim to address. A claim that has
+// expired, e.g. while discovery was unreachable, is taken again if no other
+// process has taken it in the meantime.
+func (a *sharder) renewServerClaim(address, token string) error {
+	err := a.discoveryClient.CheckAndSet(a.serverOwnerKey(address), token, holdTTL, token)
+	if errors.Is(err, discovery.ErrNotFound) || errors.Is(err, discovery.ErrConflict) {
+		// the claim expired or was removed, or was taken over, which
+		// Create tells apart
+		err = a.discoveryClient.Create(a.serverOwnerKey(address), token, holdTTL)
+		if errors.Is(err, discovery.ErrConflict) {
+			return errors.Errorf("%s has been registered by another server", address)
+		}
+	}
+	if err != nil {
+		return errors.Wrapf(err, "could not renew the claim to %s", address)
+	}
+	return nil
+}
+
+// releaseServer gives up this process's claim to address, if it still holds
+// it, so that the server can be restarted without waiting for it to expire
+func (a *sharder) releaseServer(address, token string) {
+	if owner, err := a.discoveryClient.Get(a.serverOwnerKey(address)); err != nil || owner != token {
+		return
+	}
+	if err := a.discoveryClient.Delete(a.serverOwnerKey(address)); err != nil {
+		a.logger.Errorf("Error releasing server claim: %s", err.Error())
+	}
+}
+
 func (a *sharder) RegisterFrontends(address string, frontends []Frontend) (retErr error) {
 	var once sync.Once
 	versionChan := make(chan int64)
@@ -128,34 +510,186 @@ func (a *sharder) RegisterFrontends(address string, frontends []Frontend) (retEr
 	return
 }
 
+// AssignRoles runs role assignment for as long as address holds the
+// AssignRoles lock, and stands by while another candidate holds it. Leaders
+// renew the lock every lockRenewInterval; if a leader stops renewing, e.g.
+// because it died, the lock expires after holdTTL and a standby takes over,
+// picking up the assignment from the roles in discovery. The lock is held
+// under both its namespaced key and the legacy un-namespaced one, see
+// legacyLockKey.
 func (a *sharder) AssignRoles(address string) (retErr error) {
 	var unsafeAssignRolesCancel chan bool
-	errChan := make(chan error)
-	// oldValue is the last value we wrote, if it's not "" it means we have the
-	// lock since we're the ones who set it last
-	oldValue := ""
+	errChan := make(chan error, 1)
+	// held is the lock keys that we hold, and leader is whether we hold all
+	// of them
+	held := make(map[string]bool)
+	leader := false
+	// running is whether unsafeAssignRoles is running, which it only does
+	// while we hold the lock
+	running := false
+	// after unsafeAssignRoles fails, it's only restarted once restartAt has
+	// passed, backing off exponentially while it keeps failing
+	b := backoff.NewInfiniteBackOff()
+	var restartAt time.Time
 	for {
-		if err := a.discoveryClient.CheckAndSet("lock", address, holdTTL, oldValue); err != nil {
-			if oldValue != "" {
+		if err := a.takeLocks(address, held); err != nil {
+			if leader {
 				// lock lost
-				oldValue = ""
-				close(unsafeAssignRolesCancel)
-				log.Errorf("sharder.AssignRoles error from unsafeAssignRolesCancel: %+v", <-errChan)
+				leader = false
+				var assignErr error = ErrCancelled
+				if running {
+					close(unsafeAssignRolesCancel)
+					assignErr = <-errChan
+					running = false
+				}
+				a.logger.Errorf("sharder.AssignRoles error from unsafeAssignRolesCancel: %+v", assignErr)
+				a.emit(&FinishAssignRoles{Error: assignErr.Error()})
+			} else if !errors.Is(err, discovery.ErrConflict) {
+				a.logger.Errorf("sharder.AssignRoles could not acquire lock: %+v", err)
 			}
 		} else {
-			if oldValue == "" {
+			if !leader {
 				// lock acquired
-				oldValue = address
+				leader = true
+				b.Reset()
+				restartAt = time.Time{}
+				a.logger.Info("sharder.AssignRoles acquired lock")
+				a.emit(&StartAssignRoles{})
+			}
+			if !running && !time.Now().Before(restartAt) {
+				running = true
 				unsafeAssignRolesCancel = make(chan bool)
-				go func() {
-					errChan <- a.unsafeAssignRoles(unsafeAssignRolesCancel)
-				}()
+				go func(cancel chan bool) {
+					errChan <- a.unsafeAssignRoles(cancel)
+				}(unsafeAssignRolesCancel)
+			}
+		}
+		select {
+		case err := <-errChan:
+			// assignment stopped while we still hold the lock; it's
+			// restarted after a backoff, at the first renewal of the lock
+			// after that, rather than leaving the lock held by a leader
+			// that isn't assigning
+			running = false
+			wait := b.NextBackOff()
+			restartAt = time.Now().Add(wait)
+			a.logger.Errorf("sharder.AssignRoles error from unsafeAssignRoles, restarting in %v: %+v", wait, err)
+		case <-time.After(a.lockRenewInterval):
+			if running {
+				// assignment has lasted a renewal without failing
+				b.Reset()
 			}
 		}
-		<-time.After(time.Second * time.Duration(holdTTL/2))
 	}
 }
 
+// takeLocks acquires, or renews, each of the AssignRoles lock keys for
+// address, recording which of them it holds in held. It fails as soon as one
+// of them is held by another candidate.
+func (a *sharder) takeLocks(address string, held map[string]bool) error {
+	for _, key := range a.lockKeys() {
+		// the old value is "" to acquire a key, or our own address to renew
+		// one that we set last
+		oldValue := ""
+		if held[key] {
+			oldValue = address
+		}
+		if err := a.discoveryClient.CheckAndSet(key, address, holdTTL, oldValue); err != nil {
+			delete(held, key)
+			return err
+		}
+		held[key] = true
+	}
+	return nil
+}
+
+func (a *sharder) ForceUnregister(address string) error {
+	// mark the server as evicted before removing it, so that AssignRoles
+	// moves its shards right away instead of waiting for it to come back
+	if err := a.discoveryClient.Set(a.evictedKey(address), "", holdTTL); err != nil {
+		return err
+	}
+	if err := a.discoveryClient.Delete(a.serverStateKey(address)); err != nil {
+		if err := a.discoveryClient.Delete(a.evictedKey(address)); err != nil && !errors.Is(err, discovery.ErrNotFound) {
+			a.logger.Errorf("Error removing eviction of %s: %s", address, err.Error())
+		}
+		return err
+	}
+	// the evicted server is gone, so its address can be registered again
+	// straight away
+	if err := a.discoveryClient.Delete(a.serverOwnerKey(address)); err != nil && !errors.Is(err, discovery.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (a *sharder) Validate(version int64) ([]string, error) {
+	addresses, err := a.getAddresses(version)
+	if err != nil {
+		return nil, err
+	}
+	version = addresses.Version
+	encodedServerRoles, err := a.discoveryClient.GetAll(a.serverRoleDir())
+	if err != nil {
+		return nil, err
+	}
+	shardToServers := make(map[uint64][]string)
+	serverRoles := make(map[string]*ServerRole)
+	for _, encodedServerRole := range encodedServerRoles {
+		serverRole, err := decodeServerRole(encodedServerRole)
+		if err != nil {
+			return nil, err
+		}
+		if serverRole.Version != version {
+			continue
+		}
+		serverRoles[serverRole.Address] = serverRole
+		for shard := range serverRole.Shards {
+			shardToServers[shard] = append(shardToServers[shard], serverRole.Address)
+		}
+	}
+	var result []string
+	for shard := uint64(0); shard < a.numShards; shard++ {
+		address, ok := addresses.Addresses[shard]
+		servers := shardToServers[shard]
+		sort.Strings(servers)
+		switch {
+		case !ok:
+			result = append(result, fmt.Sprintf("shard %d has no address", shard))
+		case !serverRoles[address].GetShards()[shard]:
+			result = append(result, fmt.Sprintf("shard %d has address %s, which has no role for it", shard, address))
+		}
+		if len(servers) > 1 {
+			result = append(result, fmt.Sprintf("shard %d is assigned to multiple servers: %s", shard, strings.Join(servers, ", ")))
+		}
+	}
+	var outOfRange []uint64
+	for shard := range addresses.Addresses {
+		if shard >= a.numShards {
+			outOfRange = append(outOfRange, shard)
+		}
+	}
+	sort.Slice(outOfRange, func(i, j int) bool { return outOfRange[i] < outOfRange[j] })
+	for _, shard := range outOfRange {
+		result = append(result, fmt.Sprintf("shard %d is out of range", shard))
+	}
+	if len(serverRoles) > 0 {
+		// assignShards gives each server at most this many shards
+		maxShards := (a.numShards + uint64(len(serverRoles)) - 1) / uint64(len(serverRoles))
+		var servers []string
+		for address := range serverRoles {
+			servers = append(servers, address)
+		}
+		sort.Strings(servers)
+		for _, address := range servers {
+			if numShards := uint64(len(serverRoles[address].Shards)); numShards > maxShards {
+				result = append(result, fmt.Sprintf("server %s has %d shards, more than its share of %d", address, numShards, maxShards))
+			}
+		}
+	}
+	return result, nil
+}
+
 // unsafeAssignRoles should be run
 func (a *sharder) unsafeAssignRoles(cancel chan bool) (retErr error) {
 	var version int64
@@ -186,28 +720,68 @@ func (a *sharder) unsafeAssignRoles(cancel chan bool) (retErr error) {
 			oldShards[shard] = oldServerRole.Address
 		}
 	}
-	err = a.discoveryClient.WatchAll(a.serverStateDir(), cancel,
+	// Roles don't survive for every shard, e.g. if their servers have
+	// gone, so also seed from the most recent addresses, which cover every
+	// shard. This keeps shards where they were across controller restarts.
+	versions, err := a.ListVersions()
+	if err != nil {
+		return err
+	}
+	if len(versions) > 0 {
+		latest := versions[len(versions)-1]
+		addresses, err := a.getAddresses(latest)
+		if err != nil {
+			return err
+		}
+		for shard, address := range addresses.Addresses {
+			if _, ok := oldShards[shard]; !ok {
+				oldShards[shard] = address
+			}
+		}
+		if version < latest+1 {
+			version = latest + 1
+		}
+	}
+	err = a.debouncedWatchAll(a.serverStateDir(), cancel, a.assignRolesDebounce,
 		func(encodedServerStates map[string]string) error {
-			if len(encodedServerStates) == 0 {
-				return nil
+			newServerStates, err := decodeServerStates(encodedServerStates)
+			if err != nil {
+				return err
 			}
-			newServerStates := make(map[string]*ServerState)
-			newRoles := make(map[string]*ServerRole)
-			newShards := make(map[uint64]string)
-			shardsPerServer := a.numShards / uint64(len(encodedServerStates))
-			shardsRemainder := a.numShards % uint64(len(encodedServerStates))
-			for _, encodedServerState := range encodedServerStates {
-				serverState, err := decodeServerState(encodedServerState)
+			gracePeriod := a.serverGracePeriod > 0 && missingServers(oldServers, newServerStates)
+			if gracePeriod {
+				// force-unregistered servers aren't coming back, so only
+				// wait if some other server is missing
+				encodedEvicted, err := a.discoveryClient.GetAll(a.evictedDir())
+				if err != nil {
+					return err
+				}
+				evicted := make(map[string]bool)
+				for key := range encodedEvicted {
+					evicted[strings.TrimPrefix(key, a.evictedDir()+"/")] = true
+				}
+				gracePeriod = missingServers(withoutServers(oldServers, evicted), newServerStates)
+			}
+			if gracePeriod {
+				// servers that miss a heartbeat usually come back, so give
+				// them a chance to before moving their shards
+				select {
+				case <-time.After(a.serverGracePeriod):
+				case <-cancel:
+					return discovery.ErrCancelled
+				}
+				encodedServerStates, err := a.discoveryClient.GetAll(a.serverStateDir())
 				if err != nil {
 					return err
 				}
-				newServerStates[serverState.Address] = serverState
-				newRoles[serverState.Address] = &ServerRole{
-					Address: serverState.Address,
-					Version: version,
-					Shards:  make(map[uint64]bool),
+				if newServerStates, err = decodeServerStates(encodedServerStates); err != nil {
+					return err
 				}
 			}
+			if len(newServerStates) == 0 {
+				a.reportUnassigned(nil, nil, "no servers are registered")
+				return nil
+			}
 			// See if there's any roles we can delete
 			minVersion := int64(math.MaxInt64)
 			for _, serverState := range newServerStates {
@@ -218,7 +792,7 @@ func (a *sharder) unsafeAssignRoles(cancel chan bool) (retErr error) {
 			// Delete roles that no servers are using anymore
 			if minVersion > oldMinVersion {
 				oldMinVersion = minVersion
-				if err := a.discoveryClient.WatchAll(
+				if err := a.watchAll(
 					a.frontendStateDir(),
 					cancel,
 					func(encodedFrontendStates map[string]string) error {
@@ -248,6 +822,7 @@ func (a *sharder) unsafeAssignRoles(cancel chan bool) (retErr error) {
 						if err := a.discoveryClient.Delete(key); err != nil {
 							return err
 						}
+						a.emit(&DeleteServerRole{ServerRole: serverRole})
 					}
 				}
 			}
@@ -256,22 +831,11 @@ func (a *sharder) unsafeAssignRoles(cancel chan bool) (retErr error) {
 			if sameServers(oldServers, newServerStates) {
 				return nil
 			}
-		Shard:
-			for shard := uint64(0); shard < a.numShards; shard++ {
-				if address, ok := oldShards[shard]; ok {
-					if assignShard(newRoles, newShards, address, shard, shardsPerServer, &shardsRemainder) {
-						continue Shard
-					}
-				}
-				for address := range newServerStates {
-					if assignShard(newRoles, newShards, address, shard, shardsPerServer, &shardsRemainder) {
-						continue Shard
-					}
-				}
-				log.Error(&FailedToAssignRoles{
-					ServerStates: newServerStates,
-					NumShards:    a.numShards,
-				})
+			newRoles, newShards, unassigned := assignShards(a.numShards, newServerStates, oldShards, a.pinnedShards, version, a.maxShardsPerServer, a.shuffle)
+			if len(unassigned) > 0 {
+				a.reportUnassigned(newServerStates, unassigned, "no server has room for these shards")
+			}
+			if len(newShards) == 0 {
 				return nil
 			}
 			addresses := Addresses{
@@ -286,6 +850,7 @@ func (a *sharder) unsafeAssignRoles(cancel chan bool) (retErr error) {
 				if err := a.discoveryClient.Set(a.serverRoleKeyVersion(address, version), encodedServerRole, 0); err != nil {
 					return err
 				}
+				a.emit(&SetServerRole{ServerRole: serverRole})
 				address := newServerStates[address].Address
 				for shard := range serverRole.Shards {
 					addresses.Addresses[shard] = address
@@ -298,6 +863,7 @@ func (a *sharder) unsafeAssignRoles(cancel chan bool) (retErr error) {
 			if err := a.discoveryClient.Set(a.addressesKey(version), encodedAddresses, 0); err != nil {
 				return err
 			}
+			a.emit(&SetAddresses{Addresses: &addresses})
 			version++
 			oldServers = make(map[string]bool)
 			for address := range newServerStates {
@@ -313,9 +879,83 @@ func (a *sharder) unsafeAssignRoles(cancel chan bool) (retErr error) {
 	return err
 }
 
+func decodeServerStates(encodedServerStates map[string]string) (map[string]*ServerState, error) {
+	result := make(map[string]*ServerState)
+	for _, encodedServerState := range encodedServerStates {
+		serverState, err := decodeServerState(encodedServerState)
+		if err != nil {
+			return nil, err
+		}
+		result[serverState.Address] = serverState
+	}
+	return result, nil
+}
+
+// missingServers returns whether any of oldServers is missing from
+// serverStates
+func missingServers(oldServers map[string]bool, serverStates map[string]*ServerState) bool {
+	for address := range oldServers {
+		if _, ok := serverStates[address]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutServers returns the addresses in servers that aren't in excluded
+func withoutServers(servers map[string]bool, excluded map[string]bool) map[string]bool {
+	if len(excluded) == 0 {
+		return servers
+	}
+	result := make(map[string]bool)
+	for address := range servers {
+		if !excluded[address] {
+			result[address] = true
+		}
+	}
+	return result
+}
+
+// reportUnassigned reports that role assignment couldn't place some shards,
+// so that operators can see that the cluster is under-provisioned. If shards
+// is empty, none of the shards could be placed.
+func (a *sharder) reportUnassigned(serverStates map[string]*ServerState, shards []uint64, reason string) {
+	event := &FailedToAssignRoles{
+		ServerStates: serverStates,
+		NumShards:    a.numShards,
+	}
+	a.emit(event)
+	fields := log.Fields{"reason": reason}
+	if len(shards) > 0 {
+		fields["shards"] = shards
+	}
+	a.logger.WithFields(fields).Error(event)
+}
+
 func (a *sharder) WaitForAvailability(frontendAddresses []string, serverAddresses []string) error {
 	version := InvalidVersion
-	if err := a.discoveryClient.WatchAll(a.serverDir(), nil,
+	var lagging map[string]int64
+	var laggingLock sync.Mutex
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(skewThreshold)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				laggingLock.Lock()
+				toReport := lagging
+				laggingLock.Unlock()
+				if len(toReport) > 0 {
+					a.reportSkew(toReport)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	if err := a.watchAll(a.serverDir(), nil,
 		func(encodedServerStatesAndRoles map[string]string) error {
 			serverStates := make(map[string]*ServerState)
 			serverRoles := make(map[string]map[int64]*ServerRole)
@@ -338,6 +978,9 @@ func (a *sharder) WaitForAvailability(frontendAddresses []string, serverAddresse
 					serverRoles[serverRole.Address][serverRole.Version] = serverRole
 				}
 			}
+			laggingLock.Lock()
+			lagging = laggingServers(serverAddresses, serverStates)
+			laggingLock.Unlock()
 			if len(serverStates) != len(serverAddresses) {
 				return nil
 			}
@@ -381,7 +1024,7 @@ func (a *sharder) WaitForAvailability(frontendAddresses []string, serverAddresse
 		return err
 	}
 
-	if err := a.discoveryClient.WatchAll(
+	if err := a.watchAll(
 		a.frontendStateDir(),
 		nil,
 		func(encodedFrontendStates map[string]string) error {
@@ -412,6 +1055,27 @@ func (a *sharder) WaitForAvailability(frontendAddresses []string, serverAddresse
 	return nil
 }
 
+// laggingServers returns the version of each server in serverAddresses that
+// isn't at the newest version in serverStates.
+func laggingServers(serverAddresses []string, serverStates map[string]*ServerState) map[string]int64 {
+	newest := InvalidVersion
+	for _, serverState := range serverStates {
+		if serverState.Version > newest {
+			newest = serverState.Version
+		}
+	}
+	result := make(map[string]int64)
+	for _, address := range serverAddresses {
+		serverState, ok := serverStates[address]
+		if !ok {
+			result[address] = InvalidVersion
+		} else if serverState.Version != newest || newest == InvalidVersion {
+			result[address] = serverState.Version
+		}
+	}
+	return result
+}
+
 type localSharder struct {
 	shardToAddress map[uint64]string
 }
@@ -433,6 +1097,48 @@ func (s *localSharder) GetShardToAddress(version int64) (map[uint64]string, erro
 	return s.shardToAddress, nil
 }
 
+func (s *localSharder) GetShards(address string, version int64) (map[uint64]bool, error) {
+	result := make(map[uint64]bool)
+	for shard, shardAddress := range s.shardToAddress {
+		if shardAddress == address {
+			result[shard] = true
+		}
+	}
+	return result, nil
+}
+
+func (s *localSharder) CurrentAddresses() (int64, *Addresses, error) {
+	return 0, &Addresses{Version: 0, Addresses: s.shardToAddress}, nil
+}
+
+func (s *localSharder) ListVersions() ([]int64, error) {
+	return []int64{0}, nil
+}
+
+func (s *localSharder) Snapshot() (*Snapshot, error) {
+	return newSnapshot(0, &Addresses{Version: 0, Addresses: s.shardToAddress}, uint64(len(s.shardToAddress))), nil
+}
+
+func (s *localSharder) ExportState() (*State, error) {
+	encodedAddresses, err := marshaler.MarshalToString(&Addresses{Version: 0, Addresses: s.shardToAddress})
+	if err != nil {
+		return nil, err
+	}
+	return &State{
+		NumShards: uint64(len(s.shardToAddress)),
+		Version:   0,
+		Addresses: json.RawMessage(encodedAddresses),
+	}, nil
+}
+
+func (s *localSharder) ImportState(state *State) error {
+	return errors.Errorf("a local sharder's assignment is fixed, and can't be imported")
+}
+
+func (s *localSharder) Imbalance(version int64) (float64, error) {
+	return imbalance(s.shardToAddress), nil
+}
+
 func (s *localSharder) Register(address string, servers []Server) error {
 	return nil
 }
@@ -445,14 +1151,237 @@ func (s *localSharder) AssignRoles(string) error {
 	return nil
 }
 
+func (s *localSharder) ForceUnregister(address string) error {
+	return nil
+}
+
+func (s *localSharder) Validate(version int64) ([]string, error) {
+	return nil, nil
+}
+
+// virtualSharder is a sharder whose shards are each split into virtualNodes
+// virtual nodes, which are what roles are assigned for. Virtual node i of
+// shard s is shard s*virtualNodes+i of the underlying sharder.
+type virtualSharder struct {
+	*sharder
+	virtualNodes uint64
+}
+
+func (s *virtualSharder) node(shard, node uint64) uint64 {
+	return shard*s.virtualNodes + node
+}
+
+// GetAddress returns the address of the server holding the first virtual
+// node of shard, which requests for the whole shard are routed to
+func (s *virtualSharder) GetAddress(shard uint64, version int64) (string, bool, error) {
+	return s.sharder.GetAddress(s.node(shard, 0), version)
+}
+
+func (s *virtualSharder) GetNodeAddress(shard uint64, node uint64, version int64) (string, bool, error) {
+	if node >= s.virtualNodes {
+		return "", false, errors.Errorf("shard %d has no virtual node %d", shard, node)
+	}
+	return s.sharder.GetAddress(s.node(shard, node), version)
+}
+
+func (s *virtualSharder) GetShardToAddress(version int64) (map[uint64]string, error) {
+	nodeToAddress, err := s.sharder.GetShardToAddress(version)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[uint64]string)
+	for node, address := range nodeToAddress {
+		if node%s.virtualNodes == 0 {
+			result[node/s.virtualNodes] = address
+		}
+	}
+	return result, nil
+}
+
+// GetShards returns the shards that address holds at least one virtual node
+// of
+func (s *virtualSharder) GetShards(address string, version int64) (map[uint64]bool, error) {
+	nodes, err := s.sharder.GetShards(address, version)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[uint64]bool)
+	for node := range nodes {
+		result[node/s.virtualNodes] = true
+	}
+	return result, nil
+}
+
+func (s *virtualSharder) Register(address string, servers []Server) error {
+	virtualServers := make([]Server, len(servers))
+	for i, server := range servers {
+		virtualServers[i] = &virtualServer{
+			Server:       server,
+			virtualNodes: s.virtualNodes,
+			nodes:        make(map[uint64]uint64),
+		}
+	}
+	return s.sharder.Register(address, virtualServers)
+}
+
+// virtualServer adapts a Server to being given virtual nodes. The server is
+// given a shard along with the first of the shard's virtual nodes that it
+// holds, and has it deleted along with the last.
+type virtualServer struct {
+	Server
+	virtualNodes uint64
+	// mu is held while the server is called, so that a shard isn't deleted
+	// while it's still being added
+	mu sync.Mutex
+	// nodes is the number of virtual nodes of each shard that the server
+	// holds
+	nodes map[uint64]uint64
+}
+
+func (s *virtualServer) AddShard(node uint64) error {
+	shard := node / s.virtualNodes
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.nodes[shard] == 0 {
+		if err := s.Server.AddShard(shard); err != nil {
+			return err
+		}
+	}
+	s.nodes[shard]++
+	return nil
+}
+
+func (s *virtualServer) DeleteShard(node uint64) error {
+	shard := node / s.virtualNodes
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.nodes[shard] == 1 {
+		if err := s.Server.DeleteShard(shard); err != nil {
+			return err
+		}
+	}
+	if s.nodes[shard] > 0 {
+		s.nodes[shard]--
+	}
+	if s.nodes[shard] == 0 {
+		delete(s.nodes, shard)
+	}
+	return nil
+}
+
+// watchAll is like the discovery client's WatchAll, except that if the watch
+// fails for any reason other than cancellation or an error from callBack, it's
+// restarted after an exponential backoff instead of returning the error. This
+// lets long-running watches survive transient discovery outages.
+func (a *sharder) watchAll(key string, cancel chan bool, callBack func(map[string]string) error) error {
+	b := backoff.NewInfiniteBackOff()
+	for {
+		var callBackErr error
+		err := a.discoveryClient.WatchAll(key, cancel, func(values map[string]string) error {
+			if err := callBack(values); err != nil {
+				callBackErr = err
+				return err
+			}
+			b.Reset()
+			return nil
+		})
+		if err == nil || callBackErr != nil || errors.Is(err, discovery.ErrCancelled) {
+			return err
+		}
+		wait := b.NextBackOff()
+		a.logger.Errorf("watch of %s failed, retrying in %v: %v", key, wait, err)
+		select {
+		case <-cancel:
+			return discovery.ErrCancelled
+		case <-time.After(wait):
+		}
+	}
+}
+
+// debouncedWatchAll is like watchAll, except that changes which arrive
+// within window of each other are coalesced, so that callBack is only called
+// with the latest values once they've been unchanged for window. Cancellation
+// takes effect immediately, even if a change is pending. A window of 0 calls
+// callBack for every change, like watchAll.
+func (a *sharder) debouncedWatchAll(key string, cancel chan bool, window time.Duration, callBack func(map[string]string) error) error {
+	if window <= 0 {
+		return a.watchAll(key, cancel, callBack)
+	}
+	// values holds the latest change that hasn't been seen yet; the watch
+	// replaces it rather than queueing behind it
+	values := make(chan map[string]string, 1)
+	stop := make(chan bool)
+	defer close(stop)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- a.watchAll(key, stop, func(newValues map[string]string) error {
+			select {
+			case <-values:
+			default:
+			}
+			values <- newValues
+			return nil
+		})
+	}()
+	var pending map[string]string
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-cancel:
+			return discovery.ErrCancelled
+		case err := <-errChan:
+			return err
+		case pending = <-values:
+			timer = time.After(window)
+		case <-timer:
+			timer = nil
+			if err := callBack(pending); err != nil {
+				return err
+			}
+		}
+	}
+}
+
 func (a *sharder) routeDir() string {
 	return fmt.Sprintf("%s/pfs/route", a.namespace)
 }
 
+func (a *sharder) lockKey() string {
+	return path.Join(a.routeDir(), "lock")
+}
+
+// legacyLockKey is the un-namespaced key that AssignRoles was locked with in
+// earlier releases. Leaders take it before lockKey, so that they exclude
+// leaders from those releases during a rolling upgrade. It can be dropped once
+// no release that only takes it is still running.
+func (a *sharder) legacyLockKey() string {
+	return "lock"
+}
+
+// lockKeys returns the keys that a leader must hold, in the order that
+// they're taken
+func (a *sharder) lockKeys() []string {
+	return []string{a.legacyLockKey(), a.lockKey()}
+}
+
 func (a *sharder) serverDir() string {
 	return path.Join(a.routeDir(), "server")
 }
 
+func (a *sharder) serverOwnerKey(address string) string {
+	return path.Join(a.routeDir(), "owner", address)
+}
+
+// evictedDir holds a short-lived marker for each server that's been
+// force-unregistered, which tells AssignRoles not to wait for it to return
+func (a *sharder) evictedDir() string {
+	return path.Join(a.routeDir(), "evicted")
+}
+
+func (a *sharder) evictedKey(address string) string {
+	return path.Join(a.evictedDir(), address)
+}
+
 func (a *sharder) serverStateDir() string {
 	return path.Join(a.serverDir(), "state")
 }
@@ -518,8 +1447,9 @@ func decodeServerRole(encodedServerRole string) (*ServerRole, error) {
 }
 
 func (a *sharder) getAddresses(version int64) (*Addresses, error) {
-	if version == InvalidVersion {
-		return nil, errors.Errorf("invalid version")
+	if version == CurrentVersion {
+		_, addresses, err := a.CurrentAddresses()
+		return addresses, err
 	}
 	a.addressesLock.RLock()
 	if addresses, ok := a.addresses[version]; ok {
@@ -537,10 +1467,93 @@ func (a *sharder) getAddresses(version int64) (*Addresses, error) {
 	if err := jsonpb.UnmarshalString(encodedAddresses, &addresses); err != nil {
 		return nil, err
 	}
-	a.addresses[version] = &addresses
+	a.unsafeCacheAddresses(&addresses)
 	return &addresses, nil
 }
 
+// newestAddressesKey returns the newest version in a set of addresses read
+// from the addresses directory, and the key it's stored under, going by the
+// keys alone. It returns InvalidVersion if there are none.
+func (a *sharder) newestAddressesKey(encodedAddresses map[string]string) (int64, string) {
+	newest := InvalidVersion
+	var newestKey string
+	for key := range encodedAddresses {
+		version, err := strconv.ParseInt(path.Base(key), 10, 64)
+		if err != nil {
+			a.logger.Errorf("malformed addresses key %s", key)
+			continue
+		}
+		if newest == InvalidVersion || version > newest {
+			newest = version
+			newestKey = key
+		}
+	}
+	return newest, newestKey
+}
+
+// preloadAddresses keeps the newest version's addresses cached, so that
+// lookups of it don't have to go to discovery. It's best-effort: failures are
+// logged, and lookups fall back to reading from discovery. It returns once
+// cancel is closed.
+func (a *sharder) preloadAddresses(cancel chan bool) {
+	if err := a.watchAll(a.addressesDir(), cancel, func(encodedAddresses map[string]string) error {
+		newest, newestKey := a.newestAddressesKey(encodedAddresses)
+		if newest == InvalidVersion {
+			return nil
+		}
+		a.addressesLock.RLock()
+		_, ok := a.addresses[newest]
+		a.addressesLock.RUnlock()
+		if ok {
+			return nil
+		}
+		var addresses Addresses
+		if err := jsonpb.UnmarshalString(encodedAddresses[newestKey], &addresses); err != nil {
+			a.logger.Errorf("preloadAddresses: could not decode %s: %v", newestKey, err)
+			return nil
+		}
+		a.addressesLock.Lock()
+		defer a.addressesLock.Unlock()
+		a.unsafeCacheAddresses(&addresses)
+		return nil
+	}); err != nil && !errors.Is(err, discovery.ErrCancelled) {
+		a.logger.Errorf("preloadAddresses: %v", err)
+	}
+}
+
+// unsafeCacheAddresses caches addresses along with their reverse index. Only
+// the newest version cached and the one before it are kept, as those are the
+// only versions that servers may still be using; older versions are evicted,
+// and are read again from discovery if they're requested. It must be called
+// with addressesLock held for writing.
+func (a *sharder) unsafeCacheAddresses(addresses *Addresses) {
+	a.addresses[addresses.Version] = addresses
+	a.addressToShards[addresses.Version] = indexAddresses(addresses)
+	newest := addresses.Version
+	for version := range a.addresses {
+		if version > newest {
+			newest = version
+		}
+	}
+	for version := range a.addresses {
+		if version < newest-1 {
+			delete(a.addresses, version)
+			delete(a.addressToShards, version)
+		}
+	}
+}
+
+func indexAddresses(addresses *Addresses) map[string]map[uint64]bool {
+	result := make(map[string]map[uint64]bool)
+	for shard, address := range addresses.Addresses {
+		if _, ok := result[address]; !ok {
+			result[address] = make(map[uint64]bool)
+		}
+		result[address][shard] = true
+	}
+	return result
+}
+
 func hasShard(serverRole *ServerRole, shard uint64) bool {
 	return serverRole.Shards[shard]
 }
@@ -575,8 +1588,103 @@ func assignShard(
 	return true
 }
 
+// assignShards distributes numShards shards as evenly as possible between
+// the servers in serverStates, keeping shards on the servers that held them
+// in oldShards where it can. It returns the new role of each server and the
+// new shard to address mapping, along with the shards that couldn't be
+// assigned, which are left out of both. Shards without a previous holder go
+// to the first server with room in the order chosen by shuffle.
+func assignShards(
+	numShards uint64,
+	serverStates map[string]*ServerState,
+	oldShards map[uint64]string,
+	pinnedShards map[uint64]string,
+	version int64,
+	maxShardsPerServer uint64,
+	shuffle func(n int, swap func(i, j int)),
+) (map[string]*ServerRole, map[uint64]string, []uint64) {
+	roles := make(map[string]*ServerRole)
+	shards := make(map[uint64]string)
+	var unassigned []uint64
+	if len(serverStates) == 0 {
+		// there's no one to assign shards to, this can happen transiently
+		// while membership is changing
+		for shard := uint64(0); shard < numShards; shard++ {
+			unassigned = append(unassigned, shard)
+		}
+		return roles, shards, unassigned
+	}
+	var addresses []string
+	for address := range serverStates {
+		roles[address] = &ServerRole{
+			Address: address,
+			Version: version,
+			Shards:  make(map[uint64]bool),
+		}
+		addresses = append(addresses, address)
+	}
+	// sorting first means that the order only depends on shuffle, and not on
+	// map iteration
+	sort.Strings(addresses)
+	shuffle(len(addresses), func(i, j int) { addresses[i], addresses[j] = addresses[j], addresses[i] })
+	shardsPerServer := numShards / uint64(len(serverStates))
+	shardsRemainder := numShards % uint64(len(serverStates))
+	if maxShardsPerServer > 0 && shardsPerServer >= maxShardsPerServer {
+		// there are too few servers to hold every shard, so the ones that
+		// don't fit are left unassigned
+		shardsPerServer = maxShardsPerServer
+		shardsRemainder = 0
+	}
+	// pinned shards get the first claim on their servers' room, and go
+	// through the usual assignment if their servers are gone or full
+	var pinned []uint64
+	for shard := range pinnedShards {
+		if shard < numShards {
+			pinned = append(pinned, shard)
+		}
+	}
+	sort.Slice(pinned, func(i, j int) bool { return pinned[i] < pinned[j] })
+	for _, shard := range pinned {
+		assignShard(roles, shards, pinnedShards[shard], shard, shardsPerServer, &shardsRemainder)
+	}
+Shard:
+	for shard := uint64(0); shard < numShards; shard++ {
+		if _, ok := shards[shard]; ok {
+			continue
+		}
+		if address, ok := oldShards[shard]; ok {
+			if assignShard(roles, shards, address, shard, shardsPerServer, &shardsRemainder) {
+				continue Shard
+			}
+		}
+		for _, address := range addresses {
+			if assignShard(roles, shards, address, shard, shardsPerServer, &shardsRemainder) {
+				continue Shard
+			}
+		}
+		unassigned = append(unassigned, shard)
+	}
+	return roles, shards, unassigned
+}
+
+// announceInterval returns how long to wait before next refreshing a server
+// or frontend state. It's holdTTL/2, shortened by a random amount of up to
+// announceJitter, so that it never gets closer to the state expiring.
+func (a *sharder) announceInterval() time.Duration {
+	interval := time.Second * time.Duration(holdTTL/2)
+	jitter := a.announceJitter
+	if jitter > interval {
+		jitter = interval
+	}
+	if jitter <= 0 {
+		return interval
+	}
+	return interval - time.Duration(rand.Int63n(int64(jitter)))
+}
+
 func (a *sharder) announceServers(
 	address string,
+	token string,
 	servers []Server,
 	versionChan chan int64,
 	cancel chan bool,
@@ -586,19 +1694,22 @@ func (a *sharder) announceServers(
 		Version: InvalidVersion,
 	}
 	for {
+		if err := a.renewServerClaim(address, token); err != nil {
+			return err
+		}
 		encodedServerState, err := marshaler.MarshalToString(serverState)
 		if err != nil {
 			return err
 		}
 		if err := a.discoveryClient.Set(a.serverStateKey(address), encodedServerState, holdTTL); err != nil {
-			log.Errorf("Error setting server state: %s", err.Error())
+			a.logger.Errorf("Error setting server state: %s", err.Error())
 		}
 		select {
 		case <-cancel:
 			return nil
 		case version := <-versionChan:
 			serverState.Version = version
-		case <-time.After(time.Second * time.Duration(holdTTL/2)):
+		case <-time.After(a.announceInterval()):
 		}
 	}
 }
@@ -619,14 +1730,14 @@ func (a *sharder) announceFrontends(
 			return err
 		}
 		if err := a.discoveryClient.Set(a.frontendStateKey(address), encodedFrontendState, holdTTL); err != nil {
-			log.Errorf("Error setting server state: %s", err.Error())
+			a.logger.Errorf("Error setting server state: %s", err.Error())
 		}
 		select {
 		case <-cancel:
 			return nil
 		case version := <-versionChan:
 			frontendState.Version = version
-		case <-time.After(time.Second * time.Duration(holdTTL/2)):
+		case <-time.After(a.announceInterval()):
 		}
 	}
 }
@@ -644,7 +1755,7 @@ func (a *sharder) fillRoles(
 	cancel chan bool,
 ) error {
 	oldRoles := make(map[int64]ServerRole)
-	return a.discoveryClient.WatchAll(
+	return a.watchAll(
 		a.serverRoleKey(address),
 		cancel,
 		func(encodedServerRoles map[string]string) error {
@@ -660,81 +1771,87 @@ func (a *sharder) fillRoles(
 				versions = append(versions, serverRole.Version)
 			}
 			sort.Sort(versions)
+			// Only the two oldest versions are filled. A server has to keep
+			// the shards of every version that hasn't been retired, since
+			// frontends route to it by the oldest version that any server is
+			// still on, so it can't skip ahead to newer ones.
 			if len(versions) > 2 {
 				versions = versions[0:2]
 			}
-			// For each new version bring the server up to date
+			current := make(map[int64]ServerRole)
+			for _, version := range versions {
+				current[version] = roles[version]
+			}
+			// Bring the server up to date one version at a time. A shard
+			// that's in more than one version of the window is only added
+			// once.
+			filled := make(map[int64]ServerRole)
+			for version, serverRole := range oldRoles {
+				filled[version] = serverRole
+			}
 			for _, version := range versions {
 				if _, ok := oldRoles[version]; ok {
 					// we've already seen these roles, so nothing to do here
 					continue
 				}
-				serverRole := roles[version]
-				var wg sync.WaitGroup
-				var addShardErr error
-				for _, shard := range shards(serverRole) {
-					if !containsShard(oldRoles, shard) {
-						shard := shard
-						for _, server := range servers {
-							wg.Add(1)
-							server := server
-							go func() {
-								defer wg.Done()
-								if err := server.AddShard(shard); err != nil && addShardErr == nil {
-									addShardErr = err
-								}
-							}()
-						}
+				var addedShards []uint64
+				for _, shard := range shards(roles[version]) {
+					if !containsShard(filled, shard) {
+						addedShards = append(addedShards, shard)
 					}
 				}
-				wg.Wait()
-				if addShardErr != nil {
-					return addShardErr
+				if err := forEachShard(servers, addedShards, Server.AddShard); err != nil {
+					return err
 				}
-				oldRoles[version] = serverRole
+				filled[version] = roles[version]
 				versionChan <- version
 			}
-			// See if there are any old roles that aren't needed
-			for version, serverRole := range oldRoles {
-				var wg sync.WaitGroup
-				var removeShardErr error
-				if _, ok := roles[version]; ok {
-					// these roles haven't expired yet, so nothing to do
-					continue
-				}
+			// Shards are only removed once no version in the window needs
+			// them
+			var removedShards []uint64
+			for _, serverRole := range oldRoles {
 				for _, shard := range shards(serverRole) {
-					if !containsShard(roles, shard) {
-						shard := shard
-						for _, server := range servers {
-							server := server
-							wg.Add(1)
-							go func(shard uint64) {
-								defer wg.Done()
-								if err := server.DeleteShard(shard); err != nil && removeShardErr == nil {
-									removeShardErr = err
-								}
-							}(shard)
-						}
+					if !containsShard(current, shard) && !containsUint64(removedShards, shard) {
+						removedShards = append(removedShards, shard)
 					}
 				}
-				wg.Wait()
-				if removeShardErr != nil {
-					log.Error(&RemoveServerRole{
+			}
+			// oldRoles is a map, so removals are put back in shard order
+			sort.Slice(removedShards, func(i, j int) bool { return removedShards[i] < removedShards[j] })
+			// Remove shards that none of the current roles need anymore
+			if err := forEachShard(servers, removedShards, Server.DeleteShard); err != nil {
+				for version, serverRole := range oldRoles {
+					if _, ok := current[version]; ok {
+						continue
+					}
+					serverRole := serverRole
+					a.logger.Error(&RemoveServerRole{
 						ServerRole: &serverRole,
-						Error:      removeShardErr.Error(),
+						Error:      err.Error(),
 					})
-					return removeShardErr
 				}
+				return err
 			}
-			oldRoles = make(map[int64]ServerRole)
-			for _, version := range versions {
-				oldRoles[version] = roles[version]
-			}
+			oldRoles = current
 			return nil
 		},
 	)
 }
 
+// forEachShard calls f concurrently for each server and shard, and returns
+// the first error encountered.
+func forEachShard(servers []Server, shards []uint64, f func(Server, uint64) error) error {
+	var eg errgroup.Group
+	for _, shard := range shards {
+		shard := shard
+		for _, server := range servers {
+			server := server
+			eg.Go(func() error { return f(server, shard) })
+		}
+	}
+	return eg.Wait()
+}
+
 func (a *sharder) runFrontends(
 	address string,
 	frontends []Frontend,
@@ -742,7 +1859,7 @@ func (a *sharder) runFrontends(
 	cancel chan bool,
 ) error {
 	version := InvalidVersion
-	return a.discoveryClient.WatchAll(
+	return a.watchAll(
 		a.serverStateDir(),
 		cancel,
 		func(encodedServerStates map[string]string) error {
@@ -775,11 +1892,14 @@ func (a *sharder) runFrontends(
 		})
 }
 
+// shards returns the shards of serverRole in ascending order, so that the
+// shards that fillRoles adds and removes are computed in a reproducible order
 func shards(serverRole ServerRole) []uint64 {
 	var result []uint64
 	for shard := range serverRole.Shards {
 		result = append(result, shard)
 	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
 	return result
 }
 
@@ -792,6 +1912,15 @@ func containsShard(roles map[int64]ServerRole, shard uint64) bool {
 	return false
 }
 
+func containsUint64(values []uint64, value uint64) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 func sameServers(oldServers map[string]bool, newServerStates map[string]*ServerState) bool {
 	if len(oldServers) != len(newServerStates) {
 		return false
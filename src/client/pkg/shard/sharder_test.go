@@ -0,0 +1,1124 @@
+package shard
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/pachyderm/pachyderm/src/client/pkg/discovery"
+	"github.com/pachyderm/pachyderm/src/client/pkg/errors"
+	"github.com/pachyderm/pachyderm/src/client/pkg/require"
+)
+
+func testServerStates(numServers int) map[string]*ServerState {
+	serverStates := make(map[string]*ServerState)
+	for i := 0; i < numServers; i++ {
+		address := fmt.Sprintf("server-%d", i)
+		serverStates[address] = &ServerState{Address: address}
+	}
+	return serverStates
+}
+
+// assignTestRoles registers numServers servers with a, and runs role
+// assignment until it has written the first version's addresses
+func assignTestRoles(t *testing.T, a *sharder, numServers int) {
+	t.Helper()
+	events := make(chan proto.Message, 1000)
+	a.events = events
+	for address := range testServerStates(numServers) {
+		setServerState(t, a, &ServerState{Address: address, Version: InvalidVersion})
+	}
+	cancel := make(chan bool)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- a.unsafeAssignRoles(cancel)
+	}()
+	defer func() {
+		close(cancel)
+		require.Equal(t, ErrCancelled, <-errChan)
+	}()
+	for {
+		select {
+		case event := <-events:
+			if _, ok := event.(*SetAddresses); ok {
+				return
+			}
+		case err := <-errChan:
+			t.Fatalf("role assignment exited: %v", err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for addresses")
+		}
+	}
+}
+
+func TestVirtualShardDistribution(t *testing.T) {
+	numShards := uint64(4)
+	virtualNodes := uint64(16)
+	numServers := 3
+
+	// variance returns the variance of the fraction of routing units held by
+	// each server
+	variance := func(held map[string]int, total int) float64 {
+		require.Equal(t, numServers, len(held))
+		mean := 1 / float64(numServers)
+		var result float64
+		for _, n := range held {
+			diff := float64(n)/float64(total) - mean
+			result += diff * diff
+		}
+		return result / float64(numServers)
+	}
+
+	plain := NewSharder(newTestDiscoveryClient(), numShards, "test").(*sharder)
+	assignTestRoles(t, plain, numServers)
+	plainHeld := make(map[string]int)
+	for shard := uint64(0); shard < numShards; shard++ {
+		address, ok, err := plain.GetAddress(shard, CurrentVersion)
+		require.NoError(t, err)
+		require.True(t, ok)
+		plainHeld[address]++
+	}
+
+	virtual := NewVirtualSharder(newTestDiscoveryClient(), numShards, virtualNodes, "test")
+	assignTestRoles(t, virtual.(*virtualSharder).sharder, numServers)
+	virtualHeld := make(map[string]int)
+	for shard := uint64(0); shard < numShards; shard++ {
+		for node := uint64(0); node < virtualNodes; node++ {
+			address, ok, err := virtual.GetNodeAddress(shard, node, CurrentVersion)
+			require.NoError(t, err)
+			require.True(t, ok)
+			virtualHeld[address]++
+		}
+		// whole shards are routed to the server holding their first virtual
+		// node, which holds the shard
+		address, ok, err := virtual.GetAddress(shard, CurrentVersion)
+		require.NoError(t, err)
+		require.True(t, ok)
+		firstAddress, _, err := virtual.GetNodeAddress(shard, 0, CurrentVersion)
+		require.NoError(t, err)
+		require.Equal(t, firstAddress, address)
+		shards, err := virtual.GetShards(address, CurrentVersion)
+		require.NoError(t, err)
+		require.True(t, shards[shard])
+	}
+	shardToAddress, err := virtual.GetShardToAddress(CurrentVersion)
+	require.NoError(t, err)
+	require.Equal(t, int(numShards), len(shardToAddress))
+
+	require.True(t, variance(virtualHeld, int(numShards*virtualNodes)) < variance(plainHeld, int(numShards)))
+}
+
+func TestVirtualServer(t *testing.T) {
+	server := &testServer{}
+	s := &virtualServer{Server: server, virtualNodes: 4, nodes: make(map[uint64]uint64)}
+	// the server is given shard 1 with the first of its virtual nodes
+	require.NoError(t, s.AddShard(4))
+	require.NoError(t, s.AddShard(5))
+	require.NoError(t, s.AddShard(8))
+	require.Equal(t, []uint64{1, 2}, server.added)
+	// and keeps it until it loses the last of them
+	require.NoError(t, s.DeleteShard(4))
+	require.Equal(t, 0, len(server.deleted))
+	require.NoError(t, s.DeleteShard(5))
+	require.Equal(t, []uint64{1}, server.deleted)
+}
+
+// testServer records the shards that are added to and deleted from it.
+type testServer struct {
+	mu      sync.Mutex
+	added   []uint64
+	deleted []uint64
+}
+
+func (s *testServer) AddShard(shard uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.added = append(s.added, shard)
+	return nil
+}
+
+func (s *testServer) DeleteShard(shard uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleted = append(s.deleted, shard)
+	return nil
+}
+
+func setServerRole(t *testing.T, a *sharder, serverRole *ServerRole) {
+	encodedServerRole, err := marshaler.MarshalToString(serverRole)
+	require.NoError(t, err)
+	require.NoError(t, a.discoveryClient.Set(a.serverRoleKeyVersion(serverRole.Address, serverRole.Version), encodedServerRole, 0))
+}
+
+func setServerState(t *testing.T, a *sharder, serverState *ServerState) {
+	encodedServerState, err := marshaler.MarshalToString(serverState)
+	require.NoError(t, err)
+	require.NoError(t, a.discoveryClient.Set(a.serverStateKey(serverState.Address), encodedServerState, holdTTL))
+}
+
+func setAddresses(t testing.TB, a *sharder, addresses *Addresses) {
+	encodedAddresses, err := marshaler.MarshalToString(addresses)
+	require.NoError(t, err)
+	require.NoError(t, a.discoveryClient.Set(a.addressesKey(addresses.Version), encodedAddresses, 0))
+}
+
+func TestFillRolesOverlappingVersions(t *testing.T) {
+	a := newSharder(newTestDiscoveryClient(), 4, "test")
+	server := &testServer{}
+	setServerRole(t, a, &ServerRole{Address: "server", Version: 0, Shards: map[uint64]bool{0: true, 1: true}})
+	setServerRole(t, a, &ServerRole{Address: "server", Version: 1, Shards: map[uint64]bool{1: true, 2: true}})
+	setServerRole(t, a, &ServerRole{Address: "server", Version: 2, Shards: map[uint64]bool{2: true, 3: true}})
+
+	versionChan := make(chan int64)
+	cancel := make(chan bool)
+	errChan := make(chan error)
+	go func() {
+		errChan <- a.fillRoles("server", []Server{server}, versionChan, cancel)
+	}()
+	// versions are filled in order, and only the two oldest are, so that
+	// the server keeps the shards of each version until it's retired
+	require.Equal(t, int64(0), <-versionChan)
+	require.Equal(t, int64(1), <-versionChan)
+	server.mu.Lock()
+	added := append([]uint64(nil), server.added...)
+	server.mu.Unlock()
+	sort.Slice(added, func(i, j int) bool { return added[i] < added[j] })
+	require.Equal(t, []uint64{0, 1, 2}, added)
+
+	// retiring the oldest version moves the window on, removing only the
+	// shard that no version in it needs
+	require.NoError(t, a.discoveryClient.Delete(a.serverRoleKeyVersion("server", 0)))
+	require.Equal(t, int64(2), <-versionChan)
+	require.NoErrorWithinTRetry(t, 10*time.Second, func() error {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return require.EqualOrErr([]uint64{0}, server.deleted)
+	})
+	close(cancel)
+	require.YesError(t, <-errChan)
+
+	// shards in more than one version were only added once
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	sort.Slice(server.added, func(i, j int) bool { return server.added[i] < server.added[j] })
+	require.Equal(t, []uint64{0, 1, 2, 3}, server.added)
+}
+
+func TestForceUnregister(t *testing.T) {
+	discoveryClient := newTestDiscoveryClient()
+	a := newSharder(discoveryClient, 4, "test")
+	setServerState(t, a, &ServerState{Address: "server-0", Version: InvalidVersion})
+	setServerState(t, a, &ServerState{Address: "server-1", Version: InvalidVersion})
+
+	require.NoError(t, a.ForceUnregister("server-0"))
+	states, err := discoveryClient.GetAll(a.serverStateDir())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(states))
+	_, ok := states[a.serverStateKey("server-1")]
+	require.True(t, ok)
+	require.YesError(t, a.ForceUnregister("server-0"))
+}
+
+func TestForceUnregisterSkipsGracePeriod(t *testing.T) {
+	a := newSharder(newTestDiscoveryClient(), 4, "test")
+	a.serverGracePeriod = time.Minute
+	events := make(chan proto.Message, 100)
+	a.events = events
+	setServerState(t, a, &ServerState{Address: "server-0", Version: InvalidVersion})
+	setServerState(t, a, &ServerState{Address: "server-1", Version: InvalidVersion})
+	nextAddresses := func() *Addresses {
+		t.Helper()
+		for {
+			select {
+			case event := <-events:
+				if setAddresses, ok := event.(*SetAddresses); ok {
+					return setAddresses.Addresses
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("timed out waiting for addresses")
+			}
+		}
+	}
+
+	cancel := make(chan bool)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- a.unsafeAssignRoles(cancel)
+	}()
+	defer func() {
+		close(cancel)
+		require.Equal(t, ErrCancelled, <-errChan)
+	}()
+	require.Equal(t, 4, len(nextAddresses().Addresses))
+
+	// the evicted server's shards move well before the grace period is up
+	require.NoError(t, a.ForceUnregister("server-1"))
+	addresses := nextAddresses()
+	for _, address := range addresses.Addresses {
+		require.Equal(t, "server-0", address)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	a := newSharder(newTestDiscoveryClient(), 4, "test")
+	updateAddresses := func(addresses map[uint64]string) {
+		setAddresses(t, a, &Addresses{Version: 0, Addresses: addresses})
+		// drop the cached copy of the previous addresses
+		a.addresses = make(map[int64]*Addresses)
+	}
+	setServerRole(t, a, &ServerRole{Address: "server-0", Version: 0, Shards: map[uint64]bool{0: true, 1: true}})
+	setServerRole(t, a, &ServerRole{Address: "server-1", Version: 0, Shards: map[uint64]bool{2: true, 3: true}})
+	// roles at other versions are ignored
+	setServerRole(t, a, &ServerRole{Address: "server-1", Version: 1, Shards: map[uint64]bool{0: true}})
+	updateAddresses(map[uint64]string{0: "server-0", 1: "server-0", 2: "server-1", 3: "server-1"})
+	problems, err := a.Validate(0)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(problems))
+
+	setServerRole(t, a, &ServerRole{Address: "server-1", Version: 0, Shards: map[uint64]bool{1: true, 2: true, 3: true}})
+	updateAddresses(map[uint64]string{0: "server-1", 2: "server-1", 3: "server-1"})
+	problems, err = a.Validate(0)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"shard 0 has address server-1, which has no role for it",
+		"shard 1 has no address",
+		"shard 1 is assigned to multiple servers: server-0, server-1",
+		"server server-1 has 3 shards, more than its share of 2",
+	}, problems)
+}
+
+func TestAssignRolesEvents(t *testing.T) {
+	a := newSharder(newTestDiscoveryClient(), 4, "test")
+	events := make(chan proto.Message)
+	a.events = events
+	a.serverGracePeriod = 0
+	nextEvent := func() proto.Message {
+		t.Helper()
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for event")
+		}
+		return nil
+	}
+
+	// register both servers before assignment starts, so that they're
+	// assigned roles together
+	setServerState(t, a, &ServerState{Address: "server-0", Version: InvalidVersion})
+	setServerState(t, a, &ServerState{Address: "server-1", Version: InvalidVersion})
+	cancel := make(chan bool)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- a.unsafeAssignRoles(cancel)
+	}()
+
+	var addresses []string
+	for i := 0; i < 2; i++ {
+		event, ok := nextEvent().(*SetServerRole)
+		require.True(t, ok)
+		require.Equal(t, int64(0), event.ServerRole.Version)
+		require.Equal(t, 2, len(event.ServerRole.Shards))
+		addresses = append(addresses, event.ServerRole.Address)
+	}
+	sort.Strings(addresses)
+	require.Equal(t, []string{"server-0", "server-1"}, addresses)
+	setAddresses, ok := nextEvent().(*SetAddresses)
+	require.True(t, ok)
+	require.Equal(t, int64(0), setAddresses.Addresses.Version)
+	require.Equal(t, 4, len(setAddresses.Addresses.Addresses))
+
+	// evicting a server moves all of the shards to the other one
+	require.NoError(t, a.ForceUnregister("server-1"))
+	setServerRole, ok := nextEvent().(*SetServerRole)
+	require.True(t, ok)
+	require.Equal(t, "server-0", setServerRole.ServerRole.Address)
+	require.Equal(t, int64(1), setServerRole.ServerRole.Version)
+	require.Equal(t, 4, len(setServerRole.ServerRole.Shards))
+	setAddresses, ok = nextEvent().(*SetAddresses)
+	require.True(t, ok)
+	require.Equal(t, int64(1), setAddresses.Addresses.Version)
+
+	// once the remaining server is at the new version, the old roles are
+	// deleted
+	setServerState(t, a, &ServerState{Address: "server-0", Version: 1})
+	for i := 0; i < 2; i++ {
+		deleteServerRole, ok := nextEvent().(*DeleteServerRole)
+		require.True(t, ok)
+		require.Equal(t, int64(0), deleteServerRole.ServerRole.Version)
+	}
+
+	close(cancel)
+	require.Equal(t, ErrCancelled, <-errChan)
+}
+
+func TestRegisterConflict(t *testing.T) {
+	discoveryClient := newTestDiscoveryClient()
+	a := newSharder(discoveryClient, 4, "test")
+	b := newSharder(discoveryClient, 4, "test")
+	b.claimGracePeriod = 50 * time.Millisecond
+
+	// a second process can't claim an address that's held by a live one
+	token, err := a.claimServer("server-0")
+	require.NoError(t, err)
+	err = b.Register("server-0", nil)
+	require.YesError(t, err)
+	require.Matches(t, "server-0 is already registered", err.Error())
+	require.NoError(t, a.renewServerClaim("server-0", token))
+
+	// a claim that expired is taken back by its holder, if nobody else has
+	// taken it
+	require.NoError(t, discoveryClient.Delete(a.serverOwnerKey("server-0")))
+	require.NoError(t, a.renewServerClaim("server-0", token))
+	owner, err := discoveryClient.Get(a.serverOwnerKey("server-0"))
+	require.NoError(t, err)
+	require.Equal(t, token, owner)
+	_, err = b.claimServer("server-0")
+	require.YesError(t, err)
+
+	// and if one takes over a claim that expired, the original holder stops
+	require.NoError(t, discoveryClient.Delete(a.serverOwnerKey("server-0")))
+	_, err = b.claimServer("server-0")
+	require.NoError(t, err)
+	err = a.renewServerClaim("server-0", token)
+	require.YesError(t, err)
+	require.Matches(t, "registered by another server", err.Error())
+}
+
+func TestRegisterRestart(t *testing.T) {
+	discoveryClient := newTestDiscoveryClient()
+	a := newSharder(discoveryClient, 4, "test")
+	_, err := a.claimServer("server-0")
+	require.NoError(t, err)
+
+	// a restarted server waits for its previous run's claim to expire
+	b := newSharder(discoveryClient, 4, "test")
+	b.claimGracePeriod = time.Second
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		discoveryClient.Delete(a.serverOwnerKey("server-0"))
+	}()
+	token, err := b.claimServer("server-0")
+	require.NoError(t, err)
+
+	// and releases its claim when it stops, so that it can be restarted
+	// straight away
+	b.releaseServer("server-0", token)
+	c := newSharder(discoveryClient, 4, "test")
+	c.claimGracePeriod = 0
+	_, err = c.claimServer("server-0")
+	require.NoError(t, err)
+}
+
+func TestGetShards(t *testing.T) {
+	a := newSharder(newTestDiscoveryClient(), 4, "test")
+	for version := int64(0); version < 3; version++ {
+		addresses := &Addresses{Version: version, Addresses: make(map[uint64]string)}
+		for shard := uint64(0); shard < 4; shard++ {
+			addresses.Addresses[shard] = fmt.Sprintf("server-%d", (shard+uint64(version))%2)
+		}
+		setAddresses(t, a, addresses)
+	}
+
+	shards, err := a.GetShards("server-0", 0)
+	require.NoError(t, err)
+	require.Equal(t, map[uint64]bool{0: true, 2: true}, shards)
+	shards, err = a.GetShards("server-0", 1)
+	require.NoError(t, err)
+	require.Equal(t, map[uint64]bool{1: true, 3: true}, shards)
+	shards, err = a.GetShards("server-2", 1)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(shards))
+
+	// reading a newer version evicts versions that are no longer in use
+	shards, err = a.GetShards("server-0", 2)
+	require.NoError(t, err)
+	require.Equal(t, map[uint64]bool{0: true, 2: true}, shards)
+	_, ok := a.addressToShards[0]
+	require.False(t, ok)
+	_, ok = a.addresses[0]
+	require.False(t, ok)
+	shards, err = a.GetShards("server-0", 0)
+	require.NoError(t, err)
+	require.Equal(t, map[uint64]bool{0: true, 2: true}, shards)
+}
+
+func BenchmarkGetShards(b *testing.B) {
+	numShards := uint64(10000)
+	a := newSharder(newTestDiscoveryClient(), numShards, "test")
+	addresses := &Addresses{Version: 0, Addresses: make(map[uint64]string)}
+	for shard := uint64(0); shard < numShards; shard++ {
+		addresses.Addresses[shard] = fmt.Sprintf("server-%d", shard%100)
+	}
+	setAddresses(b, a, addresses)
+	r := newRouter(a, nil, "server-0")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := r.GetShards(0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestAssignShardsNoServers(t *testing.T) {
+	roles, shards, unassigned := assignShards(4, map[string]*ServerState{}, map[uint64]string{0: "server-0"}, nil, 1, 0, rand.Shuffle)
+	require.Equal(t, 0, len(roles))
+	require.Equal(t, 0, len(shards))
+	require.Equal(t, []uint64{0, 1, 2, 3}, unassigned)
+}
+
+func TestAssignRolesAllServersGone(t *testing.T) {
+	a := newSharder(newTestDiscoveryClient(), 4, "test")
+	events := make(chan proto.Message, 10)
+	a.events = events
+	a.serverGracePeriod = 0
+	setServerState(t, a, &ServerState{Address: "server-0", Version: InvalidVersion})
+	cancel := make(chan bool)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- a.unsafeAssignRoles(cancel)
+	}()
+	waitForAddresses := func(version int64) {
+		t.Helper()
+		for {
+			select {
+			case event := <-events:
+				if setAddresses, ok := event.(*SetAddresses); ok {
+					require.Equal(t, version, setAddresses.Addresses.Version)
+					return
+				}
+			case err := <-errChan:
+				t.Fatalf("role assignment exited: %v", err)
+			case <-time.After(10 * time.Second):
+				t.Fatal("timed out waiting for addresses")
+			}
+		}
+	}
+	waitForAddresses(0)
+
+	// losing every server shouldn't stop assignment, which resumes once a
+	// server returns
+	require.NoError(t, a.ForceUnregister("server-0"))
+	setServerState(t, a, &ServerState{Address: "server-1", Version: InvalidVersion})
+	waitForAddresses(1)
+
+	close(cancel)
+	require.Equal(t, ErrCancelled, <-errChan)
+}
+
+func TestAssignRolesReportsNoServers(t *testing.T) {
+	a := newSharder(newTestDiscoveryClient(), 4, "test")
+	events := make(chan proto.Message, 10)
+	a.events = events
+	cancel := make(chan bool)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- a.unsafeAssignRoles(cancel)
+	}()
+	select {
+	case event := <-events:
+		failed, ok := event.(*FailedToAssignRoles)
+		require.True(t, ok)
+		require.Equal(t, uint64(4), failed.NumShards)
+	case err := <-errChan:
+		t.Fatalf("role assignment exited: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for assignment failure")
+	}
+	close(cancel)
+	require.Equal(t, ErrCancelled, <-errChan)
+}
+
+func TestListVersions(t *testing.T) {
+	a := newSharder(newTestDiscoveryClient(), 4, "test")
+	versions, err := a.ListVersions()
+	require.NoError(t, err)
+	require.Equal(t, 0, len(versions))
+
+	for _, version := range []int64{10, 2, 1} {
+		setAddresses(t, a, &Addresses{Version: version, Addresses: map[uint64]string{0: "server-0"}})
+	}
+	versions, err = a.ListVersions()
+	require.NoError(t, err)
+	require.Equal(t, []int64{1, 2, 10}, versions)
+}
+
+func TestWatchAllRetries(t *testing.T) {
+	a := newSharder(&flakyDiscoveryClient{testDiscoveryClient: newTestDiscoveryClient(), watchFailures: 1}, 4, "test")
+	require.NoError(t, a.discoveryClient.Set(a.addressesKey(0), "value", 0))
+	// the watch survives the failed connection and sees the value once it
+	// reconnects
+	err := a.watchAll(a.addressesDir(), nil, func(values map[string]string) error {
+		if len(values) == 1 {
+			return errComplete
+		}
+		return nil
+	})
+	require.True(t, errors.Is(err, errComplete))
+}
+
+func TestWatchAllCancelDuringBackoff(t *testing.T) {
+	a := newSharder(&flakyDiscoveryClient{testDiscoveryClient: newTestDiscoveryClient(), watchFailures: 1000}, 4, "test")
+	cancel := make(chan bool)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- a.watchAll(a.addressesDir(), cancel, func(map[string]string) error { return nil })
+	}()
+	close(cancel)
+	select {
+	case err := <-errChan:
+		require.True(t, errors.Is(err, discovery.ErrCancelled))
+	case <-time.After(10 * time.Second):
+		t.Fatal("watch wasn't cancelled")
+	}
+}
+
+func TestAssignRolesRestartKeepsShards(t *testing.T) {
+	a := newSharder(newTestDiscoveryClient(), 8, "test")
+	events := make(chan proto.Message, 100)
+	a.events = events
+	for i := 0; i < 3; i++ {
+		setServerState(t, a, &ServerState{Address: fmt.Sprintf("server-%d", i), Version: InvalidVersion})
+	}
+	runUntilAddresses := func() *Addresses {
+		t.Helper()
+		cancel := make(chan bool)
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- a.unsafeAssignRoles(cancel)
+		}()
+		defer func() {
+			close(cancel)
+			require.Equal(t, ErrCancelled, <-errChan)
+		}()
+		for {
+			select {
+			case event := <-events:
+				if setAddresses, ok := event.(*SetAddresses); ok {
+					return setAddresses.Addresses
+				}
+			case err := <-errChan:
+				t.Fatalf("role assignment exited: %v", err)
+			case <-time.After(10 * time.Second):
+				t.Fatal("timed out waiting for addresses")
+			}
+		}
+	}
+	first := runUntilAddresses()
+
+	// lose the server roles, so that the restarted controller only has the
+	// addresses to go on
+	serverRoles, err := a.discoveryClient.GetAll(a.serverRoleDir())
+	require.NoError(t, err)
+	for key := range serverRoles {
+		require.NoError(t, a.discoveryClient.Delete(key))
+	}
+	second := runUntilAddresses()
+	require.Equal(t, first.Version+1, second.Version)
+	require.Equal(t, first.Addresses, second.Addresses)
+}
+
+func TestSnapshot(t *testing.T) {
+	a := newSharder(newTestDiscoveryClient(), 3, "test")
+	setAddresses(t, a, &Addresses{Version: 0, Addresses: map[uint64]string{0: "server-0", 1: "server-1", 2: "server-0"}})
+	setAddresses(t, a, &Addresses{Version: 1, Addresses: map[uint64]string{0: "server-0", 2: "server-1"}})
+	snapshot, err := a.Snapshot()
+	require.NoError(t, err)
+	encoded, err := json.Marshal(snapshot)
+	require.NoError(t, err)
+	require.Equal(t,
+		`{"version":1,"shards":[{"shard":0,"address":"server-0"},{"shard":1,"unassigned":true},{"shard":2,"address":"server-1"}]}`,
+		string(encoded))
+}
+
+func TestCurrentVersion(t *testing.T) {
+	a := newSharder(newTestDiscoveryClient(), 2, "test")
+	setAddresses(t, a, &Addresses{Version: 0, Addresses: map[uint64]string{0: "server-0", 1: "server-0"}})
+	setAddresses(t, a, &Addresses{Version: 1, Addresses: map[uint64]string{0: "server-0", 1: "server-1"}})
+
+	address, ok, err := a.GetAddress(1, CurrentVersion)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "server-1", address)
+	shards, err := a.GetShards("server-1", CurrentVersion)
+	require.NoError(t, err)
+	require.Equal(t, map[uint64]bool{1: true}, shards)
+}
+
+func TestCurrentAddressesOnlyDecodesNewest(t *testing.T) {
+	a := newSharder(newTestDiscoveryClient(), 2, "test")
+	// older versions aren't decoded, so one that can't be doesn't matter
+	require.NoError(t, a.discoveryClient.Set(a.addressesKey(0), "malformed", 0))
+	setAddresses(t, a, &Addresses{Version: 1, Addresses: map[uint64]string{0: "server-0", 1: "server-1"}})
+
+	version, addresses, err := a.CurrentAddresses()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), version)
+	require.Equal(t, map[uint64]string{0: "server-0", 1: "server-1"}, addresses.Addresses)
+}
+
+func TestWaitForAvailabilityReportsSkew(t *testing.T) {
+	defer func(threshold time.Duration) { skewThreshold = threshold }(skewThreshold)
+	skewThreshold = 10 * time.Millisecond
+	a := newSharder(newTestDiscoveryClient(), 4, "test")
+	reports := make(chan map[string]int64, 1)
+	a.reportSkew = func(lagging map[string]int64) {
+		select {
+		case reports <- lagging:
+		default:
+		}
+	}
+	setServerState(t, a, &ServerState{Address: "server-0", Version: 1})
+	setServerRole(t, a, &ServerRole{Address: "server-0", Version: 1})
+	setServerState(t, a, &ServerState{Address: "server-1", Version: 0})
+	setServerRole(t, a, &ServerRole{Address: "server-1", Version: 0})
+
+	errChan := make(chan error)
+	go func() {
+		errChan <- a.WaitForAvailability(nil, []string{"server-0", "server-1", "server-2"})
+	}()
+	require.Equal(t, map[string]int64{"server-1": 0, "server-2": InvalidVersion}, <-reports)
+
+	setServerState(t, a, &ServerState{Address: "server-2", Version: 1})
+	setServerRole(t, a, &ServerRole{Address: "server-2", Version: 1})
+	setServerState(t, a, &ServerState{Address: "server-1", Version: 1})
+	setServerRole(t, a, &ServerRole{Address: "server-1", Version: 1})
+	require.NoError(t, a.discoveryClient.Delete(a.serverRoleKeyVersion("server-1", 0)))
+	require.NoError(t, <-errChan)
+}
+
+func TestAssignShardsSeeded(t *testing.T) {
+	serverStates := testServerStates(5)
+	assign := func(seed int64) map[uint64]string {
+		_, shards, unassigned := assignShards(7, serverStates, nil, nil, 0, 0, rand.New(rand.NewSource(seed)).Shuffle)
+		require.Equal(t, 0, len(unassigned))
+		return shards
+	}
+	// the same seed always gives the same assignment
+	for i := 0; i < 10; i++ {
+		require.Equal(t, assign(1), assign(1))
+	}
+}
+
+func TestAssignRolesServerGracePeriod(t *testing.T) {
+	a := newSharder(newTestDiscoveryClient(), 4, "test")
+	a.serverGracePeriod = 200 * time.Millisecond
+	events := make(chan proto.Message, 100)
+	a.events = events
+	setServerState(t, a, &ServerState{Address: "server-0", Version: InvalidVersion})
+	setServerState(t, a, &ServerState{Address: "server-1", Version: InvalidVersion})
+	nextAddresses := func() *Addresses {
+		t.Helper()
+		for {
+			select {
+			case event := <-events:
+				if setAddresses, ok := event.(*SetAddresses); ok {
+					return setAddresses.Addresses
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("timed out waiting for addresses")
+			}
+		}
+	}
+
+	cancel := make(chan bool)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- a.unsafeAssignRoles(cancel)
+	}()
+	defer func() {
+		close(cancel)
+		require.Equal(t, ErrCancelled, <-errChan)
+	}()
+	require.Equal(t, 4, len(nextAddresses().Addresses))
+
+	// a server that comes back within the grace period keeps its shards
+	require.NoError(t, a.discoveryClient.Delete(a.serverStateKey("server-1")))
+	setServerState(t, a, &ServerState{Address: "server-1", Version: InvalidVersion})
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected event %v", event)
+	case <-time.After(2 * a.serverGracePeriod):
+	}
+
+	// one that doesn't loses them
+	require.NoError(t, a.discoveryClient.Delete(a.serverStateKey("server-1")))
+	addresses := nextAddresses()
+	for _, address := range addresses.Addresses {
+		require.Equal(t, "server-0", address)
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	a := newSharder(newTestDiscoveryClient(), 4, "test")
+	require.Equal(t, defaultIdentity(), a.logger.Data["identity"])
+
+	a = NewSharder(newTestDiscoveryClient(), 4, "test", WithIdentity("candidate-1")).(*sharder)
+	require.Equal(t, "candidate-1", a.logger.Data["identity"])
+}
+
+func TestPreloadAddresses(t *testing.T) {
+	discoveryClient := newTestDiscoveryClient()
+	cancel := make(chan bool)
+	defer close(cancel)
+	a := NewSharder(discoveryClient, 2, "test", WithPreloadedAddresses(cancel)).(*sharder)
+	cached := func(version int64) bool {
+		a.addressesLock.RLock()
+		defer a.addressesLock.RUnlock()
+		_, ok := a.addresses[version]
+		return ok
+	}
+
+	// each new version is cached without being looked up
+	for version := int64(0); version < 3; version++ {
+		setAddresses(t, a, &Addresses{Version: version, Addresses: map[uint64]string{0: "server-0", 1: "server-1"}})
+		require.NoErrorWithinTRetry(t, 10*time.Second, func() error {
+			if !cached(version) {
+				return errors.Errorf("version %d isn't cached", version)
+			}
+			return nil
+		})
+	}
+	require.False(t, cached(0))
+}
+
+func TestAssignShardsMaxShardsPerServer(t *testing.T) {
+	serverStates := testServerStates(3)
+
+	// a cap above the even share doesn't change anything
+	roles, _, unassigned := assignShards(8, serverStates, nil, nil, 0, 3, rand.Shuffle)
+	require.Equal(t, 0, len(unassigned))
+	for _, role := range roles {
+		require.True(t, len(role.Shards) <= 3)
+	}
+
+	// a cap below it leaves the shards that don't fit unassigned
+	roles, shards, unassigned := assignShards(8, serverStates, nil, nil, 0, 2, rand.Shuffle)
+	require.Equal(t, 2, len(unassigned))
+	require.Equal(t, 6, len(shards))
+	for _, role := range roles {
+		require.Equal(t, 2, len(role.Shards))
+	}
+}
+
+func TestDebouncedWatchAll(t *testing.T) {
+	a := newSharder(newTestDiscoveryClient(), 4, "test")
+	cancel := make(chan bool)
+	calls := make(chan map[string]string, 10)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- a.debouncedWatchAll(a.addressesDir(), cancel, 500*time.Millisecond, func(values map[string]string) error {
+			calls <- values
+			return nil
+		})
+	}()
+
+	// a burst of changes is seen as one
+	for i := 0; i < 5; i++ {
+		require.NoError(t, a.discoveryClient.Set(a.addressesKey(int64(i)), "value", 0))
+	}
+	select {
+	case values := <-calls:
+		require.Equal(t, 5, len(values))
+	case <-time.After(10 * time.Second):
+		t.Fatal("callBack wasn't called")
+	}
+	select {
+	case values := <-calls:
+		t.Fatalf("unexpected second call with %v", values)
+	case <-time.After(time.Second):
+	}
+
+	// cancellation doesn't wait for a pending change
+	require.NoError(t, a.discoveryClient.Set(a.addressesKey(5), "value", 0))
+	close(cancel)
+	select {
+	case err := <-errChan:
+		require.True(t, errors.Is(err, discovery.ErrCancelled))
+	case <-time.After(10 * time.Second):
+		t.Fatal("watch wasn't cancelled")
+	}
+	require.Equal(t, 0, len(calls))
+}
+
+func TestDiscoveryErrors(t *testing.T) {
+	a := newSharder(newTestDiscoveryClient(), 2, "test")
+	setAddresses(t, a, &Addresses{Version: 0, Addresses: map[uint64]string{0: "server-0", 1: "server-0"}})
+
+	// callers can tell versions that don't exist from other failures
+	_, _, err := a.GetAddress(0, 1)
+	require.True(t, errors.Is(err, discovery.ErrNotFound))
+	_, err = a.GetShards("server-0", 1)
+	require.True(t, errors.Is(err, discovery.ErrNotFound))
+	_, _, err = a.GetAddress(0, 0)
+	require.NoError(t, err)
+}
+
+func TestAssignShardsPinned(t *testing.T) {
+	serverStates := testServerStates(2)
+
+	// pinned shards go to their servers, even over where they were before
+	oldShards := map[uint64]string{0: "server-0", 1: "server-0", 2: "server-1", 3: "server-1"}
+	_, shards, unassigned := assignShards(4, serverStates, oldShards, map[uint64]string{0: "server-1"}, 0, 0, rand.Shuffle)
+	require.Equal(t, 0, len(unassigned))
+	require.Equal(t, "server-1", shards[0])
+
+	// shards pinned to servers that are gone are assigned as usual
+	_, shards, unassigned = assignShards(4, serverStates, nil, map[uint64]string{0: "server-2"}, 0, 0, rand.Shuffle)
+	require.Equal(t, 0, len(unassigned))
+	require.Equal(t, 4, len(shards))
+
+	// pinning doesn't give a server more than its share
+	pinned := map[uint64]string{0: "server-0", 1: "server-0", 2: "server-0", 3: "server-0"}
+	roles, _, unassigned := assignShards(4, serverStates, nil, pinned, 0, 0, rand.Shuffle)
+	require.Equal(t, 0, len(unassigned))
+	require.Equal(t, 2, len(roles["server-0"].Shards))
+	require.Equal(t, 2, len(roles["server-1"].Shards))
+}
+
+func TestImbalance(t *testing.T) {
+	a := newSharder(newTestDiscoveryClient(), 4, "test")
+	setAddresses(t, a, &Addresses{Version: 0, Addresses: map[uint64]string{0: "server-0", 1: "server-1", 2: "server-0", 3: "server-1"}})
+	setAddresses(t, a, &Addresses{Version: 1, Addresses: map[uint64]string{0: "server-0", 1: "server-0", 2: "server-0", 3: "server-1"}})
+
+	imbalance, err := a.Imbalance(0)
+	require.NoError(t, err)
+	require.Equal(t, 1.0, imbalance)
+	imbalance, err = a.Imbalance(CurrentVersion)
+	require.NoError(t, err)
+	require.Equal(t, 3.0, imbalance)
+
+	imbalance, err = NewLocalSharder([]string{"server-0", "server-1"}, 3).Imbalance(CurrentVersion)
+	require.NoError(t, err)
+	require.Equal(t, 2.0, imbalance)
+}
+
+func TestAssignRolesLeaderElection(t *testing.T) {
+	discoveryClient := newTestDiscoveryClient()
+	leaderClient := &partitionedDiscoveryClient{testDiscoveryClient: discoveryClient}
+	newCandidate := func(client discovery.Client) (*sharder, chan proto.Message) {
+		a := newSharder(client, 4, "test")
+		events := make(chan proto.Message, 100)
+		a.events = events
+		a.serverGracePeriod = 0
+		a.lockRenewInterval = 10 * time.Millisecond
+		return a, events
+	}
+	waitFor := func(events chan proto.Message, match func(proto.Message) bool) {
+		t.Helper()
+		for {
+			select {
+			case event := <-events:
+				if match(event) {
+					return
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("timed out waiting for event")
+			}
+		}
+	}
+	isStart := func(event proto.Message) bool {
+		_, ok := event.(*StartAssignRoles)
+		return ok
+	}
+	isFinish := func(event proto.Message) bool {
+		_, ok := event.(*FinishAssignRoles)
+		return ok
+	}
+
+	leader, leaderEvents := newCandidate(leaderClient)
+	standby, standbyEvents := newCandidate(discoveryClient)
+	setServerState(t, leader, &ServerState{Address: "server-0", Version: InvalidVersion})
+	go leader.AssignRoles("controller-0")
+	waitFor(leaderEvents, isStart)
+	go standby.AssignRoles("controller-1")
+
+	// only the leader assigns roles
+	waitFor(leaderEvents, func(event proto.Message) bool {
+		_, ok := event.(*SetAddresses)
+		return ok
+	})
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case event := <-standbyEvents:
+		t.Fatalf("standby emitted %T while the leader held the lock", event)
+	default:
+	}
+	lock, err := discoveryClient.Get(leader.lockKey())
+	require.NoError(t, err)
+	require.Equal(t, "controller-0", lock)
+
+	// once the leader can't renew the lock and it expires, the standby
+	// takes over and resumes assignment from the existing roles
+	leaderClient.partition()
+	waitFor(leaderEvents, isFinish)
+	for _, key := range leader.lockKeys() {
+		require.NoError(t, discoveryClient.Delete(key))
+	}
+	waitFor(standbyEvents, isStart)
+	lock, err = discoveryClient.Get(standby.lockKey())
+	require.NoError(t, err)
+	require.Equal(t, "controller-1", lock)
+	setServerState(t, standby, &ServerState{Address: "server-1", Version: InvalidVersion})
+	waitFor(standbyEvents, func(event proto.Message) bool {
+		setAddresses, ok := event.(*SetAddresses)
+		return ok && setAddresses.Addresses.Version == 1
+	})
+}
+
+// watchCountingDiscoveryClient is a testDiscoveryClient that counts the
+// watches started on each key
+type watchCountingDiscoveryClient struct {
+	*testDiscoveryClient
+	mu      sync.Mutex
+	watches map[string]int
+}
+
+func (c *watchCountingDiscoveryClient) WatchAll(key string, cancel chan bool, callBack func(map[string]string) error) error {
+	c.mu.Lock()
+	c.watches[key]++
+	c.mu.Unlock()
+	return c.testDiscoveryClient.WatchAll(key, cancel, callBack)
+}
+
+func TestAssignRolesBacksOffAfterErrors(t *testing.T) {
+	discoveryClient := &watchCountingDiscoveryClient{
+		testDiscoveryClient: newTestDiscoveryClient(),
+		watches:             make(map[string]int),
+	}
+	a := newSharder(discoveryClient, 4, "test")
+	a.serverGracePeriod = 0
+	a.lockRenewInterval = 10 * time.Millisecond
+	// a server state that can't be decoded fails assignment every time
+	require.NoError(t, discoveryClient.Set(a.serverStateKey("server-0"), "malformed", 0))
+
+	go a.AssignRoles("controller-0")
+	time.Sleep(500 * time.Millisecond)
+	discoveryClient.mu.Lock()
+	defer discoveryClient.mu.Unlock()
+	// without a backoff, assignment would restart at every renewal
+	require.True(t, discoveryClient.watches[a.serverStateDir()] > 0)
+	require.True(t, discoveryClient.watches[a.serverStateDir()] <= 3, "%d", discoveryClient.watches[a.serverStateDir()])
+}
+
+func TestAssignRolesLegacyLock(t *testing.T) {
+	discoveryClient := newTestDiscoveryClient()
+	a := newSharder(discoveryClient, 4, "test")
+	events := make(chan proto.Message, 100)
+	a.events = events
+	a.serverGracePeriod = 0
+	a.lockRenewInterval = 10 * time.Millisecond
+	setServerState(t, a, &ServerState{Address: "server-0", Version: InvalidVersion})
+
+	// a leader from an earlier release only holds the un-namespaced lock
+	require.NoError(t, discoveryClient.Set(a.legacyLockKey(), "old-controller", 0))
+	go a.AssignRoles("controller-0")
+	select {
+	case event := <-events:
+		t.Fatalf("emitted %T while an earlier release held the lock", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// once it's gone, both locks are taken
+	require.NoError(t, discoveryClient.Delete(a.legacyLockKey()))
+	select {
+	case event := <-events:
+		_, ok := event.(*StartAssignRoles)
+		require.True(t, ok, "unexpected event %T", event)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the lock")
+	}
+	for _, key := range a.lockKeys() {
+		lock, err := discoveryClient.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, "controller-0", lock)
+	}
+}
+
+func TestShardsSorted(t *testing.T) {
+	serverRole := ServerRole{Shards: make(map[uint64]bool)}
+	for _, shard := range []uint64{7, 3, 11, 0, 5, 2} {
+		serverRole.Shards[shard] = true
+	}
+	for i := 0; i < 10; i++ {
+		require.Equal(t, []uint64{0, 2, 3, 5, 7, 11}, shards(serverRole))
+	}
+	require.Equal(t, 0, len(shards(ServerRole{})))
+}
+
+func TestAnnounceInterval(t *testing.T) {
+	a := newSharder(newTestDiscoveryClient(), 4, "test")
+	interval := time.Second * time.Duration(holdTTL/2)
+	varied := false
+	for i := 0; i < 100; i++ {
+		next := a.announceInterval()
+		require.True(t, next <= interval && next > interval-defaultAnnounceJitter, "%v", next)
+		varied = varied || next != interval
+	}
+	require.True(t, varied)
+
+	WithAnnounceJitter(0)(a)
+	require.Equal(t, interval, a.announceInterval())
+
+	// jitter can't make the interval negative
+	WithAnnounceJitter(time.Hour)(a)
+	for i := 0; i < 100; i++ {
+		require.True(t, a.announceInterval() > 0)
+	}
+}
+
+func TestExportImportState(t *testing.T) {
+	a := newSharder(newTestDiscoveryClient(), 4, "test")
+	setServerRole(t, a, &ServerRole{Address: "server-0", Version: 0, Shards: map[uint64]bool{0: true, 1: true, 2: true, 3: true}})
+	setAddresses(t, a, &Addresses{Version: 0, Addresses: map[uint64]string{0: "server-0", 1: "server-0", 2: "server-0", 3: "server-0"}})
+	setServerRole(t, a, &ServerRole{Address: "server-1", Version: 1, Shards: map[uint64]bool{2: true, 3: true}})
+	setServerRole(t, a, &ServerRole{Address: "server-0", Version: 1, Shards: map[uint64]bool{0: true, 1: true}})
+	setAddresses(t, a, &Addresses{Version: 1, Addresses: map[uint64]string{0: "server-0", 1: "server-0", 2: "server-1", 3: "server-1"}})
+
+	state, err := a.ExportState()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), state.Version)
+	require.Equal(t, 2, len(state.ServerRoles))
+
+	// the state survives being serialized
+	encoded, err := json.Marshal(state)
+	require.NoError(t, err)
+	var decoded State
+	require.NoError(t, json.Unmarshal(encoded, &decoded))
+
+	b := newSharder(newTestDiscoveryClient(), 4, "test")
+	require.NoError(t, b.ImportState(&decoded))
+	version, addresses, err := b.CurrentAddresses()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), version)
+	require.Equal(t, map[uint64]string{0: "server-0", 1: "server-0", 2: "server-1", 3: "server-1"}, addresses.Addresses)
+	shards, err := b.GetShards("server-1", 1)
+	require.NoError(t, err)
+	require.Equal(t, map[uint64]bool{2: true, 3: true}, shards)
+	encodedServerRole, err := b.discoveryClient.Get(b.serverRoleKeyVersion("server-0", 1))
+	require.NoError(t, err)
+	serverRole, err := decodeServerRole(encodedServerRole)
+	require.NoError(t, err)
+	require.Equal(t, map[uint64]bool{0: true, 1: true}, serverRole.Shards)
+	problems, err := b.Validate(1)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(problems))
+
+	// versions that already exist aren't overwritten
+	err = b.ImportState(&decoded)
+	require.YesError(t, err)
+	require.True(t, errors.Is(err, discovery.ErrConflict))
+
+	// and the shard count has to match
+	c := newSharder(newTestDiscoveryClient(), 8, "test")
+	require.YesError(t, c.ImportState(&decoded))
+	_, err = c.discoveryClient.Get(c.addressesKey(1))
+	require.YesError(t, err)
+
+	require.YesError(t, newLocalSharder([]string{"server-0"}, 4).ImportState(&decoded))
+}
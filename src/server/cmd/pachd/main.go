@@ -53,6 +53,7 @@ import (
 
 	etcd "github.com/coreos/etcd/clientv3"
 	units "github.com/docker/go-units"
+	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/pachyderm/pachyderm/src/client/pkg/tls"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
@@ -713,9 +714,14 @@ func doFullMode(config interface{}) (retErr error) {
 		return githook.RunGitHookServer(address, etcdAddress, path.Join(env.EtcdPrefix, env.PPSEtcdPrefix))
 	})
 	go waitForError("S3 Server", errChan, requireNoncriticalServers, func() error {
+		var s3Opts []s3.Option
+		if tracing.IsActive() {
+			s3Opts = append(s3Opts, s3.WithTracer(opentracing.GlobalTracer()))
+		}
 		server, err := s3.Server(env.S3GatewayPort, s3.NewMasterDriver(), func() (*client.APIClient, error) {
-			return client.NewFromAddress(fmt.Sprintf("localhost:%d", env.PeerPort))
-		})
+			// clones env's client, so that requests share its connection
+			return env.GetPachClient(context.Background()), nil
+		}, s3Opts...)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,240 @@
+package s3
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strings"
+
+	"github.com/pachyderm/pachyderm/src/client"
+	"github.com/pachyderm/s2"
+)
+
+// cannedACLs are the canned ACLs that can be applied to objects. All PFS
+// content has a single owner, so these are all equivalent to the owner
+// having full control, which is what's reported for objects that aren't
+// public.
+var cannedACLs = map[string]bool{
+	"private":                   true,
+	"bucket-owner-read":         true,
+	"bucket-owner-full-control": true,
+}
+
+// publicReadACL is the canned ACL that lets anyone read an object. It's only
+// supported with `WithCannedACLs`, as it's stored with the object.
+const publicReadACL = "public-read"
+
+// allUsersGroup is the grantee of the grants that apply to anyone
+const allUsersGroup = "http://acs.amazonaws.com/groups/global/AllUsers"
+
+// grantee is the grantee of an ACL grant
+type grantee struct {
+	XMLNSXSI    string `xml:"xmlns:xsi,attr"`
+	Type        string `xml:"xsi:type,attr"`
+	ID          string `xml:"ID,omitempty"`
+	DisplayName string `xml:"DisplayName,omitempty"`
+	URI         string `xml:"URI,omitempty"`
+}
+
+// grant is a permission granted by an ACL
+type grant struct {
+	Grantee    grantee `xml:"Grantee"`
+	Permission string  `xml:"Permission"`
+}
+
+// accessControlPolicy is the response body of a GetObjectAcl request
+type accessControlPolicy struct {
+	XMLName           xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ AccessControlPolicy"`
+	Owner             s2.User  `xml:"Owner"`
+	AccessControlList []grant  `xml:"AccessControlList>Grant"`
+}
+
+// ownerFullControlPolicy returns the ACL of all PFS content, in which owner
+// has full control
+func ownerFullControlPolicy(owner s2.User) *accessControlPolicy {
+	return &accessControlPolicy{
+		Owner: owner,
+		AccessControlList: []grant{
+			{
+				Grantee: grantee{
+					XMLNSXSI:    "http://www.w3.org/2001/XMLSchema-instance",
+					Type:        "CanonicalUser",
+					ID:          owner.ID,
+					DisplayName: owner.DisplayName,
+				},
+				Permission: "FULL_CONTROL",
+			},
+		},
+	}
+}
+
+// publicReadPolicy returns the ACL of public objects, in which owner has full
+// control and anyone can read
+func publicReadPolicy(owner s2.User) *accessControlPolicy {
+	policy := ownerFullControlPolicy(owner)
+	policy.AccessControlList = append(policy.AccessControlList, grant{
+		Grantee: grantee{
+			XMLNSXSI: "http://www.w3.org/2001/XMLSchema-instance",
+			Type:     "Group",
+			URI:      allUsersGroup,
+		},
+		Permission: "READ",
+	})
+	return policy
+}
+
+// checkACL returns an error if a request asks for an ACL other than the
+// owner having full control
+func checkACL(r *http.Request) error {
+	if acl := r.Header.Get("x-amz-acl"); acl != "" && !cannedACLs[acl] {
+		return s2.NotImplementedError(r)
+	}
+	for name := range r.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-grant-") {
+			return s2.NotImplementedError(r)
+		}
+	}
+	return nil
+}
+
+// requestedACL returns the canned ACL that a write asks to store with its
+// object, which is "" for ACLs equivalent to the owner having full control.
+// Other ACLs aren't supported.
+func (c *controller) requestedACL(r *http.Request) (string, error) {
+	if c.cannedACLs && r.Header.Get("x-amz-acl") == publicReadACL {
+		for name := range r.Header {
+			if strings.HasPrefix(strings.ToLower(name), "x-amz-grant-") {
+				return "", s2.NotImplementedError(r)
+			}
+		}
+		return publicReadACL, nil
+	}
+	return "", checkACL(r)
+}
+
+// setObjectACL stores the canned ACL of an object, where "" clears it. ACLs
+// are kept per key rather than per version, and are only stored with
+// `WithCannedACLs`.
+func (c *controller) setObjectACL(pc *client.APIClient, bucket *Bucket, file, acl string) error {
+	if !c.cannedACLs {
+		return nil
+	}
+	if acl == "" {
+		return c.clearMetadata(pc, aclMetadata, bucket, file)
+	}
+	return c.setMetadata(pc, aclMetadata, bucket, file, []byte(acl))
+}
+
+// objectACL returns the canned ACL stored with an object, or "" if it has
+// none
+func (c *controller) objectACL(pc *client.APIClient, bucket *Bucket, file string) (string, error) {
+	if !c.cannedACLs {
+		return "", nil
+	}
+	acl, _, err := c.getMetadata(pc, aclMetadata, bucket, file)
+	return string(acl), err
+}
+
+// isPublicRead returns whether the object that a request names can be read
+// by anyone. Errors are logged, and treated as the object not being public.
+func (c *controller) isPublicRead(r *http.Request, bucketName, file string) bool {
+	if !c.cannedACLs || file == "" {
+		return false
+	}
+	pc, err := c.requestClient(r)
+	if err != nil {
+		return false
+	}
+	bucket, err := c.driver.bucket(pc, r, bucketName)
+	if err != nil {
+		// left for the request's handler to report
+		return false
+	}
+	acl, err := c.objectACL(pc, bucket, file)
+	if err != nil {
+		c.logger.Errorf("could not read the ACL of %s/%s: %v", bucketName, file, err)
+	}
+	return acl == publicReadACL
+}
+
+// GetObjectACL returns the ACL of an object, which is the owner having full
+// control, and anyone being able to read if the object is public
+func (c *controller) GetObjectACL(r *http.Request, bucketName, file string) (*accessControlPolicy, error) {
+	c.logger.Debugf("GetObjectACL: bucketName=%+v, file=%+v", bucketName, file)
+
+	pc, err := c.requestClient(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasSuffix(file, "/") {
+		return nil, invalidFilePathError(r)
+	}
+
+	bucket, err := c.driver.bucket(pc, r, bucketName)
+	if err != nil {
+		return nil, err
+	}
+	bucketCaps, err := c.driver.bucketCapabilities(pc, r, bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !bucketCaps.readable {
+		return nil, s2.NoSuchKeyError(r)
+	}
+
+	if _, err := pc.InspectFile(bucket.Repo, bucket.Commit, file); err != nil {
+		return nil, maybeNotFoundError(r, err)
+	}
+	acl, err := c.objectACL(pc, bucket, file)
+	if err != nil {
+		return nil, err
+	}
+	if acl == publicReadACL {
+		return publicReadPolicy(c.owner), nil
+	}
+	return ownerFullControlPolicy(c.owner), nil
+}
+
+// PutObjectACL sets the ACL of an object. Only canned ACLs equivalent to the
+// owner having full control are supported, and `public-read` with
+// `WithCannedACLs`.
+func (c *controller) PutObjectACL(r *http.Request, bucketName, file string) error {
+	c.logger.Debugf("PutObjectACL: bucketName=%+v, file=%+v", bucketName, file)
+
+	pc, err := c.requestClient(r)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(file, "/") {
+		return invalidFilePathError(r)
+	}
+	// ACLs set in the request body are made of explicit grants
+	if r.ContentLength > 0 {
+		return s2.NotImplementedError(r)
+	}
+	acl, err := c.requestedACL(r)
+	if err != nil {
+		return err
+	}
+
+	bucket, err := c.driver.bucket(pc, r, bucketName)
+	if err != nil {
+		return err
+	}
+	bucketCaps, err := c.driver.bucketCapabilities(pc, r, bucket)
+	if err != nil {
+		return err
+	}
+	if !bucketCaps.writable {
+		return s2.NotImplementedError(r)
+	}
+	if !bucketCaps.readable {
+		return s2.NoSuchKeyError(r)
+	}
+
+	if _, err := pc.InspectFile(bucket.Repo, bucket.Commit, file); err != nil {
+		return maybeNotFoundError(r, err)
+	}
+	return c.setObjectACL(pc, bucket, file, acl)
+}
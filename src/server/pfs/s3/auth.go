@@ -2,14 +2,24 @@ package s3
 
 import (
 	"net/http"
+	"regexp"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/pachyderm/pachyderm/src/client/auth"
 	"github.com/pachyderm/pachyderm/src/client/pkg/errors"
+	"github.com/pachyderm/s2"
 )
 
+// signedHeadersPattern extracts the signed headers of an AWS auth V4
+// `Authorization` header
+var signedHeadersPattern = regexp.MustCompile(`SignedHeaders=([^,]+)`)
+
 func (c *controller) SecretKey(r *http.Request, accessKey string, region *string) (*string, error) {
 	c.logger.Debugf("SecretKey: %+v", region)
+	// s2 asks for the secret key just before it checks the signature, by
+	// which point the request has been routed
+	restoreSignedPath(r)
 
 	pc, err := c.clientFactory()
 	if err != nil {
@@ -55,3 +65,42 @@ func (c *controller) CustomAuth(r *http.Request) (bool, error) {
 	// pachyderm auth is disabled
 	return !active, nil
 }
+
+// signedHeadersMiddleware rejects requests authenticated with AWS auth V4
+// that don't sign every header they should. s2 only checks the signature
+// over the headers that a request lists as signed, so without this, `host`
+// or `x-amz-*` headers could be added or changed without invalidating it.
+func (c *controller) signedHeadersMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if mux.Vars(r)["authMethod"] == "v4" {
+			if err := checkSignedHeaders(r); err != nil {
+				s2.WriteError(c.logger, w, r, err)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkSignedHeaders returns an error if the signed headers of an AWS auth V4
+// request leave out `host` or any `x-amz-*` header that the request has
+func checkSignedHeaders(r *http.Request) error {
+	match := signedHeadersPattern.FindStringSubmatch(r.Header.Get("Authorization"))
+	if len(match) == 0 {
+		return s2.SignatureDoesNotMatchError(r)
+	}
+	signed := make(map[string]bool)
+	for _, name := range strings.Split(match[1], ";") {
+		signed[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	if !signed["host"] {
+		return s2.SignatureDoesNotMatchError(r)
+	}
+	for name := range r.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") && !signed[name] {
+			return s2.SignatureDoesNotMatchError(r)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package s3
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/pachyderm/s2"
+)
+
+// Authorizer decides whether a principal may perform an operation. It's
+// consulted for every request once the request has been authenticated, and
+// before the operation runs.
+type Authorizer interface {
+	// Authorize returns nil if the principal, which is the access key that
+	// the request was signed with, or empty for unsigned requests, may
+	// perform op on the given bucket and key. op is the name of the S3
+	// action, e.g. `GetObject`. bucket is empty for service-level
+	// operations, and key is empty for bucket-level ones. Any error rejects
+	// the request with `AccessDenied`.
+	Authorize(principal, op, bucket, key string) error
+}
+
+// allowAll is the default authorizer, which allows every operation
+type allowAll struct{}
+
+func (allowAll) Authorize(principal, op, bucket, key string) error {
+	return nil
+}
+
+// AuthorizerFunc adapts an ordinary function to an Authorizer
+type AuthorizerFunc func(principal, op, bucket, key string) error
+
+// Authorize calls f(principal, op, bucket, key)
+func (f AuthorizerFunc) Authorize(principal, op, bucket, key string) error {
+	return f(principal, op, bucket, key)
+}
+
+// requestOperation returns the name of the S3 action that a request
+// performs
+func requestOperation(r *http.Request) string {
+	vars := mux.Vars(r)
+	query := r.URL.Query()
+	has := func(name string) bool {
+		_, ok := query[name]
+		return ok
+	}
+
+	if vars["bucket"] == "" {
+		return "ListBuckets"
+	}
+
+	if vars["key"] == "" {
+		switch {
+		case has("versioning") && r.Method == http.MethodPut:
+			return "PutBucketVersioning"
+		case has("versioning"):
+			return "GetBucketVersioning"
+		case has("versions"):
+			return "ListObjectVersions"
+		case has("uploads"):
+			return "ListMultipartUploads"
+		case has("location"):
+			return "GetBucketLocation"
+		case has("delete") && r.Method == http.MethodPost:
+			return "DeleteObjects"
+		}
+		switch r.Method {
+		case http.MethodGet:
+			return "ListObjects"
+		case http.MethodHead:
+			return "HeadBucket"
+		case http.MethodPut:
+			return "CreateBucket"
+		case http.MethodDelete:
+			return "DeleteBucket"
+		case http.MethodPost:
+			return "PostObject"
+		}
+		return r.Method
+	}
+
+	switch {
+	case has("acl") && r.Method == http.MethodPut:
+		return "PutObjectAcl"
+	case has("acl"):
+		return "GetObjectAcl"
+	case has("restore"):
+		return "RestoreObject"
+	case has("uploads"):
+		return "CreateMultipartUpload"
+	case has("uploadId"):
+		switch r.Method {
+		case http.MethodGet:
+			return "ListParts"
+		case http.MethodPost:
+			return "CompleteMultipartUpload"
+		case http.MethodPut:
+			if r.Header.Get("x-amz-copy-source") != "" {
+				return "UploadPartCopy"
+			}
+			return "UploadPart"
+		case http.MethodDelete:
+			return "AbortMultipartUpload"
+		}
+	}
+	switch r.Method {
+	case http.MethodGet:
+		return "GetObject"
+	case http.MethodHead:
+		return "HeadObject"
+	case http.MethodPut:
+		if r.Header.Get("x-amz-copy-source") != "" {
+			return "CopyObject"
+		}
+		return "PutObject"
+	case http.MethodDelete:
+		return "DeleteObject"
+	}
+	return r.Method
+}
+
+// authorize checks a request with the controller's authorizer. Copies are
+// also checked as a `GetObject` of their source, so that they can't be used
+// to read objects that the principal can't otherwise read. Requests that
+// name their keys in their bodies, i.e. multi-object deletes and browser
+// form uploads, are checked again for each key with `authorizeKey`.
+func (c *controller) authorize(r *http.Request) error {
+	vars := mux.Vars(r)
+	if err := c.authorizeKey(r, requestOperation(r), vars["bucket"], vars["key"]); err != nil {
+		return err
+	}
+	if vars["key"] != "" && r.Method == http.MethodPut && r.Header.Get("x-amz-copy-source") != "" {
+		srcBucket, srcKey, _, err := copySource(r)
+		if err != nil {
+			// left for the copy's handler to report
+			return nil
+		}
+		return c.authorizeKey(r, "GetObject", srcBucket, srcKey)
+	}
+	return nil
+}
+
+// authorizeKey checks whether the principal of a request may perform op on
+// the given bucket and key. Unsigned requests may always read public
+// objects.
+func (c *controller) authorizeKey(r *http.Request, op, bucket, key string) error {
+	principal := mux.Vars(r)["authAccessKey"]
+	if err := c.authorizer.Authorize(principal, op, bucket, key); err != nil {
+		if principal == "" && (op == "GetObject" || op == "HeadObject") && c.isPublicRead(r, bucket, key) {
+			return nil
+		}
+		c.logger.Debugf("access denied to %s: %v", principal, err)
+		return s2.AccessDeniedError(r)
+	}
+	return nil
+}
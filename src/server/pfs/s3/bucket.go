@@ -4,9 +4,11 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gogo/protobuf/types"
 	glob "github.com/pachyderm/ohmyglob"
+	"github.com/pachyderm/pachyderm/src/client"
 	pfsClient "github.com/pachyderm/pachyderm/src/client/pfs"
 	pfsServer "github.com/pachyderm/pachyderm/src/server/pfs"
 	"github.com/pachyderm/pachyderm/src/server/pkg/ancestry"
@@ -14,7 +16,19 @@ import (
 	"github.com/pachyderm/s2"
 )
 
-func newContents(fileInfo *pfsClient.FileInfo) (s2.Contents, error) {
+// emptyETag is the ETag of empty objects: the MD5 of no content, as in S3
+const emptyETag = "d41d8cd98f00b204e9800998ecf8427e"
+
+// fileETag returns the ETag of a file, which is its PFS hash. Empty files
+// have no content to hash, so they get emptyETag, which clients expect.
+func fileETag(fileInfo *pfsClient.FileInfo) string {
+	if fileInfo.SizeBytes == 0 {
+		return emptyETag
+	}
+	return fmt.Sprintf("%x", fileInfo.Hash)
+}
+
+func newContents(fileInfo *pfsClient.FileInfo, owner s2.User) (s2.Contents, error) {
 	t, err := types.TimestampFromProto(fileInfo.Committed)
 	if err != nil {
 		return s2.Contents{}, err
@@ -23,10 +37,10 @@ func newContents(fileInfo *pfsClient.FileInfo) (s2.Contents, error) {
 	return s2.Contents{
 		Key:          fileInfo.File.Path,
 		LastModified: t,
-		ETag:         fmt.Sprintf("%x", fileInfo.Hash),
+		ETag:         fileETag(fileInfo),
 		Size:         fileInfo.SizeBytes,
 		StorageClass: globalStorageClass,
-		Owner:        defaultUser,
+		Owner:        owner,
 	}, nil
 }
 
@@ -53,33 +67,49 @@ func (c *controller) GetLocation(r *http.Request, bucketName string) (string, er
 func (c *controller) ListObjects(r *http.Request, bucketName, prefix, marker, delimiter string, maxKeys int) (*s2.ListObjectsResult, error) {
 	c.logger.Debugf("ListObjects: bucketName=%+v, prefix=%+v, marker=%+v, delimiter=%+v, maxKeys=%+v", bucketName, prefix, marker, delimiter, maxKeys)
 
+	result := s2.ListObjectsResult{
+		Contents:       []*s2.Contents{},
+		CommonPrefixes: []*s2.CommonPrefixes{},
+	}
+
+	isTruncated, err := c.listObjects(r, bucketName, prefix, marker, delimiter, maxKeys, func(contents *s2.Contents, commonPrefixes *s2.CommonPrefixes) error {
+		if contents != nil {
+			result.Contents = append(result.Contents, contents)
+		} else {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefixes)
+		}
+		return nil
+	})
+	result.IsTruncated = isTruncated
+	return &result, err
+}
+
+// listObjects iterates over the objects in a bucket, calling `f` with either
+// the contents of a file or the common prefix of a directory. It returns
+// whether the listing was truncated by `maxKeys`.
+func (c *controller) listObjects(r *http.Request, bucketName, prefix, marker, delimiter string, maxKeys int, f func(*s2.Contents, *s2.CommonPrefixes) error) (bool, error) {
 	pc, err := c.requestClient(r)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 
 	if delimiter != "" && delimiter != "/" {
-		return nil, invalidDelimiterError(r)
+		return false, invalidDelimiterError(r)
 	}
 
 	bucket, err := c.driver.bucket(pc, r, bucketName)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 	bucketCaps, err := c.driver.bucketCapabilities(pc, r, bucket)
 	if err != nil {
-		return nil, err
-	}
-
-	result := s2.ListObjectsResult{
-		Contents:       []*s2.Contents{},
-		CommonPrefixes: []*s2.CommonPrefixes{},
+		return false, err
 	}
 
 	if !bucketCaps.readable {
 		// serve empty results if we can't read the bucket; this helps with s3
 		// conformance
-		return &result, nil
+		return false, nil
 	}
 
 	recursive := delimiter == ""
@@ -90,6 +120,8 @@ func (c *controller) ListObjects(r *http.Request, bucketName, prefix, marker, de
 		pattern = fmt.Sprintf("%s*", glob.QuoteMeta(prefix))
 	}
 
+	isTruncated := false
+	count := 0
 	err = pc.GlobFileF(bucket.Repo, bucket.Commit, pattern, func(fileInfo *pfsClient.FileInfo) error {
 		if fileInfo.FileType == pfsClient.FileType_DIR {
 			if fileInfo.File.Path == "/" {
@@ -114,30 +146,141 @@ func (c *controller) ListObjects(r *http.Request, bucketName, prefix, marker, de
 			return nil
 		}
 
-		if len(result.Contents)+len(result.CommonPrefixes) >= maxKeys {
+		if count >= maxKeys {
 			if maxKeys > 0 {
-				result.IsTruncated = true
+				isTruncated = true
 			}
 			return errutil.ErrBreak
 		}
+		count++
 		if fileInfo.FileType == pfsClient.FileType_FILE {
-			c, err := newContents(fileInfo)
+			contents, err := newContents(fileInfo, c.owner)
 			if err != nil {
 				return err
 			}
+			return f(&contents, nil)
+		}
+		return f(nil, &s2.CommonPrefixes{
+			Prefix: fmt.Sprintf("%s/", fileInfo.File.Path),
+			Owner:  c.owner,
+		})
+	})
 
-			result.Contents = append(result.Contents, &c)
-		} else {
-			result.CommonPrefixes = append(result.CommonPrefixes, &s2.CommonPrefixes{
-				Prefix: fmt.Sprintf("%s/", fileInfo.File.Path),
-				Owner:  defaultUser,
-			})
+	return isTruncated, err
+}
+
+// headCommit returns the commit that a bucket currently serves, or nil if it
+// has none. It's looked up once per request for each bucket, however many of
+// the request's handlers need it.
+func (c *controller) headCommit(pc *client.APIClient, r *http.Request, bucketName string) (*pfsClient.CommitInfo, error) {
+	type result struct {
+		commitInfo *pfsClient.CommitInfo
+		err        error
+	}
+	res := requestCached(r, "headcommit/"+bucketName, func() interface{} {
+		bucket, err := c.driver.bucket(pc, r, bucketName)
+		if err != nil {
+			return result{err: err}
+		}
+		bucketCaps, err := c.driver.bucketCapabilities(pc, r, bucket)
+		if err != nil {
+			return result{err: err}
+		}
+		if !bucketCaps.readable {
+			return result{}
+		}
+		commitInfo, err := pc.InspectCommit(bucket.Repo, bucket.Commit)
+		if err != nil {
+			return result{err: maybeNotFoundError(r, err)}
 		}
+		return result{commitInfo: commitInfo}
+	}).(result)
+	return res.commitInfo, res.err
+}
 
-		return nil
-	})
+// bucketHead returns the ID of the commit that a bucket currently serves, or
+// "" if it has none. Clients can read objects at this commit to get a
+// consistent view of the bucket across several reads.
+func (c *controller) bucketHead(r *http.Request, bucketName string) (string, error) {
+	pc, err := c.requestClient(r)
+	if err != nil {
+		return "", err
+	}
+	commitInfo, err := c.headCommit(pc, r, bucketName)
+	if err != nil || commitInfo == nil {
+		return "", err
+	}
+	return commitInfo.Commit.ID, nil
+}
 
-	return &result, err
+// headVersion returns the ID of a bucket's head commit, if it's finished, or
+// "" otherwise. Listings of the bucket are the same for as long as this is,
+// so it identifies them exactly; buckets whose head is still open have no
+// version, since their contents may still change.
+func headVersion(commitInfo *pfsClient.CommitInfo) string {
+	if commitInfo == nil || commitInfo.Finished == nil {
+		return ""
+	}
+	return commitInfo.Commit.ID
+}
+
+// headModifiedSince returns whether a bucket's head commit has changed since
+// the given time. Buckets whose head is still open, or that have none, are
+// always considered modified, since their contents may still change.
+func headModifiedSince(commitInfo *pfsClient.CommitInfo, since time.Time) (bool, error) {
+	if commitInfo == nil || commitInfo.Finished == nil {
+		return true, nil
+	}
+	finished, err := types.TimestampFromProto(commitInfo.Finished)
+	if err != nil {
+		return false, err
+	}
+	// HTTP dates only have second precision
+	return finished.Truncate(time.Second).After(since), nil
+}
+
+// bucketStats returns the number of files in a bucket, and their total size
+// in bytes. The size is that of the bucket's root directory, which PFS keeps
+// up to date, but PFS doesn't keep a file count, so counting means walking
+// every file. Counts are cached by commit, as a finished commit's files
+// never change, so the walk is only repeated once the bucket has a new head.
+func (c *controller) bucketStats(r *http.Request, bucketName string) (uint64, uint64, error) {
+	pc, err := c.requestClient(r)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	commitInfo, err := c.headCommit(pc, r, bucketName)
+	if err != nil || commitInfo == nil {
+		return 0, 0, err
+	}
+	repo, commitID := commitInfo.Commit.Repo.Name, commitInfo.Commit.ID
+
+	fileInfo, err := pc.InspectFile(repo, commitID, "/")
+	if err != nil {
+		if pfsServer.IsFileNotFoundErr(err) {
+			return 0, 0, nil
+		}
+		return 0, 0, maybeNotFoundError(r, err)
+	}
+
+	cacheKey := repo + "@" + commitID
+	if count, ok := c.fileCounts.Get(cacheKey); ok {
+		return count.(uint64), fileInfo.SizeBytes, nil
+	}
+	var count uint64
+	if err := pc.GlobFileF(repo, commitID, "**", func(fileInfo *pfsClient.FileInfo) error {
+		if fileInfo.FileType == pfsClient.FileType_FILE {
+			count++
+		}
+		return nil
+	}); err != nil {
+		return 0, 0, err
+	}
+	if commitInfo.Finished != nil {
+		c.fileCounts.Add(cacheKey, count)
+	}
+	return count, fileInfo.SizeBytes, nil
 }
 
 func (c *controller) CreateBucket(r *http.Request, bucketName string) error {
@@ -146,6 +289,17 @@ func (c *controller) CreateBucket(r *http.Request, bucketName string) error {
 	if !c.driver.canModifyBuckets() {
 		return s2.NotImplementedError(r)
 	}
+	// buckets that can be created always keep historic versions, so
+	// versioning is already enabled as object lock requires
+	objectLock, err := objectLockRequested(r)
+	if err != nil {
+		return err
+	}
+	defaultHeaders := requestedDefaultHeaders(r)
+	caseInsensitive, err := c.caseInsensitiveRequested(r)
+	if err != nil {
+		return err
+	}
 
 	pc, err := c.requestClient(r)
 	if err != nil {
@@ -186,6 +340,22 @@ func (c *controller) CreateBucket(r *http.Request, bucketName string) error {
 		return s2.InternalError(r, err)
 	}
 
+	if objectLock {
+		if err := c.setObjectLock(pc, bucket, true); err != nil {
+			return s2.InternalError(r, err)
+		}
+	}
+	if defaultHeaders != nil {
+		if err := c.setDefaultHeaders(pc, bucket, defaultHeaders); err != nil {
+			return s2.InternalError(r, err)
+		}
+	}
+	if caseInsensitive {
+		if err := c.setCaseInsensitive(pc, bucket, true); err != nil {
+			return s2.InternalError(r, err)
+		}
+	}
+
 	return nil
 }
 
@@ -237,6 +407,12 @@ func (c *controller) DeleteBucket(r *http.Request, bucketName string) error {
 		return s2.InternalError(r, err)
 	}
 
+	for _, kind := range allBucketMetadata {
+		if err := c.clearMetadata(pc, kind, bucket, ""); err != nil {
+			return s2.InternalError(r, err)
+		}
+	}
+
 	repoInfo, err := pc.InspectRepo(bucket.Repo)
 	if err != nil {
 		return s2.InternalError(r, err)
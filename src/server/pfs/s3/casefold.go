@@ -0,0 +1,115 @@
+package s3
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pachyderm/pachyderm/src/client"
+	"github.com/pachyderm/s2"
+)
+
+// caseInsensitiveRequested returns whether a CreateBucket request asks for
+// the new bucket's keys to be case-insensitive
+func (c *controller) caseInsensitiveRequested(r *http.Request) (bool, error) {
+	s := r.Header.Get("x-pach-case-insensitive")
+	if s == "" {
+		return false, nil
+	}
+	enabled, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, s2.InvalidArgumentError(r)
+	}
+	if enabled && !c.caseInsensitiveBuckets {
+		return false, s2.NotImplementedError(r)
+	}
+	return enabled, nil
+}
+
+// setCaseInsensitive records whether a bucket's keys are case-insensitive
+func (c *controller) setCaseInsensitive(pc *client.APIClient, bucket *Bucket, enabled bool) error {
+	if !enabled {
+		return c.clearMetadata(pc, caseInsensitiveMetadata, bucket, "")
+	}
+	return c.setMetadata(pc, caseInsensitiveMetadata, bucket, "", nil)
+}
+
+// isCaseInsensitive returns whether a bucket's keys are case-insensitive.
+// In such buckets, keys are lowercased, so that they're stored and listed in
+// that form. Keys of PFS files that don't have that form can't be read
+// through them.
+// It's looked up once per request for each bucket, and only if
+// case-insensitive buckets are enabled.
+func (c *controller) isCaseInsensitive(r *http.Request, bucketName string) bool {
+	if !c.caseInsensitiveBuckets {
+		return false
+	}
+	return requestCached(r, "caseinsensitive/"+bucketName, func() interface{} {
+		pc, err := c.requestClient(r)
+		if err != nil {
+			return false
+		}
+		bucket, err := c.driver.bucket(pc, r, bucketName)
+		if err != nil {
+			// left for the request's handler to report
+			return false
+		}
+		_, enabled, err := c.getMetadata(pc, caseInsensitiveMetadata, bucket, "")
+		if err != nil {
+			c.logger.Errorf("could not read case-insensitivity of %s: %v", bucketName, err)
+		}
+		return enabled
+	}).(bool)
+}
+
+// foldKey returns the key that a request for key in a bucket refers to
+func (c *controller) foldKey(r *http.Request, bucketName, key string) string {
+	if key != "" && c.isCaseInsensitive(r, bucketName) {
+		return strings.ToLower(key)
+	}
+	return key
+}
+
+// foldRequestKeys folds the keys that a request refers to in its path, its
+// listing parameters and its copy source, so that s2's handlers see the keys
+// as they're stored. It returns whether the key or copy source changed.
+func (c *controller) foldRequestKeys(r *http.Request) bool {
+	if !c.caseInsensitiveBuckets {
+		return false
+	}
+	vars := mux.Vars(r)
+	bucketName := vars["bucket"]
+	changed := false
+	if bucketName != "" && c.isCaseInsensitive(r, bucketName) {
+		if key := vars["key"]; key != "" {
+			// s2's handlers read the same map
+			vars["key"] = strings.ToLower(key)
+			changed = vars["key"] != key
+		} else if r.Method == http.MethodGet {
+			query := r.URL.Query()
+			for _, name := range []string{"prefix", "marker", "start-after", "key-marker"} {
+				if value := query.Get(name); value != "" {
+					query.Set(name, strings.ToLower(value))
+				}
+			}
+			r.URL.RawQuery = query.Encode()
+		}
+	}
+
+	if copySource := r.Header.Get("x-amz-copy-source"); copySource != "" {
+		u, err := url.Parse(copySource)
+		if err != nil {
+			return changed
+		}
+		parts := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)
+		if len(parts) != 2 || !c.isCaseInsensitive(r, parts[0]) {
+			return changed
+		}
+		u.Path = strings.TrimSuffix(u.Path, parts[1]) + strings.ToLower(parts[1])
+		r.Header.Set("x-amz-copy-source", u.String())
+		changed = changed || u.String() != copySource
+	}
+	return changed
+}
@@ -0,0 +1,81 @@
+package s3
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pachyderm/pachyderm/src/client"
+	"github.com/pachyderm/pachyderm/src/client/pfs"
+	"github.com/pachyderm/pachyderm/src/client/pkg/grpcutil"
+)
+
+// defaultCommitMessage is the template used for the descriptions of commits
+// made by gateway writes, unless another is set with `WithCommitMessage`
+const defaultCommitMessage = "s3gateway: {{.Operation}} {{.Key}} in {{.Bucket}} from {{.RemoteAddr}}"
+
+// commitMessageArgs are the fields available to commit message templates
+type commitMessageArgs struct {
+	// Operation is the S3 operation that made the commit, e.g. `PutObject`
+	Operation string
+	// Bucket is the name of the bucket that was written to
+	Bucket string
+	// Key is the key of the object that was written
+	Key string
+	// RemoteAddr is the network address of the client
+	RemoteAddr string
+	// Time is when the write was made
+	Time time.Time
+}
+
+// withCommit calls `f` with the ID of the commit that a write to a bucket
+// should go to. If each write to the bucket creates its own commit, a commit
+// described by the controller's commit message template is started for `f`,
+// and finished once it returns successfully. Otherwise, `f` writes to the
+// bucket's commit directly. With `WithLastFinishWins`, the gateway's commits
+// to a branch are made one at a time.
+func (c *controller) withCommit(pc *client.APIClient, r *http.Request, bucket *Bucket, bucketCaps bucketCapabilities, operation, key string, f func(commitID string) error) error {
+	if !bucketCaps.commitPerWrite {
+		return f(bucket.Commit)
+	}
+
+	if c.lastFinishWins {
+		lock := c.branchLock(bucket)
+		lock.Lock()
+		defer lock.Unlock()
+	}
+
+	var message strings.Builder
+	if err := c.commitMessage.Execute(&message, commitMessageArgs{
+		Operation:  operation,
+		Bucket:     bucket.Name,
+		Key:        key,
+		RemoteAddr: r.RemoteAddr,
+		Time:       time.Now(),
+	}); err != nil {
+		return err
+	}
+	commit, err := pc.PfsAPIClient.StartCommit(pc.Ctx(), &pfs.StartCommitRequest{
+		Parent:      client.NewCommit(bucket.Repo, ""),
+		Branch:      bucket.Commit,
+		Description: message.String(),
+	})
+	if err != nil {
+		return grpcutil.ScrubGRPC(err)
+	}
+	if err := f(commit.ID); err != nil {
+		if err := pc.DeleteCommit(bucket.Repo, commit.ID); err != nil {
+			c.logger.Errorf("could not delete abandoned commit %s@%s: %v", bucket.Repo, commit.ID, err)
+		}
+		return err
+	}
+	return pc.FinishCommit(bucket.Repo, commit.ID)
+}
+
+// branchLock returns the lock that orders the commits the gateway makes to
+// the branch of a bucket
+func (c *controller) branchLock(bucket *Bucket) *sync.Mutex {
+	lock, _ := c.branchLocks.LoadOrStore(bucket.Repo+"@"+bucket.Commit, &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
@@ -0,0 +1,128 @@
+package s3
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pachyderm/pachyderm/src/client"
+)
+
+// defaultHeaderPrefix prefixes the CreateBucket request headers that set the
+// bucket's default headers, e.g. `x-pach-default-cache-control`
+const defaultHeaderPrefix = "x-pach-default-"
+
+// defaultableHeaders are the object response headers that a bucket can set
+// defaults for. PFS doesn't keep the headers that objects were uploaded
+// with, so unlike in S3 there are no per-object values for the defaults to
+// give way to; only a read's `response-*` overrides take precedence over
+// them.
+var defaultableHeaders = []string{
+	"Cache-Control",
+	"Content-Disposition",
+	"Content-Language",
+	"Content-Type",
+	"Expires",
+}
+
+// overridableHeaders are the object response headers that can be overridden
+// for a single read with the matching `response-*` query parameter, e.g.
+// `response-cache-control`, as in S3. Overrides take precedence over the
+// bucket's defaults and over anything that the object is stored with, such
+// as its `Content-Encoding`.
+var overridableHeaders = []string{
+	"Cache-Control",
+	"Content-Disposition",
+	"Content-Encoding",
+	"Content-Language",
+	"Content-Type",
+	"Expires",
+}
+
+// responseOverride returns the value that a read asks for the given response
+// header to have, or "" if it doesn't override it
+func responseOverride(r *http.Request, name string) string {
+	return r.URL.Query().Get("response-" + strings.ToLower(name))
+}
+
+// requestedDefaultHeaders returns the default headers that a CreateBucket
+// request asks for, or nil if there are none
+func requestedDefaultHeaders(r *http.Request) http.Header {
+	var result http.Header
+	for _, name := range defaultableHeaders {
+		if value := r.Header.Get(defaultHeaderPrefix + name); value != "" {
+			if result == nil {
+				result = make(http.Header)
+			}
+			result.Set(name, value)
+		}
+	}
+	return result
+}
+
+// setDefaultHeaders stores the default headers of a bucket, where nil
+// deletes them
+func (c *controller) setDefaultHeaders(pc *client.APIClient, bucket *Bucket, header http.Header) error {
+	if header == nil {
+		return c.clearMetadata(pc, defaultHeadersMetadata, bucket, "")
+	}
+	encoded, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	return c.setMetadata(pc, defaultHeadersMetadata, bucket, "", encoded)
+}
+
+// defaultHeaders returns the default headers of a bucket, or nil if it has
+// none
+func (c *controller) defaultHeaders(pc *client.APIClient, bucket *Bucket) (http.Header, error) {
+	encoded, ok, err := c.getMetadata(pc, defaultHeadersMetadata, bucket, "")
+	if err != nil || !ok {
+		return nil, err
+	}
+	var result http.Header
+	if err := json.Unmarshal(encoded, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// requestDefaultHeaders returns the default headers of a request's bucket,
+// which are read once per request. Errors are logged, and treated as the
+// bucket having no defaults.
+func (c *controller) requestDefaultHeaders(r *http.Request, bucketName string) http.Header {
+	return requestCached(r, "defaultheaders/"+bucketName, func() interface{} {
+		pc, err := c.requestClient(r)
+		if err != nil {
+			return http.Header(nil)
+		}
+		bucket, err := c.driver.bucket(pc, r, bucketName)
+		if err != nil {
+			// left for s2 to report
+			return http.Header(nil)
+		}
+		defaults, err := c.defaultHeaders(pc, bucket)
+		if err != nil {
+			c.logger.Errorf("could not read default headers of %s: %v", bucketName, err)
+		}
+		return defaults
+	}).(http.Header)
+}
+
+// setObjectHeaders sets the headers of an object read: the bucket's
+// defaults, overridden by any `response-*` query parameters. Errors are
+// logged rather than failing the read.
+func (c *controller) setObjectHeaders(w http.ResponseWriter, r *http.Request) {
+	defaults := c.requestDefaultHeaders(r, mux.Vars(r)["bucket"])
+	for _, name := range defaultableHeaders {
+		if value := defaults.Get(name); value != "" {
+			w.Header().Set(name, value)
+		}
+	}
+	for _, name := range overridableHeaders {
+		if value := responseOverride(r, name); value != "" {
+			w.Header().Set(name, value)
+		}
+	}
+}
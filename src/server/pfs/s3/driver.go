@@ -27,6 +27,9 @@ type bucketCapabilities struct {
 	readable         bool
 	writable         bool
 	historicVersions bool
+	// commitPerWrite is whether the bucket is a branch, so that each write
+	// to it creates its own commit
+	commitPerWrite bool
 }
 
 // Driver implementations drive the underlying bucket-related functionality
@@ -38,13 +41,89 @@ type Driver interface {
 	canModifyBuckets() bool
 }
 
+// BucketResolver maps between bucket names and the PFS branches that the
+// buckets serve, which lets the master driver serve a custom naming scheme,
+// e.g. one that adds a tenant prefix to bucket names.
+type BucketResolver interface {
+	// Resolve returns the repo and branch served by the bucket called name,
+	// or false if name isn't a valid bucket name.
+	Resolve(name string) (repo string, branch string, ok bool)
+	// Name returns the name of the bucket that serves branch of repo, or ""
+	// if the branch isn't served.
+	Name(repo string, branch string) string
+}
+
+// defaultBucketResolver serves each branch as a bucket called
+// `branch.repo`, and the default branch of each repo as a bucket called
+// `repo`.
+type defaultBucketResolver struct {
+	defaultBranch string
+}
+
+func (r *defaultBucketResolver) Resolve(name string) (string, string, bool) {
+	// Repo and branch names cannot contain a `.`, so a bucket name with a
+	// `.` in it always refers to a specific branch, and one without always
+	// refers to the default branch of a repo. Names with an empty branch or
+	// repo, e.g. `.repo` or `branch.`, are invalid rather than resolving to
+	// a branch or repo with an empty name.
+	parts := strings.SplitN(name, ".", 2)
+	if len(parts) == 2 {
+		if parts[0] == "" || parts[1] == "" {
+			return "", "", false
+		}
+		return parts[1], parts[0], true
+	}
+	if parts[0] == "" {
+		return "", "", false
+	}
+	return parts[0], r.defaultBranch, true
+}
+
+func (r *defaultBucketResolver) Name(repo, branch string) string {
+	return fmt.Sprintf("%s.%s", branch, repo)
+}
+
 // MasterDriver is the driver for the s3gateway instance running on pachd
 // master
-type MasterDriver struct{}
+type MasterDriver struct {
+	// defaultBranch is the branch used for buckets that don't specify one
+	defaultBranch string
+	// resolver maps between bucket names and branches
+	resolver BucketResolver
+}
+
+// MasterDriverOption configures a master driver.
+type MasterDriverOption func(d *MasterDriver)
+
+// WithDefaultBranch sets the branch that's served for bucket names which
+// only reference a repo. By default, this is `master`.
+func WithDefaultBranch(branch string) MasterDriverOption {
+	return func(d *MasterDriver) {
+		d.defaultBranch = branch
+	}
+}
+
+// WithBucketResolver sets how bucket names map to branches. This takes
+// precedence over `WithDefaultBranch`, which only affects the default
+// resolver.
+func WithBucketResolver(resolver BucketResolver) MasterDriverOption {
+	return func(d *MasterDriver) {
+		d.resolver = resolver
+	}
+}
 
 // NewMasterDriver constructs a new master driver
-func NewMasterDriver() *MasterDriver {
-	return &MasterDriver{}
+func NewMasterDriver(opts ...MasterDriverOption) *MasterDriver {
+	d := &MasterDriver{
+		defaultBranch: "master",
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	if d.resolver == nil {
+		d.resolver = &defaultBucketResolver{defaultBranch: d.defaultBranch}
+	}
+	return d
 }
 
 func (d *MasterDriver) listBuckets(pc *client.APIClient, r *http.Request, buckets *[]*s2.Bucket) error {
@@ -59,8 +138,12 @@ func (d *MasterDriver) listBuckets(pc *client.APIClient, r *http.Request, bucket
 			return err
 		}
 		for _, branch := range repo.Branches {
+			name := d.resolver.Name(branch.Repo.Name, branch.Name)
+			if name == "" {
+				continue
+			}
 			*buckets = append(*buckets, &s2.Bucket{
-				Name:         fmt.Sprintf("%s.%s", branch.Name, branch.Repo.Name),
+				Name:         name,
 				CreationDate: t,
 			})
 		}
@@ -70,14 +153,9 @@ func (d *MasterDriver) listBuckets(pc *client.APIClient, r *http.Request, bucket
 }
 
 func (d *MasterDriver) bucket(pc *client.APIClient, r *http.Request, name string) (*Bucket, error) {
-	branch := "master"
-	var repo string
-	parts := strings.SplitN(name, ".", 2)
-	if len(parts) == 2 {
-		branch = parts[0]
-		repo = parts[1]
-	} else {
-		repo = parts[0]
+	repo, branch, ok := d.resolver.Resolve(name)
+	if !ok {
+		return nil, s2.InvalidBucketNameError(r)
 	}
 
 	return &Bucket{
@@ -97,6 +175,7 @@ func (d *MasterDriver) bucketCapabilities(pc *client.APIClient, r *http.Request,
 		readable:         branchInfo.Head != nil,
 		writable:         true,
 		historicVersions: true,
+		commitPerWrite:   true,
 	}, nil
 }
 
@@ -0,0 +1,205 @@
+package s3
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pachyderm/pachyderm/src/client"
+	"github.com/pachyderm/pachyderm/src/client/pkg/errors"
+	"github.com/pachyderm/s2"
+)
+
+// gzipRequested returns whether a write says that its content is
+// gzip-compressed. Other encodings, such as `aws-chunked`, only describe how
+// the body is transferred, and aren't stored.
+func gzipRequested(r *http.Request) bool {
+	for _, header := range r.Header["Content-Encoding"] {
+		for _, encoding := range strings.Split(header, ",") {
+			if strings.EqualFold(strings.TrimSpace(encoding), "gzip") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// acceptsGzip returns whether a read's `Accept-Encoding` header allows a
+// gzip-compressed response
+func acceptsGzip(r *http.Request) bool {
+	for _, header := range r.Header["Accept-Encoding"] {
+		for _, encoding := range strings.Split(header, ",") {
+			parts := strings.Split(encoding, ";")
+			name := strings.TrimSpace(parts[0])
+			if !strings.EqualFold(name, "gzip") && name != "*" {
+				continue
+			}
+			accepted := true
+			for _, param := range parts[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+					accepted = err == nil && q > 0
+				}
+			}
+			return accepted
+		}
+	}
+	return false
+}
+
+// setGzipped records whether an object's content is gzip-compressed. Objects
+// written outside of the gateway aren't flagged, so they're never considered
+// compressed, unless they overwrite one that was. Clearing the flag only
+// writes to the multipart repo if the object was flagged.
+func (c *controller) setGzipped(pc *client.APIClient, bucket *Bucket, file string, gzipped bool) error {
+	if !gzipped {
+		return c.clearMetadata(pc, contentEncodingMetadata, bucket, file)
+	}
+	return c.setMetadata(pc, contentEncodingMetadata, bucket, file, nil)
+}
+
+// isGzipped returns whether an object was written gzip-compressed
+func (c *controller) isGzipped(pc *client.APIClient, bucket *Bucket, file string) (bool, error) {
+	_, gzipped, err := c.getMetadata(pc, contentEncodingMetadata, bucket, file)
+	return gzipped, err
+}
+
+// isGetObjectRequest returns whether a request reads an object, rather than
+// one of its subresources. The only query parameters of object reads are the
+// version and response header overrides.
+func isGetObjectRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if mux.Vars(r)["key"] == "" {
+		return false
+	}
+	for name := range r.URL.Query() {
+		if name != "versionId" && !strings.HasPrefix(name, "response-") {
+			return false
+		}
+	}
+	return true
+}
+
+// maxBufferedDecompression is the largest decompressed size of gzipped
+// objects that are decompressed in memory to be served, rather than as
+// they're served
+const maxBufferedDecompression = 8 * 1024 * 1024
+
+// gzipMagic is the header that gzip-compressed content starts with
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// hasGzipMagic returns whether content starts with gzipMagic, and leaves it
+// at its start
+func hasGzipMagic(content io.ReadSeeker) (bool, error) {
+	header := make([]byte, len(gzipMagic))
+	n, err := io.ReadFull(content, header)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return false, err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	return n == len(gzipMagic) && bytes.Equal(header, gzipMagic), nil
+}
+
+// serveGetObject serves reads of objects that were written gzip-compressed.
+// Clients that accept gzip get the stored content with
+// `Content-Encoding: gzip`; others get it decompressed. The flag that says
+// an object was compressed is kept per key rather than per version, so the
+// content is checked for the gzip header before it's treated as compressed,
+// and served as it's stored if it doesn't have one, as it won't for older
+// versions that were written uncompressed, or for files overwritten directly
+// in PFS. It returns false, without writing a response, for objects that
+// aren't flagged as compressed, so that they're served by s2 as usual.
+func (c *controller) serveGetObject(w http.ResponseWriter, r *http.Request) bool {
+	vars := mux.Vars(r)
+	bucketName := vars["bucket"]
+	key := vars["key"]
+
+	pc, err := c.requestClient(r)
+	if err != nil {
+		return false
+	}
+	bucket, err := c.driver.bucket(pc, r, bucketName)
+	if err != nil {
+		// left for s2 to report
+		return false
+	}
+	gzipped, err := c.isGzipped(pc, bucket, key)
+	if err != nil {
+		s2.WriteError(c.logger, w, r, s2.InternalError(r, err))
+		return true
+	}
+	if !gzipped {
+		return false
+	}
+
+	result, err := c.GetObject(r, bucketName, key, r.URL.Query().Get("versionId"))
+	if err != nil {
+		s2.WriteError(c.logger, w, r, err)
+		return true
+	}
+	if result.ETag != "" {
+		w.Header().Set("ETag", "\""+result.ETag+"\"")
+	}
+	if result.Version != "" {
+		w.Header().Set("x-amz-version-id", result.Version)
+	}
+
+	gzipped, err = hasGzipMagic(result.Content)
+	if err != nil {
+		s2.WriteError(c.logger, w, r, s2.InternalError(r, err))
+		return true
+	}
+	if !gzipped {
+		http.ServeContent(w, r, key, result.ModTime, result.Content)
+		return true
+	}
+
+	w.Header().Add("Vary", "Accept-Encoding")
+	if acceptsGzip(r) {
+		if responseOverride(r, "Content-Encoding") == "" {
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+		http.ServeContent(w, r, key, result.ModTime, result.Content)
+		return true
+	}
+
+	// small content is decompressed in memory, so that it can be served with
+	// its length and in ranges. Larger content is decompressed as it's
+	// served, without a length, and whole, even if ranges were requested,
+	// as HTTP allows.
+	gzipReader, err := gzip.NewReader(result.Content)
+	if err != nil {
+		s2.WriteError(c.logger, w, r, s2.InternalError(r, err))
+		return true
+	}
+	var decompressed bytes.Buffer
+	if _, err := io.CopyN(&decompressed, gzipReader, maxBufferedDecompression+1); err != nil && !errors.Is(err, io.EOF) {
+		s2.WriteError(c.logger, w, r, s2.InternalError(r, err))
+		return true
+	}
+	if decompressed.Len() <= maxBufferedDecompression {
+		http.ServeContent(w, r, key, result.ModTime, bytes.NewReader(decompressed.Bytes()))
+		return true
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", http.DetectContentType(decompressed.Bytes()))
+	}
+	w.Header().Set("Last-Modified", result.ModTime.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return true
+	}
+	if _, err := io.Copy(w, io.MultiReader(&decompressed, gzipReader)); err != nil {
+		c.logger.Errorf("could not stream decompressed object %s: %v", key, err)
+	}
+	return true
+}
@@ -19,6 +19,26 @@ func invalidFileParentError(r *http.Request) *s2.Error {
 	return s2.NewError(r, http.StatusBadRequest, "InvalidFilePath", "Cannot put to a path that includes an existing, non-directory parent file path")
 }
 
+func invalidRangeError(r *http.Request) *s2.Error {
+	return s2.NewError(r, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable")
+}
+
+func invalidStorageClassError(r *http.Request) *s2.Error {
+	return s2.NewError(r, http.StatusBadRequest, "InvalidStorageClass", "The storage class you specified is not valid")
+}
+
+func malformedPOSTRequestError(r *http.Request) *s2.Error {
+	return s2.NewError(r, http.StatusBadRequest, "MalformedPOSTRequest", "The body of your POST request is not well-formed multipart/form-data.")
+}
+
+func objectLockConfigurationNotFoundError(r *http.Request) *s2.Error {
+	return s2.NewError(r, http.StatusNotFound, "ObjectLockConfigurationNotFoundError", "Object Lock configuration does not exist for this bucket")
+}
+
+func slowDownError(r *http.Request) *s2.Error {
+	return s2.NewError(r, http.StatusServiceUnavailable, "SlowDown", "Please reduce your request rate.")
+}
+
 func writeToOutputBranchError(r *http.Request) *s2.Error {
 	return s2.NewError(r, http.StatusBadRequest, "WriteToOutputBranch", "You cannot write to an output branch")
 }
@@ -0,0 +1,324 @@
+package s3
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pachyderm/s2"
+)
+
+const (
+	// defaultMaxKeys is the maximum number of keys returned in an object
+	// listing, unless the client asks for fewer
+	defaultMaxKeys = 1000
+
+	// listFlushInterval is the number of listing entries written between
+	// flushes of a streamed listing
+	listFlushInterval = 100
+)
+
+// bucketSubresources are query parameters which select a bucket-level
+// subresource. Bucket `GET` requests with any of these are left to s2.
+var bucketSubresources = []string{
+	"accelerate",
+	"acl",
+	"analytics",
+	"cors",
+	"encryption",
+	"inventory",
+	"lifecycle",
+	"location",
+	"logging",
+	"metrics",
+	"notification",
+	"object-lock",
+	"policy",
+	"policyStatus",
+	"publicAccessBlock",
+	"replication",
+	"requestPayment",
+	"tagging",
+	"uploads",
+	"versioning",
+	"versions",
+	"website",
+}
+
+// isListObjectsRequest returns whether a request is for an object listing
+func isListObjectsRequest(r *http.Request) bool {
+	vars := mux.Vars(r)
+	if r.Method != http.MethodGet || vars["bucket"] == "" || vars["key"] != "" {
+		return false
+	}
+	query := r.URL.Query()
+	for _, subresource := range bucketSubresources {
+		if _, ok := query[subresource]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+// element is an XML element written to a streamed listing
+type element struct {
+	name  string
+	value interface{}
+}
+
+// encodeElements writes a sequence of elements, skipping any that are nil
+func encodeElements(encoder *xml.Encoder, elements ...element) error {
+	for _, e := range elements {
+		if e.value == nil {
+			continue
+		}
+		if err := encoder.EncodeElement(e.value, xml.StartElement{Name: xml.Name{Local: e.name}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// optional returns s, or nil if s is empty, so that it's omitted by
+// encodeElements
+func optional(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// contentsV2 is an object in a ListObjectsV2 listing. Unlike in a
+// ListObjects listing, the owner is only included if it's asked for.
+type contentsV2 struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	ETag         string    `xml:"ETag"`
+	Size         uint64    `xml:"Size"`
+	StorageClass string    `xml:"StorageClass"`
+	Owner        *s2.User  `xml:"Owner,omitempty"`
+}
+
+// commonPrefixesV2 is a common prefix in a ListObjectsV2 listing
+type commonPrefixesV2 struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// serveListObjects serves an object listing, writing out each entry as it's
+// read from PFS rather than buffering the entire listing. Because of this,
+// the response is sent with chunked transfer encoding, and errors that
+// happen after the first entry has been written can only be logged. Both
+// ListObjects and ListObjectsV2 (`list-type=2`) listings are served.
+// Listings of buckets whose head commit is finished carry the commit's ID in
+// an `x-pach-branch-version` header, which clients can send back in
+// `If-None-Match` to get a `304` if the bucket hasn't changed.
+func (c *controller) serveListObjects(w http.ResponseWriter, r *http.Request) {
+	bucketName := mux.Vars(r)["bucket"]
+	v2 := r.FormValue("list-type") == "2"
+
+	maxKeys := defaultMaxKeys
+	if s := r.FormValue("max-keys"); s != "" {
+		i, err := strconv.Atoi(s)
+		if err != nil || i < 0 || i > defaultMaxKeys {
+			s2.WriteError(c.logger, w, r, s2.InvalidArgumentError(r))
+			return
+		}
+		maxKeys = i
+	}
+	prefix := r.FormValue("prefix")
+	marker := r.FormValue("marker")
+	delimiter := r.FormValue("delimiter")
+	continuationToken := r.FormValue("continuation-token")
+	startAfter := r.FormValue("start-after")
+	fetchOwner := false
+	if v2 {
+		// continuation tokens are the base64-encoded key that the previous
+		// page ended at, and take precedence over `start-after`
+		marker = startAfter
+		if continuationToken != "" {
+			decoded, err := base64.StdEncoding.DecodeString(continuationToken)
+			if err != nil {
+				s2.WriteError(c.logger, w, r, s2.InvalidArgumentError(r))
+				return
+			}
+			marker = string(decoded)
+		}
+		if s := r.FormValue("fetch-owner"); s != "" {
+			var err error
+			if fetchOwner, err = strconv.ParseBool(s); err != nil {
+				s2.WriteError(c.logger, w, r, s2.InvalidArgumentError(r))
+				return
+			}
+		}
+	}
+
+	// listings can be made conditional on the bucket having changed, which
+	// is cheaper for clients that poll for changes. The bucket's version is
+	// exact, so `If-None-Match` takes precedence over `If-Modified-Since`.
+	pc, err := c.requestClient(r)
+	if err != nil {
+		s2.WriteError(c.logger, w, r, err)
+		return
+	}
+	headCommit, err := c.headCommit(pc, r, bucketName)
+	if err != nil {
+		s2.WriteError(c.logger, w, r, err)
+		return
+	}
+	version := headVersion(headCommit)
+	if version != "" {
+		w.Header().Set("x-pach-branch-version", version)
+	}
+	if s := r.Header.Get("If-None-Match"); s != "" {
+		if version != "" && matchesETag(s, version) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	} else if s := r.Header.Get("If-Modified-Since"); s != "" {
+		if since, err := http.ParseTime(s); err == nil {
+			modified, err := headModifiedSince(headCommit, since)
+			if err != nil {
+				s2.WriteError(c.logger, w, r, err)
+				return
+			}
+			if !modified {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+	}
+
+	c.logger.Debugf("ListObjects: bucketName=%+v, prefix=%+v, marker=%+v, delimiter=%+v, maxKeys=%+v, v2=%+v", bucketName, prefix, marker, delimiter, maxKeys, v2)
+
+	start := xml.StartElement{
+		Name: xml.Name{Space: "http://s3.amazonaws.com/doc/2006-03-01/", Local: "ListBucketResult"},
+	}
+	var encoder *xml.Encoder
+	// begin lazily writes the response prelude, so that errors which occur
+	// before any entries are listed can still be served as S3 errors
+	begin := func() error {
+		if encoder != nil {
+			return nil
+		}
+		writeXMLPrelude(w, r, http.StatusOK)
+		encoder = xml.NewEncoder(w)
+		if err := encoder.EncodeToken(start); err != nil {
+			return err
+		}
+		if v2 {
+			return encodeElements(encoder,
+				element{"Name", bucketName},
+				element{"Prefix", prefix},
+				element{"StartAfter", optional(startAfter)},
+				element{"ContinuationToken", optional(continuationToken)},
+				element{"MaxKeys", maxKeys},
+				element{"Delimiter", optional(delimiter)},
+			)
+		}
+		return encodeElements(encoder,
+			element{"Name", bucketName},
+			element{"Prefix", prefix},
+			element{"Marker", marker},
+			element{"MaxKeys", maxKeys},
+			element{"Delimiter", optional(delimiter)},
+		)
+	}
+
+	count := 0
+	nextMarker := ""
+	isTruncated, err := c.listObjects(r, bucketName, prefix, marker, delimiter, maxKeys, func(contents *s2.Contents, commonPrefixes *s2.CommonPrefixes) error {
+		if err := begin(); err != nil {
+			return err
+		}
+		var e element
+		if contents != nil {
+			// some clients (e.g. minio-python) can't handle sub-seconds in
+			// datetime output
+			contents.LastModified = contents.LastModified.UTC().Round(time.Second)
+			contents.ETag = addETagQuotes(contents.ETag)
+			if contents.Key > nextMarker {
+				nextMarker = contents.Key
+			}
+			e = element{"Contents", contents}
+			if v2 {
+				v2Contents := &contentsV2{
+					Key:          contents.Key,
+					LastModified: contents.LastModified,
+					ETag:         contents.ETag,
+					Size:         contents.Size,
+					StorageClass: contents.StorageClass,
+				}
+				if fetchOwner {
+					v2Contents.Owner = &contents.Owner
+				}
+				e.value = v2Contents
+			}
+		} else {
+			if commonPrefixes.Prefix > nextMarker {
+				nextMarker = commonPrefixes.Prefix
+			}
+			e = element{"CommonPrefixes", commonPrefixes}
+			if v2 {
+				e.value = &commonPrefixesV2{Prefix: commonPrefixes.Prefix}
+			}
+		}
+		if err := encodeElements(encoder, e); err != nil {
+			return err
+		}
+		count++
+		if count%listFlushInterval == 0 {
+			if err := encoder.Flush(); err != nil {
+				return err
+			}
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = begin()
+	}
+	if err != nil {
+		if encoder == nil {
+			s2.WriteError(c.logger, w, r, err)
+		} else {
+			// the response has already been partially written, so leave the
+			// document unterminated to signal the failure to the client
+			c.logger.Errorf("could not stream object listing: %v", err)
+		}
+		return
+	}
+
+	trailer := []element{{"IsTruncated", isTruncated}}
+	if v2 {
+		trailer = append(trailer, element{"KeyCount", count})
+		if isTruncated {
+			trailer = append(trailer, element{"NextContinuationToken", base64.StdEncoding.EncodeToString([]byte(nextMarker))})
+		}
+	} else if isTruncated {
+		trailer = append(trailer, element{"NextMarker", nextMarker})
+	}
+	if err := encodeElements(encoder, trailer...); err != nil {
+		c.logger.Errorf("could not stream object listing: %v", err)
+		return
+	}
+	if err := encoder.EncodeToken(start.End()); err != nil {
+		c.logger.Errorf("could not stream object listing: %v", err)
+		return
+	}
+	if err := encoder.Flush(); err != nil {
+		c.logger.Errorf("could not stream object listing: %v", err)
+	}
+}
+
+// addETagQuotes ensures that a given string has leading and trailing quotes.
+func addETagQuotes(s string) string {
+	if len(s) == 0 || s[0] != '"' {
+		return "\"" + s + "\""
+	}
+	return s
+}
@@ -1,19 +1,38 @@
 package s3
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/gogo/protobuf/types"
+	"github.com/gorilla/mux"
 	minio "github.com/minio/minio-go"
+	"github.com/minio/minio-go/pkg/credentials"
+	"github.com/minio/minio-go/pkg/s3signer"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
 	"github.com/pachyderm/pachyderm/src/client"
+	"github.com/pachyderm/pachyderm/src/client/pfs"
 	"github.com/pachyderm/pachyderm/src/client/pkg/errors"
 	"github.com/pachyderm/pachyderm/src/client/pkg/require"
+	pfsServer "github.com/pachyderm/pachyderm/src/server/pfs"
 	tu "github.com/pachyderm/pachyderm/src/server/pkg/testutil"
+	"github.com/pachyderm/s2"
 )
 
 func masterListBuckets(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
@@ -111,6 +130,113 @@ func masterStatObject(t *testing.T, pachClient *client.APIClient, minioClient *m
 	require.Equal(t, int64(11), info.Size)
 }
 
+func masterStatObjectDirectory(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("teststatobjectdirectory")
+	require.NoError(t, pachClient.CreateRepo(repo))
+	_, err := pachClient.PutFile(repo, "master", "dir/file", strings.NewReader("content"))
+	require.NoError(t, err)
+
+	// directories can be checked for with a trailing slash
+	res := rawRequest(t, minioClient, "HEAD", fmt.Sprintf("/master.%s/dir/", repo), nil, nil)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "application/x-directory", res.Header.Get("Content-Type"))
+	require.Equal(t, int64(0), res.ContentLength)
+	require.NotEqual(t, "", res.Header.Get("Last-Modified"))
+
+	// but they aren't objects, so they can't be read, or checked for without
+	// the slash
+	res = rawRequest(t, minioClient, "GET", fmt.Sprintf("/master.%s/dir/", repo), nil, nil)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+	res = rawRequest(t, minioClient, "HEAD", fmt.Sprintf("/master.%s/dir", repo), nil, nil)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	// directories without files, files and missing paths aren't directories
+	_, err = pachClient.PutFile(repo, "master", "empty/file", strings.NewReader("content"))
+	require.NoError(t, err)
+	require.NoError(t, pachClient.DeleteFile(repo, "master", "empty/file"))
+	for _, key := range []string{"empty/", "dir/file/", "missing/"} {
+		res := rawRequest(t, minioClient, "HEAD", fmt.Sprintf("/master.%s/%s", repo, key), nil, nil)
+		require.NoError(t, res.Body.Close())
+		require.Equal(t, http.StatusNotFound, res.StatusCode)
+	}
+}
+
+func masterObjectHeaders(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testobjectheaders")
+	require.NoError(t, pachClient.CreateRepo(repo))
+	_, err := pachClient.PutFile(repo, "master", "file", strings.NewReader("content"))
+	require.NoError(t, err)
+
+	info, err := minioClient.StatObject(fmt.Sprintf("master.%s", repo), "file", minio.StatObjectOptions{})
+	require.NoError(t, err)
+
+	for _, method := range []string{"HEAD", "GET"} {
+		res := rawRequest(t, minioClient, method, fmt.Sprintf("/master.%s/file", repo), nil, nil)
+		require.NoError(t, res.Body.Close())
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, fmt.Sprintf("\"%s\"", info.ETag), res.Header.Get("ETag"))
+		lastModified, err := time.Parse(http.TimeFormat, res.Header.Get("Last-Modified"))
+		require.NoError(t, err)
+		require.True(t, lastModified.Equal(info.LastModified))
+	}
+}
+
+func masterObjectContentLength(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testobjectcontentlength")
+	require.NoError(t, pachClient.CreateRepo(repo))
+	_, err := pachClient.PutFile(repo, "master", "file", strings.NewReader("content"))
+	require.NoError(t, err)
+
+	// objects have a known size, so they shouldn't be sent chunked
+	res := rawRequest(t, minioClient, "GET", fmt.Sprintf("/master.%s/file", repo), nil, nil)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, int64(7), res.ContentLength)
+	require.Equal(t, 0, len(res.TransferEncoding))
+	require.Equal(t, "bytes", res.Header.Get("Accept-Ranges"))
+
+	// clients probe for range support with HEAD requests
+	res = rawRequest(t, minioClient, "HEAD", fmt.Sprintf("/master.%s/file", repo), nil, nil)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "bytes", res.Header.Get("Accept-Ranges"))
+
+	res = rawRequest(t, minioClient, "GET", fmt.Sprintf("/master.%s/file", repo), nil, http.Header{
+		"Range": []string{"bytes=2-4"},
+	})
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusPartialContent, res.StatusCode)
+	require.Equal(t, int64(3), res.ContentLength)
+	require.Equal(t, "nte", string(body))
+
+	// ranges that end past the end of the object are clamped to it
+	res = rawRequest(t, minioClient, "GET", fmt.Sprintf("/master.%s/file", repo), nil, http.Header{
+		"Range": []string{"bytes=4-1000"},
+	})
+	body, err = ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusPartialContent, res.StatusCode)
+	require.Equal(t, "bytes 4-6/7", res.Header.Get("Content-Range"))
+	require.Equal(t, "ent", string(body))
+
+	// ranges that start past it can't be satisfied
+	res = rawRequest(t, minioClient, "GET", fmt.Sprintf("/master.%s/file", repo), nil, http.Header{
+		"Range": []string{"bytes=1000000-"},
+	})
+	body, err = ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusRequestedRangeNotSatisfiable, res.StatusCode)
+	require.Equal(t, "bytes */7", res.Header.Get("Content-Range"))
+	require.True(t, strings.Contains(string(body), "<Code>InvalidRange</Code>"))
+}
+
 func masterPutObject(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
 	repo := tu.UniqueString("testputobject")
 	require.NoError(t, pachClient.CreateRepo(repo))
@@ -130,6 +256,291 @@ func masterPutObject(t *testing.T, pachClient *client.APIClient, minioClient *mi
 	require.Equal(t, "content2", fetchedContent)
 }
 
+func masterPutObjectEmpty(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testputobjectempty")
+	require.NoError(t, pachClient.CreateRepo(repo))
+	require.NoError(t, pachClient.CreateBranch(repo, "master", "", nil))
+	bucket := fmt.Sprintf("master.%s", repo)
+
+	_, err := minioClient.PutObject(bucket, "dir/marker", strings.NewReader(""), 0, minio.PutObjectOptions{})
+	require.NoError(t, err)
+
+	info, err := minioClient.StatObject(bucket, "dir/marker", minio.StatObjectOptions{})
+	require.NoError(t, err)
+	require.Equal(t, int64(0), info.Size)
+	require.Equal(t, "d41d8cd98f00b204e9800998ecf8427e", info.ETag)
+
+	fetchedContent, err := getObject(t, minioClient, bucket, "dir/marker")
+	require.NoError(t, err)
+	require.Equal(t, "", fetchedContent)
+
+	var listed []minio.ObjectInfo
+	for obj := range minioClient.ListObjects(bucket, "dir/", false, make(chan struct{})) {
+		require.NoError(t, obj.Err)
+		listed = append(listed, obj)
+	}
+	require.Equal(t, 1, len(listed))
+	require.Equal(t, "dir/marker", listed[0].Key)
+	require.Equal(t, int64(0), listed[0].Size)
+	require.Equal(t, "d41d8cd98f00b204e9800998ecf8427e", listed[0].ETag)
+}
+
+func masterPutObjectChunked(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testputobjectchunked")
+	require.NoError(t, pachClient.CreateRepo(repo))
+	require.NoError(t, pachClient.CreateBranch(repo, "master", "", nil))
+
+	// a body of unknown length is sent with chunked transfer encoding and no
+	// Content-Length
+	body := io.MultiReader(strings.NewReader("chunked "), strings.NewReader("content"))
+	res := rawRequest(t, minioClient, "PUT", fmt.Sprintf("/master.%s/file", repo), body, nil)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	fetchedContent, err := getObject(t, minioClient, fmt.Sprintf("master.%s", repo), "file")
+	require.NoError(t, err)
+	require.Equal(t, "chunked content", fetchedContent)
+}
+
+func masterPutObjectAborted(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testputobjectaborted")
+	require.NoError(t, pachClient.CreateRepo(repo))
+	require.NoError(t, pachClient.CreateBranch(repo, "master", "", nil))
+
+	// start a chunked upload over a raw connection, so that it can be
+	// dropped partway through
+	u, err := minioClient.Presign("PUT", "bucket", "key", time.Minute, nil)
+	require.NoError(t, err)
+	conn, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	_, err = fmt.Fprintf(conn, "PUT /master.%s/file HTTP/1.1\r\nHost: %s\r\nTransfer-Encoding: chunked\r\n\r\n7\r\ncontent\r\n", repo, u.Host)
+	require.NoError(t, err)
+
+	// wait for the upload's commit to start, then drop the connection
+	require.NoErrorWithinTRetry(t, 10*time.Second, func() error {
+		commitInfos, err := pachClient.ListCommit(repo, "", "", 0)
+		if err != nil {
+			return err
+		}
+		return require.EqualOrErr(1, len(commitInfos))
+	})
+	require.NoError(t, conn.Close())
+
+	// the commit is deleted, and no object is created
+	require.NoErrorWithinTRetry(t, 10*time.Second, func() error {
+		commitInfos, err := pachClient.ListCommit(repo, "", "", 0)
+		if err != nil {
+			return err
+		}
+		return require.EqualOrErr(0, len(commitInfos))
+	})
+	_, err = pachClient.InspectFile(repo, "master", "file")
+	require.YesError(t, err)
+}
+
+func masterDeleteObjectsMalformed(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testdeleteobjectsmalformed")
+	require.NoError(t, pachClient.CreateRepo(repo))
+	require.NoError(t, pachClient.CreateBranch(repo, "master", "", nil))
+	path := fmt.Sprintf("/master.%s/?delete", repo)
+
+	deleteObjects := func(body string) (int, string) {
+		res := rawRequest(t, minioClient, "POST", path, strings.NewReader(body), nil)
+		defer func() { require.NoError(t, res.Body.Close()) }()
+		if res.StatusCode != http.StatusOK {
+			s3Err := s2.Error{}
+			require.NoError(t, xml.NewDecoder(res.Body).Decode(&s3Err))
+			return res.StatusCode, s3Err.Code
+		}
+		return res.StatusCode, ""
+	}
+
+	code, s3Code := deleteObjects("<Delete><Object>")
+	require.Equal(t, http.StatusBadRequest, code)
+	require.Equal(t, "MalformedXML", s3Code)
+
+	var tooMany strings.Builder
+	tooMany.WriteString("<Delete>")
+	for i := 0; i <= maxDeleteObjects; i++ {
+		fmt.Fprintf(&tooMany, "<Object><Key>%d</Key></Object>", i)
+	}
+	tooMany.WriteString("</Delete>")
+	code, s3Code = deleteObjects(tooMany.String())
+	require.Equal(t, http.StatusBadRequest, code)
+	require.Equal(t, "MalformedXML", s3Code)
+
+	// an empty list deletes nothing
+	code, _ = deleteObjects("<Delete></Delete>")
+	require.Equal(t, http.StatusOK, code)
+}
+
+func masterPutObjectConditional(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testputobjectconditional")
+	require.NoError(t, pachClient.CreateRepo(repo))
+	require.NoError(t, pachClient.CreateBranch(repo, "master", "", nil))
+	path := fmt.Sprintf("/master.%s/file", repo)
+
+	putObject := func(content string, header http.Header) int {
+		res := rawRequest(t, minioClient, "PUT", path, strings.NewReader(content), header)
+		require.NoError(t, res.Body.Close())
+		return res.StatusCode
+	}
+
+	// If-Match requires an existing object
+	require.Equal(t, http.StatusNotFound, putObject("content1", http.Header{"If-Match": []string{"*"}}))
+	require.Equal(t, http.StatusOK, putObject("content1", http.Header{"If-None-Match": []string{"*"}}))
+	require.Equal(t, http.StatusPreconditionFailed, putObject("content2", http.Header{"If-None-Match": []string{"*"}}))
+
+	info, err := minioClient.StatObject(fmt.Sprintf("master.%s", repo), "file", minio.StatObjectOptions{})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusPreconditionFailed, putObject("content2", http.Header{"If-Match": []string{"\"bogus\""}}))
+	require.Equal(t, http.StatusOK, putObject("content2", http.Header{"If-Match": []string{fmt.Sprintf("\"%s\"", info.ETag)}}))
+
+	fetchedContent, err := getObject(t, minioClient, fmt.Sprintf("master.%s", repo), "file")
+	require.NoError(t, err)
+	require.Equal(t, "content2", fetchedContent)
+
+	// completing a multipart upload is conditional in the same way
+	core := minio.Core{Client: minioClient}
+	uploadID, err := core.NewMultipartUpload(fmt.Sprintf("master.%s", repo), "file", minio.PutObjectOptions{})
+	require.NoError(t, err)
+	part, err := core.PutObjectPart(fmt.Sprintf("master.%s", repo), "file", uploadID, 1, strings.NewReader("content3"), 8, "", "", nil)
+	require.NoError(t, err)
+	complete := fmt.Sprintf("<CompleteMultipartUpload><Part><PartNumber>1</PartNumber><ETag>%s</ETag></Part></CompleteMultipartUpload>", part.ETag)
+	res := rawRequest(t, minioClient, "POST", fmt.Sprintf("%s?uploadId=%s", path, uploadID), strings.NewReader(complete), http.Header{"If-None-Match": []string{"*"}})
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusPreconditionFailed, res.StatusCode)
+	fetchedContent, err = getObject(t, minioClient, fmt.Sprintf("master.%s", repo), "file")
+	require.NoError(t, err)
+	require.Equal(t, "content2", fetchedContent)
+}
+
+func masterPutObjectContentMD5(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testputobjectcontentmd5")
+	require.NoError(t, pachClient.CreateRepo(repo))
+	require.NoError(t, pachClient.CreateBranch(repo, "master", "", nil))
+
+	sum := md5.Sum([]byte("content"))
+	res := rawRequest(t, minioClient, "PUT", fmt.Sprintf("/master.%s/file", repo), strings.NewReader("content"), http.Header{
+		"Content-Md5": []string{base64.StdEncoding.EncodeToString(sum[:])},
+	})
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	// a corrupted upload should be rejected without overwriting the file
+	res = rawRequest(t, minioClient, "PUT", fmt.Sprintf("/master.%s/file", repo), strings.NewReader("corrupted"), http.Header{
+		"Content-Md5": []string{base64.StdEncoding.EncodeToString(sum[:])},
+	})
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+	require.True(t, strings.Contains(string(body), "BadDigest"))
+
+	// chunked uploads have no Content-Length, but should still be checked
+	commitInfo, err := pachClient.InspectCommit(repo, "master")
+	require.NoError(t, err)
+	res = rawRequest(t, minioClient, "PUT", fmt.Sprintf("/master.%s/file", repo), io.MultiReader(strings.NewReader("corr"), strings.NewReader("upted")), http.Header{
+		"Content-Md5": []string{base64.StdEncoding.EncodeToString(sum[:])},
+	})
+	body, err = ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+	require.True(t, strings.Contains(string(body), "BadDigest"))
+	headInfo, err := pachClient.InspectCommit(repo, "master")
+	require.NoError(t, err)
+	require.Equal(t, commitInfo.Commit.ID, headInfo.Commit.ID)
+
+	fetchedContent, err := getObject(t, minioClient, fmt.Sprintf("master.%s", repo), "file")
+	require.NoError(t, err)
+	require.Equal(t, "content", fetchedContent)
+}
+
+func masterPutObjectStorageClass(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testputobjectstorageclass")
+	require.NoError(t, pachClient.CreateRepo(repo))
+	require.NoError(t, pachClient.CreateBranch(repo, "master", "", nil))
+
+	r := strings.NewReader("content")
+	_, err := minioClient.PutObject(fmt.Sprintf("master.%s", repo), "file", r, int64(r.Len()), minio.PutObjectOptions{StorageClass: "REDUCED_REDUNDANCY"})
+	require.NoError(t, err)
+
+	// PFS only has one tier, so content is reported in the standard class
+	// regardless of what was asked for
+	ch := minioClient.ListObjects(fmt.Sprintf("master.%s", repo), "", false, make(chan struct{}))
+	obj := <-ch
+	require.NoError(t, obj.Err)
+	require.Equal(t, "file", obj.Key)
+	require.Equal(t, "STANDARD", obj.StorageClass)
+
+	res := rawRequest(t, minioClient, "PUT", fmt.Sprintf("/master.%s/file", repo), strings.NewReader("content"), http.Header{
+		"X-Amz-Storage-Class": []string{"BOGUS"},
+	})
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+	require.True(t, strings.Contains(string(body), "InvalidStorageClass"))
+}
+
+func masterCommitMessage(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testcommitmessage")
+	require.NoError(t, pachClient.CreateRepo(repo))
+	require.NoError(t, pachClient.CreateBranch(repo, "master", "", nil))
+
+	r := strings.NewReader("content")
+	_, err := minioClient.PutObject(fmt.Sprintf("master.%s", repo), "file", r, int64(r.Len()), minio.PutObjectOptions{})
+	require.NoError(t, err)
+
+	commitInfo, err := pachClient.InspectCommit(repo, "master")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(commitInfo.Description, fmt.Sprintf("s3gateway: PutObject file in master.%s from ", repo)))
+}
+
+func masterObjectACL(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testobjectacl")
+	require.NoError(t, pachClient.CreateRepo(repo))
+	require.NoError(t, pachClient.CreateBranch(repo, "master", "", nil))
+
+	// canned ACLs that amount to the owner having full control are accepted,
+	// others aren't
+	res := rawRequest(t, minioClient, "PUT", fmt.Sprintf("/master.%s/file", repo), strings.NewReader("content"), http.Header{
+		"X-Amz-Acl": []string{"private"},
+	})
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	res = rawRequest(t, minioClient, "PUT", fmt.Sprintf("/master.%s/file2", repo), strings.NewReader("content"), http.Header{
+		"X-Amz-Acl": []string{"public-read"},
+	})
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusNotImplemented, res.StatusCode)
+
+	res = rawRequest(t, minioClient, "GET", fmt.Sprintf("/master.%s/file?acl", repo), nil, nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	policy := accessControlPolicy{}
+	require.NoError(t, xml.NewDecoder(res.Body).Decode(&policy))
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, defaultUser, policy.Owner)
+	require.Equal(t, 1, len(policy.AccessControlList))
+	require.Equal(t, "FULL_CONTROL", policy.AccessControlList[0].Permission)
+
+	res = rawRequest(t, minioClient, "PUT", fmt.Sprintf("/master.%s/file?acl", repo), nil, http.Header{
+		"X-Amz-Acl": []string{"bucket-owner-full-control"},
+	})
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	res = rawRequest(t, minioClient, "PUT", fmt.Sprintf("/master.%s/file?acl", repo), nil, http.Header{
+		"X-Amz-Grant-Read": []string{"uri=http://acs.amazonaws.com/groups/global/AllUsers"},
+	})
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusNotImplemented, res.StatusCode)
+
+	res = rawRequest(t, minioClient, "GET", fmt.Sprintf("/master.%s/nonexistent?acl", repo), nil, nil)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
 func masterRemoveObject(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
 	repo := tu.UniqueString("testremoveobject")
 	require.NoError(t, pachClient.CreateRepo(repo))
@@ -140,12 +551,373 @@ func masterRemoveObject(t *testing.T, pachClient *client.APIClient, minioClient
 	require.NoError(t, minioClient.RemoveObject(fmt.Sprintf("master.%s", repo), "file"))
 	require.NoError(t, minioClient.RemoveObject(fmt.Sprintf("master.%s", repo), "file"))
 
+	// deletes answer with an empty 204, as in S3, whether or not the object
+	// existed
+	for _, key := range []string{"file", "missing"} {
+		res := rawRequest(t, minioClient, "DELETE", fmt.Sprintf("/master.%s/%s", repo, key), nil, nil)
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		require.Equal(t, http.StatusNoContent, res.StatusCode)
+		require.Equal(t, 0, len(body))
+	}
+
 	// make sure the object no longer exists
 	_, err = getObject(t, minioClient, fmt.Sprintf("master.%s", repo), "file")
 	keyNotFoundError(t, err)
 }
 
+func masterUnsupportedSubresources(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testunsupportedsubresources")
+	require.NoError(t, pachClient.CreateRepo(repo))
+	_, err := pachClient.PutFile(repo, "master", "file", strings.NewReader("content"))
+	require.NoError(t, err)
+
+	for _, path := range []string{
+		"/master.%s/file?torrent",
+		"/master.%s/file?attributes",
+		"/master.%s?lifecycle",
+		"/master.%s?ownershipControls",
+		"/master.%s?intelligent-tiering",
+	} {
+		res := rawRequest(t, minioClient, "GET", fmt.Sprintf(path, repo), nil, nil)
+		s3Err := struct {
+			Code string `xml:"Code"`
+		}{}
+		require.NoError(t, xml.NewDecoder(res.Body).Decode(&s3Err))
+		require.NoError(t, res.Body.Close())
+		require.Equal(t, http.StatusNotImplemented, res.StatusCode, path)
+		require.Equal(t, "NotImplemented", s3Err.Code, path)
+	}
+
+	// parameters with values, or that may be empty, aren't subresources
+	res := rawRequest(t, minioClient, "GET", fmt.Sprintf("/master.%s/file?x-id=GetObject", repo), nil, nil)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	res = rawRequest(t, minioClient, "GET", fmt.Sprintf("/master.%s?list-type=2&prefix", repo), nil, nil)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func masterCompleteMultipartValidation(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testcompletemultipartvalidation")
+	require.NoError(t, pachClient.CreateRepo(repo))
+	require.NoError(t, pachClient.CreateBranch(repo, "master", "", nil))
+	bucket := fmt.Sprintf("master.%s", repo)
+
+	core := minio.Core{Client: minioClient}
+	uploadID, err := core.NewMultipartUpload(bucket, "file", minio.PutObjectOptions{})
+	require.NoError(t, err)
+	content1 := strings.Repeat("1", 5*1024*1024)
+	part1, err := core.PutObjectPart(bucket, "file", uploadID, 1, strings.NewReader(content1), int64(len(content1)), "", "", nil)
+	require.NoError(t, err)
+	part2, err := core.PutObjectPart(bucket, "file", uploadID, 2, strings.NewReader("2"), 1, "", "", nil)
+	require.NoError(t, err)
+
+	complete := func(parts ...minio.CompletePart) (int, string) {
+		var body strings.Builder
+		body.WriteString("<CompleteMultipartUpload>")
+		for _, part := range parts {
+			fmt.Fprintf(&body, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", part.PartNumber, part.ETag)
+		}
+		body.WriteString("</CompleteMultipartUpload>")
+		res := rawRequest(t, minioClient, "POST", fmt.Sprintf("/%s/file?uploadId=%s", bucket, uploadID), strings.NewReader(body.String()), nil)
+		s3Err := struct {
+			Code string `xml:"Code"`
+		}{}
+		if res.StatusCode != http.StatusOK {
+			require.NoError(t, xml.NewDecoder(res.Body).Decode(&s3Err))
+		}
+		require.NoError(t, res.Body.Close())
+		return res.StatusCode, s3Err.Code
+	}
+	first := minio.CompletePart{PartNumber: 1, ETag: part1.ETag}
+	second := minio.CompletePart{PartNumber: 2, ETag: part2.ETag}
+
+	for _, parts := range [][]minio.CompletePart{
+		{second, first},
+		{first, first, second},
+	} {
+		code, s3Code := complete(parts...)
+		require.Equal(t, http.StatusBadRequest, code)
+		require.Equal(t, "InvalidPartOrder", s3Code)
+	}
+	for _, parts := range [][]minio.CompletePart{
+		{{PartNumber: 1, ETag: strings.Repeat("0", len(part1.ETag))}, second},
+		{{PartNumber: 1, ETag: fmt.Sprintf("%x", md5.Sum([]byte(content1)))}, second},
+		{{PartNumber: 1, ETag: "bad"}, second},
+		{first, {PartNumber: 3, ETag: part2.ETag}},
+	} {
+		code, s3Code := complete(parts...)
+		require.Equal(t, http.StatusBadRequest, code)
+		require.Equal(t, "InvalidPart", s3Code)
+	}
+	_, err = minioClient.StatObject(bucket, "file", minio.StatObjectOptions{})
+	keyNotFoundError(t, err)
+
+	code, _ := complete(first, second)
+	require.Equal(t, http.StatusOK, code)
+	fetchedContent, err := getObject(t, minioClient, bucket, "file")
+	require.NoError(t, err)
+	require.Equal(t, content1+"2", fetchedContent)
+}
+
+func masterRemoveObjectConditional(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testremoveobjectconditional")
+	require.NoError(t, pachClient.CreateRepo(repo))
+	bucket := fmt.Sprintf("master.%s", repo)
+	_, err := pachClient.PutFile(repo, "master", "file", strings.NewReader("content1"))
+	require.NoError(t, err)
+	info, err := minioClient.StatObject(bucket, "file", minio.StatObjectOptions{})
+	require.NoError(t, err)
+	seen := info.LastModified
+
+	// the object is updated after the client last saw it
+	time.Sleep(time.Second)
+	_, err = pachClient.PutFileOverwrite(repo, "master", "file", strings.NewReader("content2"), 0)
+	require.NoError(t, err)
+
+	removeObject := func(key string, since time.Time) int {
+		res := rawRequest(t, minioClient, "DELETE", fmt.Sprintf("/%s/%s", bucket, key), nil, http.Header{
+			"If-Unmodified-Since": []string{since.UTC().Format(http.TimeFormat)},
+		})
+		require.NoError(t, res.Body.Close())
+		return res.StatusCode
+	}
+	require.Equal(t, http.StatusPreconditionFailed, removeObject("file", seen))
+	fetchedContent, err := getObject(t, minioClient, bucket, "file")
+	require.NoError(t, err)
+	require.Equal(t, "content2", fetchedContent)
+
+	require.Equal(t, http.StatusNoContent, removeObject("file", time.Now().Add(time.Minute)))
+	_, err = getObject(t, minioClient, bucket, "file")
+	keyNotFoundError(t, err)
+
+	// deleting a missing object is still a no-op
+	require.Equal(t, http.StatusNoContent, removeObject("file", seen))
+}
+
+func masterRemoveObjectVersion(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testremoveobjectversion")
+	require.NoError(t, pachClient.CreateRepo(repo))
+	_, err := pachClient.PutFile(repo, "master", "file", strings.NewReader("content1"))
+	require.NoError(t, err)
+	branchInfo, err := pachClient.InspectBranch(repo, "master")
+	require.NoError(t, err)
+	oldID := branchInfo.Head.ID
+
+	// deletes without a version add a delete marker
+	res := rawRequest(t, minioClient, "DELETE", fmt.Sprintf("/master.%s/file", repo), nil, nil)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusNoContent, res.StatusCode)
+	require.Equal(t, "true", res.Header.Get("x-amz-delete-marker"))
+	markerID := res.Header.Get("x-amz-version-id")
+	require.NotEqual(t, "", markerID)
+	require.NotEqual(t, oldID, markerID)
+	_, err = getObject(t, minioClient, fmt.Sprintf("master.%s", repo), "file")
+	keyNotFoundError(t, err)
+
+	// earlier versions remain readable
+	res = rawRequest(t, minioClient, "GET", fmt.Sprintf("/master.%s/file?versionId=%s", repo, oldID), nil, nil)
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "content1", string(body))
+
+	// only the latest version can be permanently deleted
+	res = rawRequest(t, minioClient, "DELETE", fmt.Sprintf("/master.%s/file?versionId=%s", repo, oldID), nil, nil)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusNotImplemented, res.StatusCode)
+
+	// deleting the delete marker restores the object
+	res = rawRequest(t, minioClient, "DELETE", fmt.Sprintf("/master.%s/file?versionId=%s", repo, markerID), nil, nil)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusNoContent, res.StatusCode)
+	require.Equal(t, "true", res.Header.Get("x-amz-delete-marker"))
+	fetchedContent, err := getObject(t, minioClient, fmt.Sprintf("master.%s", repo), "file")
+	require.NoError(t, err)
+	require.Equal(t, "content1", fetchedContent)
+
+	res = rawRequest(t, minioClient, "DELETE", fmt.Sprintf("/master.%s/file?versionId=%s", repo, "0123456789abcdef0123456789abcdef"), nil, nil)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func masterListParts(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testlistparts")
+	require.NoError(t, pachClient.CreateRepo(repo))
+	require.NoError(t, pachClient.CreateBranch(repo, "master", "", nil))
+	bucket := fmt.Sprintf("master.%s", repo)
+
+	core := minio.Core{Client: minioClient}
+	uploadID, err := core.NewMultipartUpload(bucket, "file", minio.PutObjectOptions{})
+	require.NoError(t, err)
+	for i := 1; i <= 11; i++ {
+		content := fmt.Sprintf("part%d", i)
+		_, err := core.PutObjectPart(bucket, "file", uploadID, i, strings.NewReader(content), int64(len(content)), "", "", nil)
+		require.NoError(t, err)
+	}
+
+	// parts are listed in numeric order across pages
+	var partNumbers []int
+	marker := 0
+	for {
+		result, err := core.ListObjectParts(bucket, "file", uploadID, marker, 4)
+		require.NoError(t, err)
+		for _, part := range result.ObjectParts {
+			partNumbers = append(partNumbers, part.PartNumber)
+		}
+		if !result.IsTruncated {
+			break
+		}
+		marker = result.NextPartNumberMarker
+	}
+	require.Equal(t, []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}, partNumbers)
+
+	_, err = core.ListObjectParts(bucket, "file", "bogus", 0, 1000)
+	require.YesError(t, err)
+	require.Equal(t, "NoSuchUpload", minio.ToErrorResponse(err).Code)
+}
+
 // Tests inserting and getting files over 64mb in size
+func masterUploadPartCopy(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testuploadpartcopy")
+	require.NoError(t, pachClient.CreateRepo(repo))
+	require.NoError(t, pachClient.CreateBranch(repo, "master", "", nil))
+	bucket := fmt.Sprintf("master.%s", repo)
+
+	// the first part is the minimum part size, so that the upload can be
+	// completed
+	partSize := int64(5 * 1024 * 1024)
+	content := strings.Repeat("x", int(partSize)) + "tail"
+	_, err := minioClient.PutObject(bucket, "src", strings.NewReader(content), int64(len(content)), minio.PutObjectOptions{})
+	require.NoError(t, err)
+
+	core := minio.Core{Client: minioClient}
+	uploadID, err := core.NewMultipartUpload(bucket, "dest", minio.PutObjectOptions{})
+	require.NoError(t, err)
+	part1, err := core.CopyObjectPart(bucket, "src", bucket, "dest", uploadID, 1, 0, partSize, nil)
+	require.NoError(t, err)
+	part2, err := core.CopyObjectPart(bucket, "src", bucket, "dest", uploadID, 2, partSize, 4, nil)
+	require.NoError(t, err)
+	_, err = core.CompleteMultipartUpload(bucket, "dest", uploadID, []minio.CompletePart{part1, part2})
+	require.NoError(t, err)
+
+	fetchedContent, err := getObject(t, minioClient, bucket, "dest")
+	require.NoError(t, err)
+	require.Equal(t, content, fetchedContent)
+
+	// ranges must lie within the source object
+	_, err = core.CopyObjectPart(bucket, "src", bucket, "dest", uploadID, 3, partSize, 5, nil)
+	require.YesError(t, err)
+}
+
+func masterObjectLock(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testobjectlock")
+	bucket := fmt.Sprintf("master.%s", repo)
+
+	res := rawRequest(t, minioClient, "PUT", "/"+bucket, nil, http.Header{
+		"x-amz-bucket-object-lock-enabled": []string{"bogus"},
+	})
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res = rawRequest(t, minioClient, "PUT", "/"+bucket, nil, http.Header{
+		"x-amz-bucket-object-lock-enabled": []string{"true"},
+	})
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	res = rawRequest(t, minioClient, "GET", fmt.Sprintf("/%s?object-lock", bucket), nil, nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	config := objectLockConfiguration{}
+	require.NoError(t, xml.NewDecoder(res.Body).Decode(&config))
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, "Enabled", config.ObjectLockEnabled)
+
+	// object lock requires versioning
+	res = rawRequest(t, minioClient, "GET", fmt.Sprintf("/%s?versioning", bucket), nil, nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	versioning := struct {
+		Status string `xml:"Status"`
+	}{}
+	require.NoError(t, xml.NewDecoder(res.Body).Decode(&versioning))
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, s2.VersioningEnabled, versioning.Status)
+
+	// the flag doesn't outlive the bucket
+	require.NoError(t, minioClient.RemoveBucket(bucket))
+	require.NoError(t, minioClient.MakeBucket(bucket, ""))
+	res = rawRequest(t, minioClient, "GET", fmt.Sprintf("/%s?object-lock", bucket), nil, nil)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+	require.NoError(t, minioClient.RemoveBucket(bucket))
+}
+
+func masterPostObject(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testpostobject")
+	require.NoError(t, pachClient.CreateRepo(repo))
+	require.NoError(t, pachClient.CreateBranch(repo, "master", "", nil))
+	bucket := fmt.Sprintf("master.%s", repo)
+
+	res := postObject(t, minioClient, bucket, map[string]string{"key": "dir/${filename}"}, "file1", "content1")
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusNoContent, res.StatusCode)
+	fetchedContent, err := getObject(t, minioClient, bucket, "dir/file1")
+	require.NoError(t, err)
+	require.Equal(t, "content1", fetchedContent)
+
+	res = postObject(t, minioClient, bucket, map[string]string{"key": "file2", "success_action_status": "201"}, "upload", "content2")
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	result := postResponse{}
+	require.NoError(t, xml.NewDecoder(res.Body).Decode(&result))
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, bucket, result.Bucket)
+	require.Equal(t, "file2", result.Key)
+	fetchedContent, err = getObject(t, minioClient, bucket, "file2")
+	require.NoError(t, err)
+	require.Equal(t, "content2", fetchedContent)
+
+	// forms must name the object
+	res = postObject(t, minioClient, bucket, map[string]string{}, "file3", "content3")
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func masterBucketNotification(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testbucketnotification")
+	require.NoError(t, pachClient.CreateRepo(repo))
+	require.NoError(t, pachClient.CreateBranch(repo, "master", "", nil))
+	bucket := fmt.Sprintf("master.%s", repo)
+
+	getNotification := func() string {
+		res := rawRequest(t, minioClient, "GET", fmt.Sprintf("/%s?notification", bucket), nil, nil)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		config := notificationConfiguration{}
+		require.NoError(t, xml.NewDecoder(res.Body).Decode(&config))
+		require.NoError(t, res.Body.Close())
+		return strings.TrimSpace(string(config.Inner))
+	}
+	require.Equal(t, "", getNotification())
+
+	queueConfig := "<QueueConfiguration><Queue>arn:aws:sqs:us-east-1:000000000000:queue</Queue><Event>s3:ObjectCreated:*</Event></QueueConfiguration>"
+	res := rawRequest(t, minioClient, "PUT", fmt.Sprintf("/%s?notification", bucket), strings.NewReader(
+		"<NotificationConfiguration xmlns=\"http://s3.amazonaws.com/doc/2006-03-01/\">"+queueConfig+"</NotificationConfiguration>",
+	), nil)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, queueConfig, getNotification())
+
+	res = rawRequest(t, minioClient, "PUT", fmt.Sprintf("/%s?notification", bucket), strings.NewReader("not xml"), nil)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res = rawRequest(t, minioClient, "GET", fmt.Sprintf("/master.%s?notification", tu.UniqueString("nonexistent")), nil, nil)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
 func masterLargeObjects(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
 	// test repos: repo1 exists, repo2 does not
 	repo1 := tu.UniqueString("testlargeobject1")
@@ -214,6 +986,17 @@ func masterGetObjectNoBranch(t *testing.T, pachClient *client.APIClient, minioCl
 	bucketNotFoundError(t, err)
 }
 
+func masterPutObjectNoBranch(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testputobjectnobranch")
+	require.NoError(t, pachClient.CreateRepo(repo))
+
+	// branches aren't created by writes unless WithAutoCreateBranches is set
+	_, err := minioClient.PutObject(fmt.Sprintf("branch.%s", repo), "file", strings.NewReader("content"), 7, minio.PutObjectOptions{})
+	bucketNotFoundError(t, err)
+	_, err = pachClient.InspectBranch(repo, "branch")
+	require.YesError(t, err)
+}
+
 func masterGetObjectNoRepo(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
 	repo := tu.UniqueString("testgetobjectnorepo")
 	_, err := getObject(t, minioClient, fmt.Sprintf("master.%s", repo), "file")
@@ -255,16 +1038,135 @@ func masterMakeBucketRedundant(t *testing.T, pachClient *client.APIClient, minio
 	require.Equal(t, err.Error(), "The bucket you tried to create already exists, and you own it.")
 }
 
-func masterMakeBucketDifferentBranches(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
-	repo := tu.UniqueString("testmakebucketdifferentbranches")
-	require.NoError(t, minioClient.MakeBucket(fmt.Sprintf("master.%s", repo), ""))
-	require.NoError(t, minioClient.MakeBucket(fmt.Sprintf("branch.%s", repo), ""))
-}
-
-func masterBucketExists(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
-	repo := tu.UniqueString("testbucketexists")
+func masterBucketDefaultHeaders(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testbucketdefaultheaders")
+	bucket := fmt.Sprintf("master.%s", repo)
 
-	exists, err := minioClient.BucketExists(fmt.Sprintf("master.%s", repo))
+	res := rawRequest(t, minioClient, "PUT", "/"+bucket, nil, http.Header{
+		"X-Pach-Default-Cache-Control": []string{"max-age=60"},
+	})
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	_, err := pachClient.PutFile(repo, "master", "file", strings.NewReader("content"))
+	require.NoError(t, err)
+
+	for _, method := range []string{"GET", "HEAD"} {
+		res = rawRequest(t, minioClient, method, fmt.Sprintf("/%s/file", bucket), nil, nil)
+		require.NoError(t, res.Body.Close())
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, "max-age=60", res.Header.Get("Cache-Control"))
+	}
+
+	// a read can override the defaults
+	res = rawRequest(t, minioClient, "GET", fmt.Sprintf("/%s/file?response-cache-control=no-cache", bucket), nil, nil)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "no-cache", res.Header.Get("Cache-Control"))
+
+	// the defaults don't outlive the bucket
+	require.NoError(t, minioClient.RemoveObject(bucket, "file"))
+	require.NoError(t, minioClient.RemoveBucket(bucket))
+	require.NoError(t, minioClient.MakeBucket(bucket, ""))
+	_, err = pachClient.PutFile(repo, "master", "file", strings.NewReader("content"))
+	require.NoError(t, err)
+	res = rawRequest(t, minioClient, "GET", fmt.Sprintf("/%s/file", bucket), nil, nil)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "", res.Header.Get("Cache-Control"))
+}
+
+func masterResponseHeaderOverrides(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testresponseheaderoverrides")
+	bucket := fmt.Sprintf("master.%s", repo)
+
+	res := rawRequest(t, minioClient, "PUT", "/"+bucket, nil, http.Header{
+		"X-Pach-Default-Cache-Control": []string{"max-age=60"},
+		"X-Pach-Default-Content-Type":  []string{"text/plain"},
+	})
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	_, err := pachClient.PutFile(repo, "master", "file", strings.NewReader("content"))
+	require.NoError(t, err)
+
+	// all of the overrides can be given together, and they take precedence
+	// over the bucket's defaults
+	overrides := map[string]string{
+		"Cache-Control":       "no-cache",
+		"Content-Disposition": "attachment; filename=\"report.txt\"",
+		"Content-Encoding":    "identity",
+		"Content-Language":    "en-US",
+		"Content-Type":        "application/octet-stream",
+		"Expires":             "Thu, 01 Dec 1994 16:00:00 GMT",
+	}
+	query := make(url.Values)
+	for name, value := range overrides {
+		query.Set("response-"+strings.ToLower(name), value)
+	}
+	res = rawRequest(t, minioClient, "GET", fmt.Sprintf("/%s/file?%s", bucket, query.Encode()), nil, nil)
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "content", string(body))
+	for name, value := range overrides {
+		require.Equal(t, value, res.Header.Get(name))
+	}
+
+	// headers that aren't overridden keep their defaults
+	res = rawRequest(t, minioClient, "GET", fmt.Sprintf("/%s/file?response-expires=0", bucket), nil, nil)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "0", res.Header.Get("Expires"))
+	require.Equal(t, "max-age=60", res.Header.Get("Cache-Control"))
+	require.Equal(t, "text/plain", res.Header.Get("Content-Type"))
+}
+
+func masterSignedHeaders(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testsignedheaders")
+	require.NoError(t, pachClient.CreateRepo(repo))
+	require.NoError(t, pachClient.CreateBranch(repo, "master", "", nil))
+
+	// build a request to the gateway from a presigned URL, and sign it with
+	// auth V4. Auth isn't active, so any credentials are accepted.
+	u, err := minioClient.Presign("HEAD", "bucket", "key", time.Minute, nil)
+	require.NoError(t, err)
+	u.Path = fmt.Sprintf("/master.%s/", repo)
+	u.RawQuery = ""
+	signedRequest := func(header http.Header) *http.Request {
+		req, err := http.NewRequest("HEAD", u.String(), nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		return s3signer.SignV4(*req, "key", "key", "", "us-east-1")
+	}
+
+	res, err := http.DefaultClient.Do(signedRequest(http.Header{"X-Amz-Meta-Foo": []string{"bar"}}))
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	// an x-amz-* header that's added after signing isn't covered by the
+	// signature
+	req := signedRequest(nil)
+	req.Header.Set("X-Amz-Meta-Foo", "bar")
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+}
+
+func masterMakeBucketDifferentBranches(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testmakebucketdifferentbranches")
+	require.NoError(t, minioClient.MakeBucket(fmt.Sprintf("master.%s", repo), ""))
+	require.NoError(t, minioClient.MakeBucket(fmt.Sprintf("branch.%s", repo), ""))
+}
+
+func masterBucketExists(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testbucketexists")
+
+	exists, err := minioClient.BucketExists(fmt.Sprintf("master.%s", repo))
 	require.NoError(t, err)
 	require.False(t, exists)
 
@@ -292,6 +1194,75 @@ func masterBucketExists(t *testing.T, pachClient *client.APIClient, minioClient
 	require.True(t, exists)
 }
 
+func masterBucketStats(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testbucketstats")
+	require.NoError(t, pachClient.CreateRepo(repo))
+	commit, err := pachClient.StartCommit(repo, "master")
+	require.NoError(t, err)
+	putListFileTestObject(t, pachClient, repo, commit.ID, "", 0)
+	putListFileTestObject(t, pachClient, repo, commit.ID, "dir/", 1)
+	require.NoError(t, pachClient.FinishCommit(repo, commit.ID))
+
+	res := rawRequest(t, minioClient, "HEAD", fmt.Sprintf("/master.%s/", repo), nil, http.Header{
+		"X-Pach-Stats": []string{"true"},
+	})
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "2", res.Header.Get("x-pach-file-count"))
+	require.Equal(t, "4", res.Header.Get("x-pach-size-bytes"))
+
+	// counts are cached by commit, so they follow new commits
+	_, err = pachClient.PutFile(repo, "master", "new", strings.NewReader("new"))
+	require.NoError(t, err)
+	res = rawRequest(t, minioClient, "HEAD", fmt.Sprintf("/master.%s/", repo), nil, http.Header{
+		"X-Pach-Stats": []string{"true"},
+	})
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "3", res.Header.Get("x-pach-file-count"))
+	require.Equal(t, "7", res.Header.Get("x-pach-size-bytes"))
+
+	// stats are only computed when they're asked for
+	res = rawRequest(t, minioClient, "HEAD", fmt.Sprintf("/master.%s/", repo), nil, nil)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "", res.Header.Get("x-pach-file-count"))
+	require.Equal(t, "", res.Header.Get("x-pach-size-bytes"))
+}
+
+func masterBucketHead(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testbuckethead")
+	require.NoError(t, pachClient.CreateRepo(repo))
+	_, err := pachClient.PutFile(repo, "master", "file", strings.NewReader("content1"))
+	require.NoError(t, err)
+	branchInfo, err := pachClient.InspectBranch(repo, "master")
+	require.NoError(t, err)
+	headID := branchInfo.Head.ID
+
+	res := rawRequest(t, minioClient, "HEAD", fmt.Sprintf("/master.%s/", repo), nil, http.Header{
+		"X-Pach-Head-Commit": []string{"true"},
+	})
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, headID, res.Header.Get("x-pach-head-commit"))
+
+	// the head commit is only looked up when it's asked for
+	res = rawRequest(t, minioClient, "HEAD", fmt.Sprintf("/master.%s/", repo), nil, nil)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "", res.Header.Get("x-pach-head-commit"))
+
+	// reads pinned to the head commit don't see later writes
+	_, err = pachClient.PutFile(repo, "master", "file", strings.NewReader("content2"))
+	require.NoError(t, err)
+	res = rawRequest(t, minioClient, "GET", fmt.Sprintf("/master.%s/file?versionId=%s", repo, headID), nil, nil)
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "content1", string(body))
+}
+
 func masterRemoveBucket(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
 	repo := tu.UniqueString("testremovebucket")
 
@@ -360,6 +1331,27 @@ func masterListObjectsPaginated(t *testing.T, pachClient *client.APIClient, mini
 		expectedFiles = append(expectedFiles, fmt.Sprintf("dir/%d", i))
 	}
 	checkListObjects(t, ch, &startTime, &endTime, expectedFiles, []string{})
+
+	// A prefix that's a full key lists just that key, with or without a
+	// delimiter
+	ch = minioClient.ListObjects(fmt.Sprintf("master.%s", repo), "dir/5", false, make(chan struct{}))
+	checkListObjects(t, ch, &startTime, &endTime, []string{"dir/5"}, []string{})
+	ch = minioClient.ListObjects(fmt.Sprintf("master.%s", repo), "dir/5", true, make(chan struct{}))
+	checkListObjects(t, ch, &startTime, &endTime, []string{"dir/5"}, []string{})
+
+	// Without a delimiter, nested files should be listed as flat keys rather
+	// than being grouped into common prefixes
+	ch = minioClient.ListObjects(fmt.Sprintf("master.%s", repo), "", true, make(chan struct{}))
+	expectedFiles = []string{}
+	for i := 0; i <= 1000; i++ {
+		expectedFiles = append(expectedFiles, fmt.Sprintf("%d", i))
+	}
+	for i := 0; i < 10; i++ {
+		expectedFiles = append(expectedFiles, fmt.Sprintf("dir/%d", i))
+	}
+	checkListObjects(t, ch, &startTime, &endTime, expectedFiles, []string{})
+	ch = minioClient.ListObjects(fmt.Sprintf("master.%s", repo), "d", true, make(chan struct{}))
+	checkListObjects(t, ch, &startTime, &endTime, expectedFiles[len(expectedFiles)-10:], []string{})
 }
 
 func masterListObjectsHeadlessBranch(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
@@ -416,6 +1408,172 @@ func masterListObjectsRecursive(t *testing.T, pachClient *client.APIClient, mini
 	checkListObjects(t, ch, &startTime, &endTime, expectedFiles, []string{})
 }
 
+func masterListObjectsStreamed(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testlistobjectsstreamed")
+	require.NoError(t, pachClient.CreateRepo(repo))
+	commit, err := pachClient.StartCommit(repo, "master")
+	require.NoError(t, err)
+	// enough files to span several flushes of the listing
+	for i := 0; i < 250; i++ {
+		_, err = pachClient.PutFile(repo, commit.ID, fmt.Sprintf("%03d", i), strings.NewReader(fmt.Sprintf("%d", i)))
+		require.NoError(t, err)
+	}
+	require.NoError(t, pachClient.FinishCommit(repo, commit.ID))
+
+	res := rawRequest(t, minioClient, "GET", fmt.Sprintf("/master.%s/?max-keys=200", repo), nil, nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	result := s2.ListObjectsResult{}
+	require.NoError(t, xml.NewDecoder(res.Body).Decode(&result))
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, 200, len(result.Contents))
+	require.True(t, result.IsTruncated)
+	require.Equal(t, "199", result.Contents[199].Key)
+
+	res = rawRequest(t, minioClient, "GET", fmt.Sprintf("/master.%s/?max-keys=bad", repo), nil, nil)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func masterListObjectsV2(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testlistobjectsv2")
+	require.NoError(t, pachClient.CreateRepo(repo))
+	commit, err := pachClient.StartCommit(repo, "master")
+	require.NoError(t, err)
+	putListFileTestObject(t, pachClient, repo, commit.ID, "", 0)
+	putListFileTestObject(t, pachClient, repo, commit.ID, "", 1)
+	putListFileTestObject(t, pachClient, repo, commit.ID, "", 2)
+	putListFileTestObject(t, pachClient, repo, commit.ID, "dir/", 3)
+	require.NoError(t, pachClient.FinishCommit(repo, commit.ID))
+
+	// minio asks for owners
+	var keys []string
+	for obj := range minioClient.ListObjectsV2(fmt.Sprintf("master.%s", repo), "", true, make(chan struct{})) {
+		require.NoError(t, obj.Err)
+		require.Equal(t, "pachyderm", obj.Owner.DisplayName)
+		keys = append(keys, obj.Key)
+	}
+	require.Equal(t, []string{"0", "1", "2", "dir/3"}, keys)
+
+	type listBucketV2Result struct {
+		Contents []struct {
+			Key   string
+			Owner *s2.User
+		}
+		CommonPrefixes        []s2.CommonPrefixes
+		KeyCount              int
+		IsTruncated           bool
+		NextContinuationToken string
+	}
+	list := func(query string) listBucketV2Result {
+		res := rawRequest(t, minioClient, "GET", fmt.Sprintf("/master.%s/?list-type=2&%s", repo, query), nil, nil)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		result := listBucketV2Result{}
+		require.NoError(t, xml.NewDecoder(res.Body).Decode(&result))
+		require.NoError(t, res.Body.Close())
+		return result
+	}
+
+	// owners are omitted unless they're asked for, and pages are linked by
+	// continuation tokens
+	result := list("delimiter=/&max-keys=2")
+	require.Equal(t, 2, result.KeyCount)
+	require.True(t, result.IsTruncated)
+	require.Equal(t, "0", result.Contents[0].Key)
+	require.Nil(t, result.Contents[0].Owner)
+	result = list("delimiter=/&max-keys=2&fetch-owner=true&continuation-token=" + url.QueryEscape(result.NextContinuationToken))
+	require.Equal(t, 2, result.KeyCount)
+	require.False(t, result.IsTruncated)
+	require.Equal(t, 1, len(result.Contents))
+	require.Equal(t, "2", result.Contents[0].Key)
+	require.Equal(t, "pachyderm", result.Contents[0].Owner.DisplayName)
+	require.Equal(t, "dir/", result.CommonPrefixes[0].Prefix)
+
+	result = list("start-after=1")
+	require.Equal(t, 2, result.KeyCount)
+	require.Equal(t, "2", result.Contents[0].Key)
+
+	// paging with start-after resumes seamlessly across directories, and
+	// past the last key
+	keys = nil
+	startAfter := ""
+	for {
+		result = list("max-keys=1&start-after=" + url.QueryEscape(startAfter))
+		if result.KeyCount == 0 {
+			break
+		}
+		startAfter = result.Contents[0].Key
+		keys = append(keys, startAfter)
+	}
+	require.Equal(t, []string{"0", "1", "2", "dir/3"}, keys)
+}
+
+func masterListObjectsIfNoneMatch(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testlistobjectsifnonematch")
+	require.NoError(t, pachClient.CreateRepo(repo))
+	_, err := pachClient.PutFile(repo, "master", "file", strings.NewReader("content"))
+	require.NoError(t, err)
+	commitInfo, err := pachClient.InspectCommit(repo, "master")
+	require.NoError(t, err)
+
+	list := func(version string) *http.Response {
+		var header http.Header
+		if version != "" {
+			header = http.Header{"If-None-Match": []string{fmt.Sprintf("\"%s\"", version)}}
+		}
+		res := rawRequest(t, minioClient, "GET", fmt.Sprintf("/master.%s/?list-type=2", repo), nil, header)
+		require.NoError(t, res.Body.Close())
+		return res
+	}
+	res := list("")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	version := res.Header.Get("x-pach-branch-version")
+	require.Equal(t, commitInfo.Commit.ID, version)
+
+	// the branch hasn't changed
+	res = list(version)
+	require.Equal(t, http.StatusNotModified, res.StatusCode)
+	require.Equal(t, version, res.Header.Get("x-pach-branch-version"))
+
+	// but once it has, the listing is served with the new version
+	_, err = pachClient.PutFile(repo, "master", "file2", strings.NewReader("content"))
+	require.NoError(t, err)
+	res = list(version)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.NotEqual(t, version, res.Header.Get("x-pach-branch-version"))
+	require.Equal(t, http.StatusNotModified, list(res.Header.Get("x-pach-branch-version")).StatusCode)
+}
+
+func masterListObjectsIfModifiedSince(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testlistobjectsifmodifiedsince")
+	require.NoError(t, pachClient.CreateRepo(repo))
+	_, err := pachClient.PutFile(repo, "master", "file", strings.NewReader("content"))
+	require.NoError(t, err)
+	commitInfo, err := pachClient.InspectCommit(repo, "master")
+	require.NoError(t, err)
+	finished, err := types.TimestampFromProto(commitInfo.Finished)
+	require.NoError(t, err)
+
+	list := func(since time.Time) *http.Response {
+		res := rawRequest(t, minioClient, "GET", fmt.Sprintf("/master.%s/", repo), nil, http.Header{
+			"If-Modified-Since": []string{since.UTC().Format(http.TimeFormat)},
+		})
+		require.NoError(t, res.Body.Close())
+		return res
+	}
+	require.Equal(t, http.StatusNotModified, list(finished).StatusCode)
+	require.Equal(t, http.StatusOK, list(finished.Add(-time.Hour)).StatusCode)
+
+	_, err = pachClient.PutFile(repo, "master", "file2", strings.NewReader("content"))
+	require.NoError(t, err)
+	commitInfo, err = pachClient.InspectCommit(repo, "master")
+	require.NoError(t, err)
+	newFinished, err := types.TimestampFromProto(commitInfo.Finished)
+	require.NoError(t, err)
+	if newFinished.Truncate(time.Second).After(finished) {
+		require.Equal(t, http.StatusOK, list(finished).StatusCode)
+	}
+}
+
 func masterAuthV2(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
 	// The other tests use auth V4, versus this which checks auth V2
 	minioClientV2, err := minio.NewV2("127.0.0.1:30600", "", "", false)
@@ -424,6 +1582,50 @@ func masterAuthV2(t *testing.T, pachClient *client.APIClient, minioClient *minio
 	require.NoError(t, err)
 }
 
+func masterRestoreObject(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	repo := tu.UniqueString("testrestoreobject")
+	require.NoError(t, pachClient.CreateRepo(repo))
+	_, err := pachClient.PutFile(repo, "master", "file", strings.NewReader("content"))
+	require.NoError(t, err)
+
+	res := rawRequest(t, minioClient, "POST", fmt.Sprintf("/master.%s/file?restore", repo), nil, nil)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	res = rawRequest(t, minioClient, "POST", fmt.Sprintf("/master.%s/nonexistent?restore", repo), nil, nil)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func masterBrowserPaths(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+	// browsers get a robots.txt while there's no bucket by that name
+	res := rawRequest(t, minioClient, "GET", "/robots.txt", nil, nil)
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.True(t, strings.Contains(string(body), "Disallow: /"))
+
+	// but S3 clients don't
+	res = rawRequest(t, minioClient, "GET", "/robots.txt", nil, http.Header{"X-Amz-Content-Sha256": {"UNSIGNED-PAYLOAD"}})
+	body, err = ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.False(t, strings.Contains(string(body), "Disallow: /"))
+
+	// and once the bucket exists, nobody does
+	require.NoError(t, pachClient.CreateRepo("txt"))
+	defer func() {
+		require.NoError(t, pachClient.DeleteRepo("txt", true))
+	}()
+	require.NoError(t, pachClient.CreateBranch("txt", "robots", "", nil))
+	res = rawRequest(t, minioClient, "GET", "/robots.txt", nil, nil)
+	body, err = ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.False(t, strings.Contains(string(body), "Disallow: /"))
+}
+
 func TestMasterDriver(t *testing.T) {
 	if testing.Short() {
 		t.Skip("Skipping integration tests in short mode")
@@ -445,21 +1647,96 @@ func TestMasterDriver(t *testing.T) {
 		t.Run("StatObject", func(t *testing.T) {
 			masterStatObject(t, pachClient, minioClient)
 		})
+		t.Run("StatObjectDirectory", func(t *testing.T) {
+			masterStatObjectDirectory(t, pachClient, minioClient)
+		})
+		t.Run("ObjectHeaders", func(t *testing.T) {
+			masterObjectHeaders(t, pachClient, minioClient)
+		})
+		t.Run("ObjectContentLength", func(t *testing.T) {
+			masterObjectContentLength(t, pachClient, minioClient)
+		})
 		t.Run("PutObject", func(t *testing.T) {
 			masterPutObject(t, pachClient, minioClient)
 		})
+		t.Run("PutObjectEmpty", func(t *testing.T) {
+			masterPutObjectEmpty(t, pachClient, minioClient)
+		})
+		t.Run("PutObjectChunked", func(t *testing.T) {
+			masterPutObjectChunked(t, pachClient, minioClient)
+		})
+		t.Run("PutObjectAborted", func(t *testing.T) {
+			masterPutObjectAborted(t, pachClient, minioClient)
+		})
+		t.Run("DeleteObjectsMalformed", func(t *testing.T) {
+			masterDeleteObjectsMalformed(t, pachClient, minioClient)
+		})
+		t.Run("PutObjectConditional", func(t *testing.T) {
+			masterPutObjectConditional(t, pachClient, minioClient)
+		})
+		t.Run("PutObjectContentMD5", func(t *testing.T) {
+			masterPutObjectContentMD5(t, pachClient, minioClient)
+		})
+		t.Run("PutObjectStorageClass", func(t *testing.T) {
+			masterPutObjectStorageClass(t, pachClient, minioClient)
+		})
+		t.Run("CommitMessage", func(t *testing.T) {
+			masterCommitMessage(t, pachClient, minioClient)
+		})
+		t.Run("CompleteMultipartValidation", func(t *testing.T) {
+			masterCompleteMultipartValidation(t, pachClient, minioClient)
+		})
+		t.Run("RemoveObjectConditional", func(t *testing.T) {
+			masterRemoveObjectConditional(t, pachClient, minioClient)
+		})
+		t.Run("ObjectACL", func(t *testing.T) {
+			masterObjectACL(t, pachClient, minioClient)
+		})
+		t.Run("UnsupportedSubresources", func(t *testing.T) {
+			masterUnsupportedSubresources(t, pachClient, minioClient)
+		})
 		t.Run("RemoveObject", func(t *testing.T) {
 			masterRemoveObject(t, pachClient, minioClient)
 		})
+		t.Run("RemoveObjectVersion", func(t *testing.T) {
+			masterRemoveObjectVersion(t, pachClient, minioClient)
+		})
 		t.Run("LargeObjects", func(t *testing.T) {
 			masterLargeObjects(t, pachClient, minioClient)
 		})
+		t.Run("ListParts", func(t *testing.T) {
+			masterListParts(t, pachClient, minioClient)
+		})
+		t.Run("UploadPartCopy", func(t *testing.T) {
+			masterUploadPartCopy(t, pachClient, minioClient)
+		})
+		t.Run("BucketDefaultHeaders", func(t *testing.T) {
+			masterBucketDefaultHeaders(t, pachClient, minioClient)
+		})
+		t.Run("ResponseHeaderOverrides", func(t *testing.T) {
+			masterResponseHeaderOverrides(t, pachClient, minioClient)
+		})
+		t.Run("SignedHeaders", func(t *testing.T) {
+			masterSignedHeaders(t, pachClient, minioClient)
+		})
+		t.Run("ObjectLock", func(t *testing.T) {
+			masterObjectLock(t, pachClient, minioClient)
+		})
+		t.Run("PostObject", func(t *testing.T) {
+			masterPostObject(t, pachClient, minioClient)
+		})
+		t.Run("BucketNotification", func(t *testing.T) {
+			masterBucketNotification(t, pachClient, minioClient)
+		})
 		t.Run("GetObjectNoHead", func(t *testing.T) {
 			masterGetObjectNoHead(t, pachClient, minioClient)
 		})
 		t.Run("GetObjectNoBranch", func(t *testing.T) {
 			masterGetObjectNoBranch(t, pachClient, minioClient)
 		})
+		t.Run("PutObjectNoBranch", func(t *testing.T) {
+			masterPutObjectNoBranch(t, pachClient, minioClient)
+		})
 		t.Run("GetObjectNoRepo", func(t *testing.T) {
 			masterGetObjectNoRepo(t, pachClient, minioClient)
 		})
@@ -481,6 +1758,12 @@ func TestMasterDriver(t *testing.T) {
 		t.Run("BucketExists", func(t *testing.T) {
 			masterBucketExists(t, pachClient, minioClient)
 		})
+		t.Run("BucketStats", func(t *testing.T) {
+			masterBucketStats(t, pachClient, minioClient)
+		})
+		t.Run("BucketHead", func(t *testing.T) {
+			masterBucketHead(t, pachClient, minioClient)
+		})
 		t.Run("RemoveBucket", func(t *testing.T) {
 			masterRemoveBucket(t, pachClient, minioClient)
 		})
@@ -496,8 +1779,982 @@ func TestMasterDriver(t *testing.T) {
 		t.Run("ListObjectsRecursive", func(t *testing.T) {
 			masterListObjectsRecursive(t, pachClient, minioClient)
 		})
+		t.Run("ListObjectsStreamed", func(t *testing.T) {
+			masterListObjectsStreamed(t, pachClient, minioClient)
+		})
+		t.Run("ListObjectsV2", func(t *testing.T) {
+			masterListObjectsV2(t, pachClient, minioClient)
+		})
+		t.Run("ListObjectsIfModifiedSince", func(t *testing.T) {
+			masterListObjectsIfModifiedSince(t, pachClient, minioClient)
+		})
+		t.Run("ListObjectsIfNoneMatch", func(t *testing.T) {
+			masterListObjectsIfNoneMatch(t, pachClient, minioClient)
+		})
 		t.Run("AuthV2", func(t *testing.T) {
 			masterAuthV2(t, pachClient, minioClient)
 		})
+		t.Run("RestoreObject", func(t *testing.T) {
+			masterRestoreObject(t, pachClient, minioClient)
+		})
+		t.Run("BrowserPaths", func(t *testing.T) {
+			masterBrowserPaths(t, pachClient, minioClient)
+		})
+	})
+}
+
+func TestMasterDriverDefaultBranch(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration tests in short mode")
+	}
+
+	testRunner(t, "master", NewMasterDriver(WithDefaultBranch("develop")), func(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+		repo := tu.UniqueString("testdefaultbranch")
+		require.NoError(t, pachClient.CreateRepo(repo))
+		_, err := pachClient.PutFile(repo, "develop", "file", strings.NewReader("develop"))
+		require.NoError(t, err)
+		_, err = pachClient.PutFile(repo, "master", "file", strings.NewReader("master"))
+		require.NoError(t, err)
+
+		fetchedContent, err := getObject(t, minioClient, repo, "file")
+		require.NoError(t, err)
+		require.Equal(t, "develop", fetchedContent)
+
+		fetchedContent, err = getObject(t, minioClient, fmt.Sprintf("master.%s", repo), "file")
+		require.NoError(t, err)
+		require.Equal(t, "master", fetchedContent)
 	})
 }
+
+func TestDefaultBucketResolver(t *testing.T) {
+	resolver := &defaultBucketResolver{defaultBranch: "master"}
+	for name, expected := range map[string][]string{
+		"repo":              {"repo", "master"},
+		"branch.repo":       {"repo", "branch"},
+		"my-branch.my_repo": {"my_repo", "my-branch"},
+		// only the first `.` separates the branch, so the rest of the name
+		// is never mistaken for part of it
+		"branch.repo.extra": {"repo.extra", "branch"},
+	} {
+		repo, branch, ok := resolver.Resolve(name)
+		require.True(t, ok, name)
+		require.Equal(t, expected, []string{repo, branch}, name)
+	}
+	for _, name := range []string{"", ".", ".repo", "branch."} {
+		_, _, ok := resolver.Resolve(name)
+		require.False(t, ok, name)
+	}
+
+	// names round-trip
+	repo, branch, ok := resolver.Resolve(resolver.Name("repo", "branch"))
+	require.True(t, ok)
+	require.Equal(t, []string{"repo", "branch"}, []string{repo, branch})
+}
+
+// tenantResolver serves the branches of repos as buckets called
+// `tenant-branch-repo`
+type tenantResolver struct{}
+
+func (tenantResolver) Resolve(name string) (string, string, bool) {
+	parts := strings.SplitN(name, "-", 3)
+	if len(parts) != 3 || parts[0] != "tenant" {
+		return "", "", false
+	}
+	return parts[2], parts[1], true
+}
+
+func (tenantResolver) Name(repo, branch string) string {
+	return fmt.Sprintf("tenant-%s-%s", branch, repo)
+}
+
+func TestMasterDriverBucketResolver(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration tests in short mode")
+	}
+
+	testRunner(t, "master", NewMasterDriver(WithBucketResolver(tenantResolver{})), func(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+		repo := tu.UniqueString("testbucketresolver")
+		require.NoError(t, pachClient.CreateRepo(repo))
+		_, err := pachClient.PutFile(repo, "master", "file", strings.NewReader("content"))
+		require.NoError(t, err)
+		bucket := fmt.Sprintf("tenant-master-%s", repo)
+
+		fetchedContent, err := getObject(t, minioClient, bucket, "file")
+		require.NoError(t, err)
+		require.Equal(t, "content", fetchedContent)
+
+		buckets, err := minioClient.ListBuckets()
+		require.NoError(t, err)
+		found := false
+		for _, b := range buckets {
+			if b.Name == bucket {
+				found = true
+			}
+		}
+		require.True(t, found)
+
+		// names that the resolver doesn't recognize aren't buckets
+		_, err = getObject(t, minioClient, fmt.Sprintf("master.%s", repo), "file")
+		require.YesError(t, err)
+	})
+}
+
+func TestCommitMessageTemplate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration tests in short mode")
+	}
+
+	testRunner(t, "master", NewMasterDriver(), func(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+		repo := tu.UniqueString("testcommitmessagetemplate")
+		require.NoError(t, pachClient.CreateRepo(repo))
+		require.NoError(t, pachClient.CreateBranch(repo, "master", "", nil))
+
+		r := strings.NewReader("content")
+		_, err := minioClient.PutObject(fmt.Sprintf("master.%s", repo), "file", r, int64(r.Len()), minio.PutObjectOptions{})
+		require.NoError(t, err)
+		commitInfo, err := pachClient.InspectCommit(repo, "master")
+		require.NoError(t, err)
+		require.Equal(t, "PutObject file", commitInfo.Description)
+
+		require.NoError(t, minioClient.RemoveObject(fmt.Sprintf("master.%s", repo), "file"))
+		commitInfo, err = pachClient.InspectCommit(repo, "master")
+		require.NoError(t, err)
+		require.Equal(t, "DeleteObject file", commitInfo.Description)
+	}, WithCommitMessage("{{.Operation}} {{.Key}}"))
+}
+
+func TestInvalidCommitMessageTemplate(t *testing.T) {
+	_, err := Server(0, NewMasterDriver(), client.NewForTest, WithCommitMessage("{{.Operation"))
+	require.YesError(t, err)
+}
+
+func TestReservedPaths(t *testing.T) {
+	// reserved paths are answered without a pachyderm client
+	clientFactory := func() (*client.APIClient, error) {
+		return nil, errors.Errorf("unexpected request to pachyderm")
+	}
+	server, err := Server(0, NewMasterDriver(), clientFactory)
+	require.NoError(t, err)
+	serve := func(method, target string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		for name, values := range header {
+			r.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		server.Handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// browser paths are only answered once they're known not to be buckets,
+	// which needs a client
+	require.Equal(t, http.StatusInternalServerError, serve("GET", "/favicon.ico", nil).Code)
+	require.Equal(t, http.StatusInternalServerError, serve("GET", "/robots.txt", nil).Code)
+
+	// reserved paths are answered without one
+	server, err = Server(0, NewMasterDriver(), clientFactory, WithReservedPaths("/.well-known/status"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, serve("GET", "/.well-known/status", nil).Code)
+	require.Equal(t, http.StatusNotFound, serve("HEAD", "/.well-known/status", nil).Code)
+
+	// anything else goes to s2, which fails to authenticate without a client
+	require.Equal(t, http.StatusInternalServerError, serve("GET", "/.well-known/status?list-type=2", nil).Code)
+	require.Equal(t, http.StatusInternalServerError, serve("PUT", "/.well-known/status", nil).Code)
+	require.Equal(t, http.StatusInternalServerError, serve("GET", "/master.repo", nil).Code)
+
+	// paths that could be buckets can't be reserved
+	for _, p := range []string{"/status", "/favicon.ico", "/master.repo/key", "/", "status"} {
+		_, err = Server(0, NewMasterDriver(), clientFactory, WithReservedPaths(p))
+		require.YesError(t, err)
+	}
+}
+
+func TestRequestOperation(t *testing.T) {
+	for _, test := range []struct {
+		method, target, bucket, key string
+		header                      http.Header
+		expected                    string
+	}{
+		{"GET", "/", "", "", nil, "ListBuckets"},
+		{"GET", "/b?list-type=2", "b", "", nil, "ListObjects"},
+		{"HEAD", "/b", "b", "", nil, "HeadBucket"},
+		{"PUT", "/b", "b", "", nil, "CreateBucket"},
+		{"DELETE", "/b", "b", "", nil, "DeleteBucket"},
+		{"PUT", "/b?versioning", "b", "", nil, "PutBucketVersioning"},
+		{"GET", "/b?versions", "b", "", nil, "ListObjectVersions"},
+		{"POST", "/b?delete", "b", "", nil, "DeleteObjects"},
+		{"GET", "/b/k", "b", "k", nil, "GetObject"},
+		{"HEAD", "/b/k", "b", "k", nil, "HeadObject"},
+		{"PUT", "/b/k", "b", "k", nil, "PutObject"},
+		{"PUT", "/b/k", "b", "k", http.Header{"X-Amz-Copy-Source": {"/b/j"}}, "CopyObject"},
+		{"DELETE", "/b/k", "b", "k", nil, "DeleteObject"},
+		{"GET", "/b/k?acl", "b", "k", nil, "GetObjectAcl"},
+		{"POST", "/b/k?uploads", "b", "k", nil, "CreateMultipartUpload"},
+		{"PUT", "/b/k?uploadId=u&partNumber=1", "b", "k", nil, "UploadPart"},
+		{"PUT", "/b/k?uploadId=u&partNumber=1", "b", "k", http.Header{"X-Amz-Copy-Source": {"/b/j"}}, "UploadPartCopy"},
+		{"POST", "/b/k?uploadId=u", "b", "k", nil, "CompleteMultipartUpload"},
+		{"DELETE", "/b/k?uploadId=u", "b", "k", nil, "AbortMultipartUpload"},
+	} {
+		r := httptest.NewRequest(test.method, test.target, nil)
+		for name, values := range test.header {
+			r.Header[name] = values
+		}
+		r = mux.SetURLVars(r, map[string]string{"bucket": test.bucket, "key": test.key})
+		require.Equal(t, test.expected, requestOperation(r), "%s %s", test.method, test.target)
+	}
+}
+
+func TestUnsupportedSubresource(t *testing.T) {
+	for target, expected := range map[string]bool{
+		"/b/k":                          false,
+		"/b/k?acl":                      false,
+		"/b/k?torrent":                  true,
+		"/b/k?uploadId=u&partNumber=1":  false,
+		"/b/k?versionId":                false,
+		"/b?list-type=2&prefix&marker=": false,
+		"/b?ownershipControls":          true,
+		"/b?foo=&bar":                   true,
+		"/b?foo=bar":                    false,
+		"/b?delete":                     false,
+	} {
+		require.Equal(t, expected, unsupportedSubresource(httptest.NewRequest("GET", target, nil)), target)
+	}
+}
+
+func TestFlushWriter(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	w := &flushWriter{ResponseWriter: recorder, flusher: recorder}
+	w.Header().Set("Content-Length", "7")
+	w.WriteHeader(http.StatusOK)
+	require.True(t, recorder.Flushed)
+
+	recorder.Flushed = false
+	n, err := w.Write([]byte("content"))
+	require.NoError(t, err)
+	require.Equal(t, 7, n)
+	require.True(t, recorder.Flushed)
+	require.Equal(t, "content", recorder.Body.String())
+}
+
+func TestTracer(t *testing.T) {
+	tracer := mocktracer.New()
+	c := &controller{}
+	WithTracer(tracer)(c)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = mux.SetURLVars(r, map[string]string{"bucket": "master.repo", "key": "file", "requestID": "1234"})
+		tagSpan(r)
+		// pachyderm clients made for the request carry its span
+		pc := withRequestSpan(&client.APIClient{}, r)
+		require.Equal(t, opentracing.SpanFromContext(r.Context()), opentracing.SpanFromContext(pc.Ctx()))
+		w.Write([]byte("content"))
+	})
+	r := httptest.NewRequest("PUT", "/master.repo/file", strings.NewReader("abc"))
+	c.serveTraced(httptest.NewRecorder(), r, handler)
+
+	spans := tracer.FinishedSpans()
+	require.Equal(t, 1, len(spans))
+	span := spans[0]
+	require.Equal(t, "s3gateway/PutObject", span.OperationName)
+	require.Equal(t, "PutObject", span.Tag("s3.operation"))
+	require.Equal(t, "master.repo", span.Tag("s3.bucket"))
+	require.Equal(t, "file", span.Tag("s3.key"))
+	require.Equal(t, "1234", span.Tag("s3.request_id"))
+	require.Equal(t, uint16(http.StatusOK), span.Tag("http.status_code"))
+	require.Equal(t, int64(3), span.Tag("bytes_read"))
+	require.Equal(t, int64(7), span.Tag("bytes_written"))
+}
+
+func TestRequestState(t *testing.T) {
+	var clients int
+	c := &controller{clientFactory: func() (*client.APIClient, error) {
+		clients++
+		return &client.APIClient{}, nil
+	}}
+	r := withRequestState(httptest.NewRequest("GET", "/master.repo/file", nil))
+
+	// a request's handlers share its client
+	pc, err := c.requestClient(r)
+	require.NoError(t, err)
+	otherPC, err := c.requestClient(r)
+	require.NoError(t, err)
+	require.Equal(t, 1, clients)
+	require.True(t, pc == otherPC)
+
+	// and look things up once
+	var lookups int
+	lookup := func() interface{} {
+		lookups++
+		return true
+	}
+	require.True(t, requestCached(r, "key", lookup).(bool))
+	require.True(t, requestCached(r, "key", lookup).(bool))
+	require.Equal(t, 1, lookups)
+
+	// requests that didn't go through the server have nothing shared
+	r = httptest.NewRequest("GET", "/master.repo/file", nil)
+	_, err = c.requestClient(r)
+	require.NoError(t, err)
+	require.Equal(t, 2, clients)
+}
+
+func TestHasGzipMagic(t *testing.T) {
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	_, err := gzipWriter.Write([]byte("content"))
+	require.NoError(t, err)
+	require.NoError(t, gzipWriter.Close())
+
+	for content, expected := range map[string]bool{
+		compressed.String(): true,
+		"content":           false,
+		"\x1f":              false,
+		"":                  false,
+	} {
+		reader := strings.NewReader(content)
+		gzipped, err := hasGzipMagic(reader)
+		require.NoError(t, err)
+		require.Equal(t, expected, gzipped)
+		// the content is left at its start
+		rest, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, content, string(rest))
+	}
+}
+
+func TestVirtualHostBucket(t *testing.T) {
+	c := &controller{}
+	r := httptest.NewRequest("GET", "/key", nil)
+	r.Host = "master.repo.s3.example.com"
+	require.Equal(t, "", c.virtualHostBucket(r))
+
+	WithBaseDomain("s3.example.com")(c)
+	for host, expected := range map[string]string{
+		"master.repo.s3.example.com":      "master.repo",
+		"master.repo.S3.Example.com:8080": "master.repo",
+		"s3.example.com":                  "",
+		"s3.example.com:8080":             "",
+		".s3.example.com":                 "",
+		"master.repo.example.com":         "",
+		"localhost:8080":                  "",
+	} {
+		r.Host = host
+		require.Equal(t, expected, c.virtualHostBucket(r), host)
+	}
+}
+
+func TestUnloggedBuckets(t *testing.T) {
+	c := &controller{driver: NewMasterDriver()}
+	require.True(t, c.logsRequest(httptest.NewRequest("GET", "/master.repo/file", nil)))
+
+	WithUnloggedBuckets("master.noisy")(c)
+	require.False(t, c.logsRequest(httptest.NewRequest("GET", "/master.noisy/file", nil)))
+	require.False(t, c.logsRequest(httptest.NewRequest("PUT", "/master.noisy/dir/file", nil)))
+	require.False(t, c.logsRequest(httptest.NewRequest("GET", "/master.noisy?list-type=2", nil)))
+	require.False(t, c.logsRequest(httptest.NewRequest("HEAD", "/master.noisy/", nil)))
+	require.True(t, c.logsRequest(httptest.NewRequest("GET", "/master.repo/file", nil)))
+	require.True(t, c.logsRequest(httptest.NewRequest("GET", "/master.noisy2/file", nil)))
+	require.True(t, c.logsRequest(httptest.NewRequest("GET", "/", nil)))
+
+	// buckets are compared by the branch they serve, whatever they're called
+	require.False(t, c.logsRequest(httptest.NewRequest("GET", "/noisy/file", nil)))
+	WithUnloggedBuckets("noisy")(c)
+	require.False(t, c.logsRequest(httptest.NewRequest("GET", "/master.noisy/file", nil)))
+	require.True(t, c.logsRequest(httptest.NewRequest("GET", "/branch.noisy/file", nil)))
+}
+
+func TestBaseDomain(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration tests in short mode")
+	}
+
+	testRunner(t, "master", NewMasterDriver(), func(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+		repo := tu.UniqueString("testbasedomain")
+		require.NoError(t, pachClient.CreateRepo(repo))
+		_, err := pachClient.PutFile(repo, "master", "dir/file", strings.NewReader("content"))
+		require.NoError(t, err)
+		bucket := fmt.Sprintf("master.%s", repo)
+
+		// virtual-hosted requests go to subdomains of the base domain, which
+		// are all dialed at the gateway
+		u, err := minioClient.Presign("GET", "bucket", "key", time.Minute, nil)
+		require.NoError(t, err)
+		gatewayAddr := u.Host
+		_, port, err := net.SplitHostPort(gatewayAddr)
+		require.NoError(t, err)
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, gatewayAddr)
+			},
+		}
+		// minio's auth V2 signer assumes that bucket names have no dots, so
+		// only signed auth V4 and unsigned requests are tested
+		for _, creds := range []*credentials.Credentials{
+			credentials.NewStaticV4("key", "key", ""),
+			credentials.NewStaticV4("", "", ""),
+		} {
+			vhostClient, err := minio.NewWithOptions(fmt.Sprintf("s3.local:%s", port), &minio.Options{
+				Creds:        creds,
+				BucketLookup: minio.BucketLookupDNS,
+			})
+			require.NoError(t, err)
+			vhostClient.SetCustomTransport(transport)
+
+			fetchedContent, err := getObject(t, vhostClient, bucket, "dir/file")
+			require.NoError(t, err)
+			require.Equal(t, "content", fetchedContent)
+			_, err = vhostClient.PutObject(bucket, "dir/file2", strings.NewReader("content2"), 8, minio.PutObjectOptions{})
+			require.NoError(t, err)
+			_, err = getObject(t, vhostClient, bucket, "missing")
+			keyNotFoundError(t, err)
+		}
+
+		// path-style addressing still works
+		fetchedContent, err := getObject(t, minioClient, bucket, "dir/file2")
+		require.NoError(t, err)
+		require.Equal(t, "content2", fetchedContent)
+	}, WithBaseDomain("s3.local"))
+}
+
+func TestCannedACLs(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration tests in short mode")
+	}
+
+	// the test's requests are all unsigned, and the authorizer doesn't let
+	// them read anything
+	authorizer := AuthorizerFunc(func(principal, op, bucket, key string) error {
+		if op == "GetObject" || op == "HeadObject" {
+			return errors.Errorf("%s may not %s %s", principal, op, key)
+		}
+		return nil
+	})
+
+	testRunner(t, "master", NewMasterDriver(), func(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+		repo := tu.UniqueString("testcannedacls")
+		require.NoError(t, pachClient.CreateRepo(repo))
+		require.NoError(t, pachClient.CreateBranch(repo, "master", "", nil))
+		bucket := fmt.Sprintf("master.%s", repo)
+
+		putObject := func(key string, header http.Header) {
+			res := rawRequest(t, minioClient, "PUT", fmt.Sprintf("/%s/%s", bucket, key), strings.NewReader("content"), header)
+			require.NoError(t, res.Body.Close())
+			require.Equal(t, http.StatusOK, res.StatusCode)
+		}
+		getObjectACL := func(key string) accessControlPolicy {
+			res := rawRequest(t, minioClient, "GET", fmt.Sprintf("/%s/%s?acl", bucket, key), nil, nil)
+			require.Equal(t, http.StatusOK, res.StatusCode)
+			policy := accessControlPolicy{}
+			require.NoError(t, xml.NewDecoder(res.Body).Decode(&policy))
+			require.NoError(t, res.Body.Close())
+			return policy
+		}
+		publicRead := http.Header{"X-Amz-Acl": []string{"public-read"}}
+
+		putObject("public", publicRead)
+		putObject("private", nil)
+
+		// public objects grant reads to everyone, and can be read anonymously
+		policy := getObjectACL("public")
+		require.Equal(t, 2, len(policy.AccessControlList))
+		require.Equal(t, allUsersGroup, policy.AccessControlList[1].Grantee.URI)
+		require.Equal(t, "READ", policy.AccessControlList[1].Permission)
+		fetchedContent, err := getObject(t, minioClient, bucket, "public")
+		require.NoError(t, err)
+		require.Equal(t, "content", fetchedContent)
+
+		// others don't
+		require.Equal(t, 1, len(getObjectACL("private").AccessControlList))
+		_, err = getObject(t, minioClient, bucket, "private")
+		accessDeniedError(t, err)
+
+		// overwriting a public object without an ACL makes it private
+		putObject("public", nil)
+		require.Equal(t, 1, len(getObjectACL("public").AccessControlList))
+		_, err = getObject(t, minioClient, bucket, "public")
+		accessDeniedError(t, err)
+
+		// an existing object can be made public
+		res := rawRequest(t, minioClient, "PUT", fmt.Sprintf("/%s/private?acl", bucket), nil, publicRead)
+		require.NoError(t, res.Body.Close())
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		fetchedContent, err = getObject(t, minioClient, bucket, "private")
+		require.NoError(t, err)
+		require.Equal(t, "content", fetchedContent)
+
+		// and deleting it forgets that it was
+		require.NoError(t, minioClient.RemoveObject(bucket, "private"))
+		putObject("private", nil)
+		_, err = getObject(t, minioClient, bucket, "private")
+		accessDeniedError(t, err)
+	}, WithAuthorizer(authorizer), WithCannedACLs())
+}
+
+func TestAuthorizer(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration tests in short mode")
+	}
+
+	authorizer := AuthorizerFunc(func(principal, op, bucket, key string) error {
+		switch {
+		case strings.HasPrefix(key, "private/") && op != "PutObject":
+		case strings.HasPrefix(key, "readonly/") && op != "GetObject" && op != "HeadObject":
+		default:
+			return nil
+		}
+		return errors.Errorf("%s may not %s %s", principal, op, key)
+	})
+
+	testRunner(t, "master", NewMasterDriver(), func(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+		repo := tu.UniqueString("testauthorizer")
+		require.NoError(t, pachClient.CreateRepo(repo))
+		require.NoError(t, pachClient.CreateBranch(repo, "master", "", nil))
+		bucket := fmt.Sprintf("master.%s", repo)
+
+		_, err := minioClient.PutObject(bucket, "public", strings.NewReader("content"), 7, minio.PutObjectOptions{})
+		require.NoError(t, err)
+		_, err = minioClient.PutObject(bucket, "private/file", strings.NewReader("content"), 7, minio.PutObjectOptions{})
+		require.NoError(t, err)
+
+		fetchedContent, err := getObject(t, minioClient, bucket, "public")
+		require.NoError(t, err)
+		require.Equal(t, "content", fetchedContent)
+		_, err = getObject(t, minioClient, bucket, "private/file")
+		accessDeniedError(t, err)
+		accessDeniedError(t, minioClient.RemoveObject(bucket, "private/file"))
+
+		// copies are also checked against their source
+		src := minio.NewSourceInfo(bucket, "private/file", nil)
+		dst, err := minio.NewDestinationInfo(bucket, "copy", nil, nil)
+		require.NoError(t, err)
+		accessDeniedError(t, minioClient.CopyObject(dst, src))
+		_, err = minioClient.StatObject(bucket, "copy", minio.StatObjectOptions{})
+		keyNotFoundError(t, err)
+
+		// the keys of multi-object deletes are each checked as DeleteObject
+		_, err = pachClient.PutFile(repo, "master", "readonly/file", strings.NewReader("content"))
+		require.NoError(t, err)
+		keys := make(chan string, 2)
+		keys <- "readonly/file"
+		keys <- "public"
+		close(keys)
+		var deleteErrs []minio.RemoveObjectError
+		for deleteErr := range minioClient.RemoveObjects(bucket, keys) {
+			deleteErrs = append(deleteErrs, deleteErr)
+		}
+		require.Equal(t, 1, len(deleteErrs))
+		require.Equal(t, "readonly/file", deleteErrs[0].ObjectName)
+		accessDeniedError(t, deleteErrs[0].Err)
+		_, err = minioClient.StatObject(bucket, "public", minio.StatObjectOptions{})
+		keyNotFoundError(t, err)
+
+		// the keys of browser form uploads are checked as PutObject
+		res := postObject(t, minioClient, bucket, map[string]string{"key": "readonly/${filename}"}, "file", "overwritten")
+		require.NoError(t, res.Body.Close())
+		require.Equal(t, http.StatusForbidden, res.StatusCode)
+		fetchedContent, err = getObject(t, minioClient, bucket, "readonly/file")
+		require.NoError(t, err)
+		require.Equal(t, "content", fetchedContent)
+
+		// keys in case-insensitive buckets are checked as they're stored
+		foldedRepo := tu.UniqueString("testauthorizerfolded")
+		foldedBucket := fmt.Sprintf("master.%s", foldedRepo)
+		res = rawRequest(t, minioClient, "PUT", "/"+foldedBucket, nil, http.Header{
+			"X-Pach-Case-Insensitive": []string{"true"},
+		})
+		require.NoError(t, res.Body.Close())
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		_, err = minioClient.PutObject(foldedBucket, "private/file", strings.NewReader("content"), 7, minio.PutObjectOptions{})
+		require.NoError(t, err)
+		_, err = getObject(t, minioClient, foldedBucket, "PRIVATE/file")
+		accessDeniedError(t, err)
+	}, WithAuthorizer(authorizer), WithCaseInsensitiveBuckets())
+}
+
+func TestMasterDriverMaxBuckets(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration tests in short mode")
+	}
+
+	testRunner(t, "master", NewMasterDriver(), func(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+		repos := []string{}
+		for i := 0; i < 3; i++ {
+			repo := tu.UniqueString("testmaxbuckets")
+			require.NoError(t, pachClient.CreateRepo(repo))
+			require.NoError(t, pachClient.CreateBranch(repo, "master", "", nil))
+			repos = append(repos, repo)
+			// creation dates are reported at second granularity
+			time.Sleep(time.Second)
+		}
+
+		buckets, err := minioClient.ListBuckets()
+		require.NoError(t, err)
+		require.Equal(t, 2, len(buckets))
+		require.Equal(t, fmt.Sprintf("master.%s", repos[2]), buckets[0].Name)
+		require.Equal(t, fmt.Sprintf("master.%s", repos[1]), buckets[1].Name)
+	}, WithMaxBuckets(2))
+}
+
+func TestGzipContentEncoding(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration tests in short mode")
+	}
+
+	testRunner(t, "master", NewMasterDriver(), func(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+		repo := tu.UniqueString("testgetobjectgzip")
+		require.NoError(t, pachClient.CreateRepo(repo))
+		require.NoError(t, pachClient.CreateBranch(repo, "master", "", nil))
+		path := fmt.Sprintf("/master.%s/file", repo)
+
+		var compressed bytes.Buffer
+		gzipWriter := gzip.NewWriter(&compressed)
+		_, err := gzipWriter.Write([]byte("content"))
+		require.NoError(t, err)
+		require.NoError(t, gzipWriter.Close())
+
+		putObject := func(content []byte, header http.Header) string {
+			res := rawRequest(t, minioClient, "PUT", path, bytes.NewReader(content), header)
+			require.NoError(t, res.Body.Close())
+			require.Equal(t, http.StatusOK, res.StatusCode)
+			return res.Header.Get("x-amz-version-id")
+		}
+		getObjectVersion := func(acceptEncoding, version string) (string, string) {
+			versionPath := path
+			if version != "" {
+				versionPath += "?versionId=" + version
+			}
+			res := rawRequest(t, minioClient, "GET", versionPath, nil, http.Header{"Accept-Encoding": []string{acceptEncoding}})
+			body, err := ioutil.ReadAll(res.Body)
+			require.NoError(t, err)
+			require.NoError(t, res.Body.Close())
+			require.Equal(t, http.StatusOK, res.StatusCode)
+			return res.Header.Get("Content-Encoding"), string(body)
+		}
+		getObject := func(acceptEncoding string) (string, string) {
+			return getObjectVersion(acceptEncoding, "")
+		}
+
+		plainVersion := putObject([]byte("plain"), nil)
+		putObject(compressed.Bytes(), http.Header{"Content-Encoding": []string{"gzip"}})
+
+		// clients that accept gzip get the stored content
+		encoding, body := getObject("gzip")
+		require.Equal(t, "gzip", encoding)
+		require.Equal(t, compressed.String(), body)
+
+		// others get it decompressed
+		encoding, body = getObject("identity")
+		require.Equal(t, "", encoding)
+		require.Equal(t, "content", body)
+
+		// versions written before it was compressed are served as they're stored
+		for _, acceptEncoding := range []string{"gzip", "identity"} {
+			encoding, body = getObjectVersion(acceptEncoding, plainVersion)
+			require.Equal(t, "", encoding)
+			require.Equal(t, "plain", body)
+		}
+
+		// as is the object once it's overwritten in PFS
+		_, err = pachClient.PutFileOverwrite(repo, "master", "file", strings.NewReader("overwritten"), 0)
+		require.NoError(t, err)
+		encoding, body = getObject("gzip")
+		require.Equal(t, "", encoding)
+		require.Equal(t, "overwritten", body)
+
+		// overwriting the object without an encoding clears it
+		putObject(compressed.Bytes(), http.Header{"Content-Encoding": []string{"gzip"}})
+		putObject(compressed.Bytes(), nil)
+		encoding, body = getObject("identity")
+		require.Equal(t, "", encoding)
+		require.Equal(t, compressed.String(), body)
+
+		// large content is decompressed as it's served, without a length
+		large := bytes.Repeat([]byte("content"), 2*1024*1024)
+		compressed.Reset()
+		gzipWriter = gzip.NewWriter(&compressed)
+		_, err = gzipWriter.Write(large)
+		require.NoError(t, err)
+		require.NoError(t, gzipWriter.Close())
+		putObject(compressed.Bytes(), http.Header{"Content-Encoding": []string{"gzip"}})
+		res := rawRequest(t, minioClient, "GET", path, nil, http.Header{"Accept-Encoding": []string{"identity"}})
+		largeBody, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, "", res.Header.Get("Content-Length"))
+		require.True(t, bytes.Equal(large, largeBody))
+	}, WithGzipContentEncoding())
+
+	// without the option, compressed writes are stored and served as they're
+	// sent
+	testRunner(t, "master", NewMasterDriver(), func(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+		repo := tu.UniqueString("testgzipcontentencodingdisabled")
+		require.NoError(t, pachClient.CreateRepo(repo))
+		require.NoError(t, pachClient.CreateBranch(repo, "master", "", nil))
+		path := fmt.Sprintf("/master.%s/file", repo)
+
+		var compressed bytes.Buffer
+		gzipWriter := gzip.NewWriter(&compressed)
+		_, err := gzipWriter.Write([]byte("content"))
+		require.NoError(t, err)
+		require.NoError(t, gzipWriter.Close())
+		res := rawRequest(t, minioClient, "PUT", path, bytes.NewReader(compressed.Bytes()), http.Header{"Content-Encoding": []string{"gzip"}})
+		require.NoError(t, res.Body.Close())
+		require.Equal(t, http.StatusOK, res.StatusCode)
+
+		res = rawRequest(t, minioClient, "GET", path, nil, http.Header{"Accept-Encoding": []string{"identity"}})
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, "", res.Header.Get("Content-Encoding"))
+		require.Equal(t, compressed.String(), string(body))
+	})
+}
+
+func TestCaseInsensitiveBuckets(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration tests in short mode")
+	}
+
+	testRunner(t, "master", NewMasterDriver(), func(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+		repo := tu.UniqueString("testcaseinsensitivebucket")
+		bucket := fmt.Sprintf("master.%s", repo)
+
+		res := rawRequest(t, minioClient, "PUT", "/"+bucket, nil, http.Header{
+			"X-Pach-Case-Insensitive": []string{"true"},
+		})
+		require.NoError(t, res.Body.Close())
+		require.Equal(t, http.StatusOK, res.StatusCode)
+
+		// keys are stored lowercased, and can be read in any case
+		r := strings.NewReader("content")
+		_, err := minioClient.PutObject(bucket, "Dir/File", r, int64(r.Len()), minio.PutObjectOptions{})
+		require.NoError(t, err)
+		fetchedContent, err := getObject(t, minioClient, bucket, "dir/FILE")
+		require.NoError(t, err)
+		require.Equal(t, "content", fetchedContent)
+		_, err = pachClient.InspectFile(repo, "master", "dir/file")
+		require.NoError(t, err)
+
+		// listings return the stored keys
+		var keys []string
+		for obj := range minioClient.ListObjects(bucket, "DIR/", false, make(chan struct{})) {
+			require.NoError(t, obj.Err)
+			keys = append(keys, obj.Key)
+		}
+		require.Equal(t, []string{"dir/file"}, keys)
+
+		require.NoError(t, minioClient.RemoveObject(bucket, "DIR/file"))
+		_, err = pachClient.InspectFile(repo, "master", "dir/file")
+		require.YesError(t, err)
+	}, WithCaseInsensitiveBuckets())
+
+	// buckets can't be made case-insensitive unless that's enabled
+	testRunner(t, "master", NewMasterDriver(), func(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+		bucket := fmt.Sprintf("master.%s", tu.UniqueString("testcaseinsensitivedisabled"))
+		res := rawRequest(t, minioClient, "PUT", "/"+bucket, nil, http.Header{
+			"X-Pach-Case-Insensitive": []string{"true"},
+		})
+		require.NoError(t, res.Body.Close())
+		require.Equal(t, http.StatusNotImplemented, res.StatusCode)
+	})
+}
+
+func TestAutoCreateBranches(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration tests in short mode")
+	}
+
+	testRunner(t, "master", NewMasterDriver(), func(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+		repo := tu.UniqueString("testautocreatebranches")
+		require.NoError(t, pachClient.CreateRepo(repo))
+
+		// the first write to a missing branch creates it
+		_, err := minioClient.PutObject(fmt.Sprintf("branch.%s", repo), "file", strings.NewReader("content"), 7, minio.PutObjectOptions{})
+		require.NoError(t, err)
+		branchInfo, err := pachClient.InspectBranch(repo, "branch")
+		require.NoError(t, err)
+		require.NotNil(t, branchInfo.Head)
+		fetchedContent, err := getObject(t, minioClient, fmt.Sprintf("branch.%s", repo), "file")
+		require.NoError(t, err)
+		require.Equal(t, "content", fetchedContent)
+
+		// but repos still have to exist
+		_, err = minioClient.PutObject(fmt.Sprintf("branch.%s", tu.UniqueString("testautocreatebranches")), "file", strings.NewReader("content"), 7, minio.PutObjectOptions{})
+		bucketNotFoundError(t, err)
+	}, WithAutoCreateBranches())
+}
+
+func TestSkipUnchangedPuts(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration tests in short mode")
+	}
+
+	testRunner(t, "master", NewMasterDriver(), func(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+		repo := tu.UniqueString("testskipunchangedputs")
+		require.NoError(t, pachClient.CreateRepo(repo))
+		require.NoError(t, pachClient.CreateBranch(repo, "master", "", nil))
+		bucket := fmt.Sprintf("master.%s", repo)
+
+		putObject := func(content string) {
+			r := strings.NewReader(content)
+			_, err := minioClient.PutObject(bucket, "file", r, int64(r.Len()), minio.PutObjectOptions{})
+			require.NoError(t, err)
+		}
+
+		putObject("content1")
+		commitInfo, err := pachClient.InspectCommit(repo, "master")
+		require.NoError(t, err)
+		firstCommit := commitInfo.Commit.ID
+
+		// re-uploading the same content shouldn't create a commit
+		putObject("content1")
+		commitInfo, err = pachClient.InspectCommit(repo, "master")
+		require.NoError(t, err)
+		require.Equal(t, firstCommit, commitInfo.Commit.ID)
+
+		// content of the same size that differs should still be written
+		putObject("content2")
+		commitInfo, err = pachClient.InspectCommit(repo, "master")
+		require.NoError(t, err)
+		require.NotEqual(t, firstCommit, commitInfo.Commit.ID)
+		fetchedContent, err := getObject(t, minioClient, bucket, "file")
+		require.NoError(t, err)
+		require.Equal(t, "content2", fetchedContent)
+	}, WithSkipUnchangedPuts())
+}
+
+func TestLastFinishWins(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration tests in short mode")
+	}
+
+	testRunner(t, "master", NewMasterDriver(), func(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+		repo := tu.UniqueString("testlastfinishwins")
+		require.NoError(t, pachClient.CreateRepo(repo))
+		require.NoError(t, pachClient.CreateBranch(repo, "master", "", nil))
+		path := fmt.Sprintf("/master.%s/file", repo)
+
+		// the slow write starts first, and is still uploading when the fast
+		// one finishes
+		body, w := io.Pipe()
+		slowDone := make(chan *http.Response)
+		go func() {
+			slowDone <- rawRequest(t, minioClient, "PUT", path, body, nil)
+		}()
+		_, err := w.Write([]byte("slow"))
+		require.NoError(t, err)
+
+		fast := rawRequest(t, minioClient, "PUT", path, strings.NewReader("fast"), nil)
+		require.Equal(t, http.StatusOK, fast.StatusCode)
+		_, err = w.Write([]byte(" write"))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		slow := <-slowDone
+		require.Equal(t, http.StatusOK, slow.StatusCode)
+
+		// the slow write finished last, so it wins, and its commit is the
+		// one that finished last
+		fetchedContent, err := getObject(t, minioClient, fmt.Sprintf("master.%s", repo), "file")
+		require.NoError(t, err)
+		require.Equal(t, "slow write", fetchedContent)
+		fastCommit, err := pachClient.InspectCommit(repo, fast.Header.Get("x-amz-version-id"))
+		require.NoError(t, err)
+		slowCommit, err := pachClient.InspectCommit(repo, slow.Header.Get("x-amz-version-id"))
+		require.NoError(t, err)
+		require.Equal(t, fastCommit.Commit.ID, slowCommit.ParentCommit.ID)
+		fastFinished, err := types.TimestampFromProto(fastCommit.Finished)
+		require.NoError(t, err)
+		slowFinished, err := types.TimestampFromProto(slowCommit.Finished)
+		require.NoError(t, err)
+		require.True(t, slowFinished.After(fastFinished))
+	}, WithLastFinishWins())
+}
+
+func TestOwner(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration tests in short mode")
+	}
+
+	owner := s2.User{ID: "0123456789abcdef0123456789abcdef", DisplayName: "testowner"}
+	testRunner(t, "master", NewMasterDriver(), func(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+		repo := tu.UniqueString("testowner")
+		require.NoError(t, pachClient.CreateRepo(repo))
+		_, err := pachClient.PutFile(repo, "master", "file", strings.NewReader("content"))
+		require.NoError(t, err)
+
+		res := rawRequest(t, minioClient, "GET", "/", nil, nil)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		result := s2.ListBucketsResult{}
+		require.NoError(t, xml.NewDecoder(res.Body).Decode(&result))
+		require.NoError(t, res.Body.Close())
+		require.Equal(t, owner, *result.Owner)
+
+		// objects in ListObjects (V1) listings have the same owner, and the
+		// storage class of all PFS content
+		for obj := range minioClient.ListObjects(fmt.Sprintf("master.%s", repo), "", true, make(chan struct{})) {
+			require.NoError(t, obj.Err)
+			require.Equal(t, owner.ID, obj.Owner.ID)
+			require.Equal(t, owner.DisplayName, obj.Owner.DisplayName)
+			require.Equal(t, globalStorageClass, obj.StorageClass)
+		}
+	}, WithOwner(owner.ID, owner.DisplayName))
+}
+
+func TestMaxMultipartUploads(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration tests in short mode")
+	}
+
+	// uploads left in progress by other tests count towards the limit
+	pachClient, err := client.NewForTest()
+	require.NoError(t, err)
+	inProgress := 0
+	if err := pachClient.GlobFileF(multipartRepo, "master", "**/.keep", func(*pfs.FileInfo) error {
+		inProgress++
+		return nil
+	}); err != nil && !pfsServer.IsRepoNotFoundErr(err) && !pfsServer.IsBranchNotFoundErr(err) {
+		require.NoError(t, err)
+	}
+
+	testRunner(t, "master", NewMasterDriver(), func(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client) {
+		repo := tu.UniqueString("testmaxmultipartuploads")
+		require.NoError(t, pachClient.CreateRepo(repo))
+		require.NoError(t, pachClient.CreateBranch(repo, "master", "", nil))
+		bucket := fmt.Sprintf("master.%s", repo)
+		core := minio.Core{Client: minioClient}
+
+		uploadID, err := core.NewMultipartUpload(bucket, "first", minio.PutObjectOptions{})
+		require.NoError(t, err)
+
+		// the limit is reached, so new uploads are turned away. The raw
+		// request avoids the minio client's retries of 503s.
+		res := rawRequest(t, minioClient, "POST", fmt.Sprintf("/%s/second?uploads", bucket), nil, nil)
+		require.NoError(t, res.Body.Close())
+		require.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+
+		// until one is finished
+		require.NoError(t, core.AbortMultipartUpload(bucket, "first", uploadID))
+		uploadID, err = core.NewMultipartUpload(bucket, "second", minio.PutObjectOptions{})
+		require.NoError(t, err)
+		require.NoError(t, core.AbortMultipartUpload(bucket, "second", uploadID))
+
+		// concurrent uploads to the same gateway can't exceed the limit
+		// together
+		statuses := make(chan int, 5)
+		for i := 0; i < cap(statuses); i++ {
+			go func() {
+				res := rawRequest(t, minioClient, "POST", fmt.Sprintf("/%s/concurrent?uploads", bucket), nil, nil)
+				res.Body.Close()
+				statuses <- res.StatusCode
+			}()
+		}
+		started := 0
+		for i := 0; i < cap(statuses); i++ {
+			if <-statuses == http.StatusOK {
+				started++
+			}
+		}
+		require.Equal(t, 1, started)
+	}, WithMaxMultipartUploads(inProgress+1, 0))
+}
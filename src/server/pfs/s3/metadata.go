@@ -0,0 +1,99 @@
+package s3
+
+import (
+	"bytes"
+	"path"
+
+	"github.com/pachyderm/pachyderm/src/client"
+	pfsServer "github.com/pachyderm/pachyderm/src/server/pfs"
+)
+
+// bucketMetadata is a kind of metadata that S3 keeps for buckets or objects,
+// but that PFS has no place for. Each kind is stored in its own directory of
+// the multipart repo, in a file per bucket, or per object under a directory
+// per bucket. Repo names can't contain dots, so these directories can't
+// collide with the content of a multipart upload.
+type bucketMetadata string
+
+const (
+	// objectLockMetadata flags the buckets that were created with object
+	// lock enabled
+	objectLockMetadata bucketMetadata = ".objectlock"
+	// notificationMetadata holds the notification configuration of each
+	// bucket
+	notificationMetadata bucketMetadata = ".notification"
+	// contentEncodingMetadata flags the objects that were written with
+	// `Content-Encoding: gzip`
+	contentEncodingMetadata bucketMetadata = ".contentencoding"
+	// defaultHeadersMetadata holds the headers each bucket serves its objects
+	// with
+	defaultHeadersMetadata bucketMetadata = ".defaultheaders"
+	// caseInsensitiveMetadata flags the buckets that were created
+	// case-insensitive
+	caseInsensitiveMetadata bucketMetadata = ".caseinsensitive"
+	// aclMetadata holds the canned ACL of each object that has one other
+	// than the owner having full control
+	aclMetadata bucketMetadata = ".acl"
+)
+
+// allBucketMetadata is every kind of bucket metadata, all of which is
+// cleared when a bucket is deleted, so that a bucket created later with the
+// same name doesn't inherit it
+var allBucketMetadata = []bucketMetadata{
+	objectLockMetadata,
+	notificationMetadata,
+	contentEncodingMetadata,
+	defaultHeadersMetadata,
+	caseInsensitiveMetadata,
+	aclMetadata,
+}
+
+// path returns the path of the metadata of a bucket, or of one of its
+// objects if file isn't ""
+func (m bucketMetadata) path(bucket *Bucket, file string) string {
+	return path.Join(string(m), bucket.Repo, bucket.Commit, file)
+}
+
+// getMetadata returns the metadata of a bucket, or of one of its objects if
+// file isn't "", and whether it's set
+func (c *controller) getMetadata(pc *client.APIClient, kind bucketMetadata, bucket *Bucket, file string) ([]byte, bool, error) {
+	var buf bytes.Buffer
+	if err := pc.GetFile(c.repo, "master", kind.path(bucket, file), 0, 0, &buf); err != nil {
+		if isMetadataNotFoundErr(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return buf.Bytes(), true, nil
+}
+
+// setMetadata sets the metadata of a bucket, or of one of its objects if
+// file isn't ""
+func (c *controller) setMetadata(pc *client.APIClient, kind bucketMetadata, bucket *Bucket, file string, value []byte) error {
+	if err := c.ensureRepo(pc); err != nil {
+		return err
+	}
+	_, err := pc.PutFileOverwrite(c.repo, "master", kind.path(bucket, file), bytes.NewReader(value), 0)
+	return err
+}
+
+// clearMetadata removes the metadata of a bucket, or of one of its objects if
+// file isn't "". Clearing the metadata of a bucket whose metadata is kept
+// per object clears that of all its objects.
+func (c *controller) clearMetadata(pc *client.APIClient, kind bucketMetadata, bucket *Bucket, file string) error {
+	metadataPath := kind.path(bucket, file)
+	if _, err := pc.InspectFile(c.repo, "master", metadataPath); err != nil {
+		if isMetadataNotFoundErr(err) {
+			// nothing was set
+			return nil
+		}
+		return err
+	}
+	return pc.DeleteFile(c.repo, "master", metadataPath)
+}
+
+// isMetadataNotFoundErr returns whether err means that metadata isn't set,
+// including because the multipart repo hasn't been created yet
+func isMetadataNotFoundErr(err error) bool {
+	return pfsServer.IsFileNotFoundErr(err) || pfsServer.IsRepoNotFoundErr(err) || pfsServer.IsBranchNotFoundErr(err)
+}
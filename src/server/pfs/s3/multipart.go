@@ -1,13 +1,18 @@
 package s3
 
 import (
+	"encoding/xml"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"path"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gogo/protobuf/types"
 	"github.com/pachyderm/pachyderm/src/client"
@@ -134,7 +139,7 @@ func (c *controller) ListMultipart(r *http.Request, bucketName, keyMarker, uploa
 		result.Uploads = append(result.Uploads, &s2.Upload{
 			Key:          key,
 			UploadID:     uploadID,
-			Initiator:    defaultUser,
+			Initiator:    c.owner,
 			StorageClass: globalStorageClass,
 			Initiated:    timestamp,
 		})
@@ -153,6 +158,13 @@ func (c *controller) InitMultipart(r *http.Request, bucketName, key string) (str
 		return "", err
 	}
 
+	if err := checkStorageClass(r); err != nil {
+		return "", err
+	}
+	if err := checkACL(r); err != nil {
+		return "", err
+	}
+
 	if err = c.ensureRepo(pc); err != nil {
 		return "", err
 	}
@@ -169,16 +181,112 @@ func (c *controller) InitMultipart(r *http.Request, bucketName, key string) (str
 		return "", s2.NotImplementedError(r)
 	}
 
+	if err := c.reserveMultipartUpload(pc, r); err != nil {
+		return "", err
+	}
+
 	uploadID := uuid.NewWithoutDashes()
 
 	_, err = pc.PutFileOverwrite(c.repo, "master", keepPath(bucket.Repo, bucket.Commit, key, uploadID), strings.NewReader(""), 0)
 	if err != nil {
+		c.releaseMultipartUpload()
 		return "", err
 	}
 
 	return uploadID, nil
 }
 
+// multipartRecountInterval is how often the gateway's count of multipart
+// uploads in progress is recounted from PFS
+const multipartRecountInterval = time.Minute
+
+// multipartCount is the gateway's count of the multipart uploads in
+// progress, which WithMaxMultipartUploads limits. Counting them in PFS means
+// walking the whole multipart repo, so the count is kept in memory, adjusted
+// as this gateway starts and finishes uploads, and only recounted once it's
+// older than multipartRecountInterval, which picks up the uploads that other
+// gateways have started and finished in the meantime.
+type multipartCount struct {
+	mu        sync.Mutex
+	uploads   int
+	countedAt time.Time
+}
+
+// reserveMultipartUpload counts a new multipart upload, or returns an error
+// if it would exceed the limits set with WithMaxMultipartUploads. Uploads are
+// reserved one at a time, so concurrent requests to the same gateway can't
+// exceed the limit together, but requests to different gateways can, until
+// the next recount, so the limit is approximate.
+func (c *controller) reserveMultipartUpload(pc *client.APIClient, r *http.Request) error {
+	if c.maxMultipartUploads > 0 {
+		if err := c.countMultipartUpload(pc, r); err != nil {
+			return err
+		}
+	}
+	if c.maxMultipartBytes > 0 {
+		// the size of each repo's uploads is that of its top-level
+		// directory, so one listing gives them all
+		fileInfos, err := pc.ListFile(c.repo, "master", "/")
+		if err != nil {
+			c.releaseMultipartUpload()
+			return err
+		}
+		var size uint64
+		for _, fileInfo := range fileInfos {
+			// dot directories hold bucket settings rather than parts
+			if !strings.HasPrefix(path.Base(fileInfo.File.Path), ".") {
+				size += fileInfo.SizeBytes
+			}
+		}
+		if size >= c.maxMultipartBytes {
+			c.releaseMultipartUpload()
+			return slowDownError(r)
+		}
+	}
+	return nil
+}
+
+// countMultipartUpload adds a new multipart upload to the gateway's count,
+// recounting first if the count is stale, or returns an error if there's no
+// room for it
+func (c *controller) countMultipartUpload(pc *client.APIClient, r *http.Request) error {
+	count := &c.multipartUploads
+	count.mu.Lock()
+	defer count.mu.Unlock()
+	if time.Since(count.countedAt) >= multipartRecountInterval {
+		uploads := 0
+		if err := pc.GlobFileF(c.repo, "master", "**/.keep", func(fileInfo *pfsClient.FileInfo) error {
+			if _, _, _, _, err := multipartKeepArgs(fileInfo.File.Path); err == nil {
+				uploads++
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		count.uploads = uploads
+		count.countedAt = time.Now()
+	}
+	if count.uploads >= c.maxMultipartUploads {
+		return slowDownError(r)
+	}
+	count.uploads++
+	return nil
+}
+
+// releaseMultipartUpload uncounts a multipart upload that has been completed
+// or aborted, or that failed to start
+func (c *controller) releaseMultipartUpload() {
+	if c.maxMultipartUploads == 0 {
+		return
+	}
+	count := &c.multipartUploads
+	count.mu.Lock()
+	defer count.mu.Unlock()
+	if count.uploads > 0 {
+		count.uploads--
+	}
+}
+
 func (c *controller) AbortMultipart(r *http.Request, bucketName, key, uploadID string) error {
 	c.logger.Debugf("AbortMultipart: bucketName=%+v, key=%+v, uploadID=%+v", bucketName, key, uploadID)
 
@@ -205,10 +313,47 @@ func (c *controller) AbortMultipart(r *http.Request, bucketName, key, uploadID s
 	if err != nil {
 		return s2.InternalError(r, err)
 	}
+	c.releaseMultipartUpload()
 
 	return nil
 }
 
+// validateParts checks the parts that a CompleteMultipart request lists,
+// before any of them are copied into the object: part numbers must be
+// strictly ascending, each part must have been uploaded with the given ETag,
+// and every part but the last must be at least 5mb, as in S3.
+func (c *controller) validateParts(pc *client.APIClient, r *http.Request, bucket *Bucket, key, uploadID string, parts []*s2.Part) error {
+	for i, part := range parts {
+		// s2 only checks that part numbers don't decrease
+		if i > 0 && part.PartNumber <= parts[i-1].PartNumber {
+			return s2.InvalidPartOrderError(nil, r)
+		}
+
+		fileInfo, err := pc.InspectFile(c.repo, "master", chunkPath(bucket.Repo, bucket.Commit, key, uploadID, part.PartNumber))
+		if err != nil {
+			if pfsServer.IsFileNotFoundErr(err) {
+				return s2.InvalidPartError(r)
+			}
+			return err
+		}
+
+		// the ETags of parts are the hashes of their PFS files, which is
+		// what UploadPart and ListParts return, so anything else, such as
+		// an MD5 that a client computed itself, can't be checked. s2 adds
+		// quotes to the ETags it reads.
+		if strings.Trim(part.ETag, "\"") != fileETag(fileInfo) {
+			return s2.InvalidPartError(r)
+		}
+
+		if i < len(parts)-1 && fileInfo.SizeBytes < 5*1024*1024 {
+			// each part, except for the last, is expected to be at least 5mb
+			// in s3
+			return s2.EntityTooSmallError(r)
+		}
+	}
+	return nil
+}
+
 func (c *controller) CompleteMultipart(r *http.Request, bucketName, key, uploadID string, parts []*s2.Part) (*s2.CompleteMultipartResult, error) {
 	c.logger.Debugf("CompleteMultipart: bucketName=%+v, key=%+v, uploadID=%+v, parts=%+v", bucketName, key, uploadID, parts)
 
@@ -241,58 +386,51 @@ func (c *controller) CompleteMultipart(r *http.Request, bucketName, key, uploadI
 		return nil, err
 	}
 
+	if err := c.validateParts(pc, r, bucket, key, uploadID, parts); err != nil {
+		return nil, err
+	}
+
 	// check if the destination file already exists, and if so, delete it
 	_, err = pc.InspectFile(bucket.Repo, bucket.Commit, key)
 	if err != nil && !pfsServer.IsFileNotFoundErr(err) && !pfsServer.IsNoHeadErr(err) {
 		return nil, err
-	} else if err == nil {
-		err = pc.DeleteFile(bucket.Repo, bucket.Commit, key)
-		if err != nil {
-			if errutil.IsWriteToOutputBranchError(err) {
-				return nil, writeToOutputBranchError(r)
-			}
-			return nil, err
-		}
 	}
+	exists := err == nil
 
-	for i, part := range parts {
-		srcPath := chunkPath(bucket.Repo, bucket.Commit, key, uploadID, part.PartNumber)
-
-		fileInfo, err := pc.InspectFile(c.repo, "master", srcPath)
-		if err != nil {
-			if pfsServer.IsFileNotFoundErr(err) {
-				return nil, s2.InvalidPartError(r)
-			}
-			return nil, err
-		}
-
-		// Only verify the ETag when it's of the same length as PFS file
-		// hashes. This is because s3 clients will generally use md5 for
-		// ETags, and would otherwise fail.
-		expectedETag := fmt.Sprintf("%x", fileInfo.Hash)
-		if len(part.ETag) == len(expectedETag) && part.ETag != expectedETag {
-			return nil, s2.InvalidPartError(r)
+	err = c.withCommit(pc, r, bucket, bucketCaps, "CompleteMultipart", key, func(commitID string) error {
+		// like PutObject, completing an upload can be conditional on the
+		// object that it replaces
+		if err := checkWritePreconditions(pc, r, bucket.Repo, commitID, key); err != nil {
+			return err
 		}
-
-		if i < len(parts)-1 && fileInfo.SizeBytes < 5*1024*1024 {
-			// each part, except for the last, is expected to be at least 5mb
-			// in s3
-			return nil, s2.EntityTooSmallError(r)
+		if exists {
+			if err := pc.DeleteFile(bucket.Repo, commitID, key); err != nil {
+				return err
+			}
 		}
 
-		err = pc.CopyFile(c.repo, "master", srcPath, bucket.Repo, bucket.Commit, key, false)
-		if err != nil {
-			if errutil.IsWriteToOutputBranchError(err) {
-				return nil, writeToOutputBranchError(r)
+		for _, part := range parts {
+			srcPath := chunkPath(bucket.Repo, bucket.Commit, key, uploadID, part.PartNumber)
+			if err := pc.CopyFile(c.repo, "master", srcPath, bucket.Repo, commitID, key, false); err != nil {
+				return err
 			}
-			return nil, err
 		}
+		// the new object is private, like that of any write that doesn't
+		// set an ACL
+		return c.setObjectACL(pc, bucket, key, "")
+	})
+	if err != nil {
+		if errutil.IsWriteToOutputBranchError(err) {
+			return nil, writeToOutputBranchError(r)
+		}
+		return nil, err
 	}
 
 	err = pc.DeleteFile(c.repo, "master", parentDirPath(bucket.Repo, bucket.Commit, key, uploadID))
 	if err != nil {
 		return nil, err
 	}
+	c.releaseMultipartUpload()
 
 	fileInfo, err := pc.InspectFile(bucket.Repo, bucket.Commit, key)
 	if err != nil && !pfsServer.IsOutputCommitNotFinishedErr(err) {
@@ -301,7 +439,7 @@ func (c *controller) CompleteMultipart(r *http.Request, bucketName, key, uploadI
 
 	result := s2.CompleteMultipartResult{Location: globalLocation}
 	if fileInfo != nil {
-		result.ETag = fmt.Sprintf("%x", fileInfo.Hash)
+		result.ETag = fileETag(fileInfo)
 		result.Version = fileInfo.File.Commit.ID
 	}
 
@@ -325,13 +463,24 @@ func (c *controller) ListMultipartChunks(r *http.Request, bucketName, key, uploa
 		return nil, err
 	}
 
+	_, err = pc.InspectFile(c.repo, "master", keepPath(bucket.Repo, bucket.Commit, key, uploadID))
+	if err != nil {
+		if pfsServer.IsFileNotFoundErr(err) {
+			return nil, s2.NoSuchUploadError(r)
+		}
+		return nil, err
+	}
+
 	result := s2.ListMultipartChunksResult{
-		Initiator:    &defaultUser,
-		Owner:        &defaultUser,
+		Initiator:    &c.owner,
+		Owner:        &c.owner,
 		StorageClass: globalStorageClass,
 		Parts:        []*s2.Part{},
 	}
 
+	// chunks are globbed in lexicographic order of their paths, e.g. part 10
+	// before part 2, so they're sorted by part number before being paged
+	var parts []*s2.Part
 	globPattern := path.Join(parentDirPath(bucket.Repo, bucket.Commit, key, uploadID), "*")
 	err = pc.GlobFileF(c.repo, "master", globPattern, func(fileInfo *pfsClient.FileInfo) error {
 		_, _, _, _, partNumber, err := multipartChunkArgs(fileInfo.File.Path)
@@ -343,59 +492,139 @@ func (c *controller) ListMultipartChunks(r *http.Request, bucketName, key, uploa
 			return nil
 		}
 
-		if len(result.Parts) >= maxParts {
-			if maxParts > 0 {
-				result.IsTruncated = true
-			}
-			return errutil.ErrBreak
-		}
-
-		result.Parts = append(result.Parts, &s2.Part{
+		parts = append(parts, &s2.Part{
 			PartNumber: partNumber,
-			ETag:       fmt.Sprintf("%x", fileInfo.Hash),
+			ETag:       fileETag(fileInfo),
 		})
 
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
 
-	return &result, err
+	if len(parts) > maxParts {
+		if maxParts > 0 {
+			result.IsTruncated = true
+		}
+		parts = parts[:maxParts]
+	}
+	result.Parts = append(result.Parts, parts...)
+
+	return &result, nil
 }
 
 func (c *controller) UploadMultipartChunk(r *http.Request, bucketName, key, uploadID string, partNumber int, reader io.Reader) (string, error) {
 	c.logger.Debugf("UploadMultipartChunk: bucketName=%+v, key=%+v, uploadID=%+v partNumber=%+v", bucketName, key, uploadID, partNumber)
 
-	pc, err := c.requestClient(r)
+	fileInfo, err := c.putChunk(r, bucketName, key, uploadID, partNumber, reader)
 	if err != nil {
 		return "", err
 	}
+	return fileETag(fileInfo), nil
+}
+
+// copyPartResult is the response body of an UploadPartCopy request
+type copyPartResult struct {
+	XMLName      xml.Name  `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CopyPartResult"`
+	LastModified time.Time `xml:"LastModified"`
+	ETag         string    `xml:"ETag"`
+}
+
+// UploadMultipartChunkCopy uploads a part of a multipart upload from an
+// existing object, named by the `x-amz-copy-source` header, rather than from
+// the request body. A byte range of the object can be selected with the
+// `x-amz-copy-source-range` header.
+func (c *controller) UploadMultipartChunkCopy(r *http.Request, bucketName, key, uploadID string, partNumber int) (*copyPartResult, error) {
+	c.logger.Debugf("UploadMultipartChunkCopy: bucketName=%+v, key=%+v, uploadID=%+v partNumber=%+v", bucketName, key, uploadID, partNumber)
+
+	srcBucketName, srcKey, srcVersion, err := copySource(r)
+	if err != nil {
+		return nil, err
+	}
+	srcObj, err := c.GetObject(r, srcBucketName, srcKey, srcVersion)
+	if err != nil {
+		return nil, err
+	}
+	size, err := srcObj.Content.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	offset, length := int64(0), size
+	if s := r.Header.Get("x-amz-copy-source-range"); s != "" {
+		var first, last int64
+		if _, err := fmt.Sscanf(s, "bytes=%d-%d", &first, &last); err != nil || first < 0 || first > last || last >= size {
+			return nil, s2.InvalidArgumentError(r)
+		}
+		offset, length = first, last-first+1
+	}
+	if _, err := srcObj.Content.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	fileInfo, err := c.putChunk(r, bucketName, key, uploadID, partNumber, io.LimitReader(srcObj.Content, length))
+	if err != nil {
+		return nil, err
+	}
+	lastModified, err := types.TimestampFromProto(fileInfo.Committed)
+	if err != nil {
+		return nil, err
+	}
+	return &copyPartResult{
+		LastModified: lastModified.UTC().Round(time.Second),
+		ETag:         addETagQuotes(fileETag(fileInfo)),
+	}, nil
+}
+
+// copySource parses the bucket, key and version of the object named by a
+// request's `x-amz-copy-source` header, which is of the form
+// `[/]bucket/key[?versionId=version]`
+func copySource(r *http.Request) (bucketName, key, version string, err error) {
+	srcURL, err := url.Parse(r.Header.Get("x-amz-copy-source"))
+	if err != nil {
+		return "", "", "", s2.InvalidArgumentError(r)
+	}
+	srcPath := strings.SplitN(strings.TrimPrefix(srcURL.Path, "/"), "/", 2)
+	if len(srcPath) != 2 || srcPath[0] == "" {
+		return "", "", "", s2.InvalidArgumentError(r)
+	}
+	if srcPath[1] == "" {
+		return "", "", "", s2.NoSuchKeyError(r)
+	}
+	return srcPath[0], srcPath[1], srcURL.Query().Get("versionId"), nil
+}
+
+// putChunk writes the content of a part of a multipart upload
+func (c *controller) putChunk(r *http.Request, bucketName, key, uploadID string, partNumber int, reader io.Reader) (*pfsClient.FileInfo, error) {
+	pc, err := c.requestClient(r)
+	if err != nil {
+		return nil, err
+	}
 
 	if err = c.ensureRepo(pc); err != nil {
-		return "", err
+		return nil, err
 	}
 
 	bucket, err := c.driver.bucket(pc, r, bucketName)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	_, err = pc.InspectFile(c.repo, "master", keepPath(bucket.Repo, bucket.Commit, key, uploadID))
 	if err != nil {
 		if pfsServer.IsFileNotFoundErr(err) {
-			return "", s2.NoSuchUploadError(r)
+			return nil, s2.NoSuchUploadError(r)
 		}
-		return "", err
+		return nil, err
 	}
 
 	path := chunkPath(bucket.Repo, bucket.Commit, key, uploadID, partNumber)
 	_, err = pc.PutFileOverwrite(c.repo, "master", path, reader, 0)
 	if err != nil {
-		return "", err
-	}
-
-	fileInfo, err := pc.InspectFile(c.repo, "master", path)
-	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return fmt.Sprintf("%x", fileInfo.Hash), nil
+	return pc.InspectFile(c.repo, "master", path)
 }
@@ -0,0 +1,94 @@
+package s3
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pachyderm/pachyderm/src/client"
+	"github.com/pachyderm/s2"
+)
+
+// notificationConfiguration is a bucket notification configuration. Its
+// content is stored as-is, since notifications aren't delivered.
+type notificationConfiguration struct {
+	XMLName xml.Name `xml:"NotificationConfiguration"`
+	Inner   []byte   `xml:",innerxml"`
+}
+
+// emptyNotificationConfiguration is the configuration of buckets that
+// haven't had one set
+var emptyNotificationConfiguration = notificationConfiguration{
+	XMLName: xml.Name{Space: "http://s3.amazonaws.com/doc/2006-03-01/", Local: "NotificationConfiguration"},
+}
+
+// GetBucketNotification returns the notification configuration of a bucket
+func (c *controller) GetBucketNotification(r *http.Request, bucketName string) (*notificationConfiguration, error) {
+	c.logger.Debugf("GetBucketNotification: %+v", bucketName)
+
+	pc, err := c.requestClient(r)
+	if err != nil {
+		return nil, err
+	}
+	bucket, err := c.existingBucket(pc, r, bucketName)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, ok, err := c.getMetadata(pc, notificationMetadata, bucket, "")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		// no configuration has been set
+		return &emptyNotificationConfiguration, nil
+	}
+	result := &notificationConfiguration{}
+	if err := xml.Unmarshal(encoded, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// PutBucketNotification sets the notification configuration of a bucket. The
+// configuration is stored so that it can be read back, but notifications
+// aren't sent.
+func (c *controller) PutBucketNotification(r *http.Request, bucketName string) error {
+	c.logger.Debugf("PutBucketNotification: %+v", bucketName)
+
+	pc, err := c.requestClient(r)
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	config := notificationConfiguration{}
+	if err := xml.Unmarshal(body, &config); err != nil {
+		return s2.MalformedXMLError(r)
+	}
+	bucket, err := c.existingBucket(pc, r, bucketName)
+	if err != nil {
+		return err
+	}
+
+	encoded, err := xml.Marshal(&config)
+	if err != nil {
+		return err
+	}
+	return c.setMetadata(pc, notificationMetadata, bucket, "", encoded)
+}
+
+// existingBucket returns the bucket called bucketName, or an error if its
+// branch doesn't exist
+func (c *controller) existingBucket(pc *client.APIClient, r *http.Request, bucketName string) (*Bucket, error) {
+	bucket, err := c.driver.bucket(pc, r, bucketName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pc.InspectBranch(bucket.Repo, bucket.Commit); err != nil {
+		return nil, maybeNotFoundError(r, err)
+	}
+	return bucket, nil
+}
@@ -1,12 +1,27 @@
 package s3
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/gogo/protobuf/types"
+	"github.com/gorilla/mux"
+	glob "github.com/pachyderm/ohmyglob"
+	"github.com/pachyderm/pachyderm/src/client"
+	"github.com/pachyderm/pachyderm/src/client/pfs"
+	"github.com/pachyderm/pachyderm/src/client/pkg/errors"
+	"github.com/pachyderm/pachyderm/src/client/pkg/grpcutil"
 	pfsServer "github.com/pachyderm/pachyderm/src/server/pfs"
 	"github.com/pachyderm/pachyderm/src/server/pkg/errutil"
 	"github.com/pachyderm/s2"
@@ -21,7 +36,9 @@ func (c *controller) GetObject(r *http.Request, bucketName, file, version string
 	}
 
 	if strings.HasSuffix(file, "/") {
-		return nil, invalidFilePathError(r)
+		// directories only appear in listings, as common prefixes, and
+		// there's never an object at their key
+		return nil, s2.NoSuchKeyError(r)
 	}
 
 	bucket, err := c.driver.bucket(pc, r, bucketName)
@@ -51,21 +68,31 @@ func (c *controller) GetObject(r *http.Request, bucketName, file, version string
 	if err != nil {
 		return nil, maybeNotFoundError(r, err)
 	}
+	if fileInfo.FileType != pfs.FileType_FILE {
+		return nil, s2.NoSuchKeyError(r)
+	}
 
 	modTime, err := types.TimestampFromProto(fileInfo.Committed)
 	if err != nil {
 		return nil, err
 	}
 
-	content, err := pc.GetFileReadSeeker(bucket.Repo, bucket.Commit, file)
-	if err != nil {
-		return nil, err
-	}
+	// read large files in parallel ranges, rather than over a single stream
+	size := int64(fileInfo.SizeBytes)
+	content := newParallelReader(r.Context(), size, func(ctx context.Context, offset, size int64, w io.Writer) error {
+		reader, err := pc.WithCtx(ctx).GetFileReader(bucket.Repo, bucket.Commit, file, offset, size)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, reader)
+		return grpcutil.ScrubGRPC(err)
+	})
+	content.limit = requestedRangeEnd(r, size)
 
 	result := s2.GetObjectResult{
 		ModTime:      modTime,
 		Content:      content,
-		ETag:         fmt.Sprintf("%x", fileInfo.Hash),
+		ETag:         fileETag(fileInfo),
 		Version:      bucket.Commit,
 		DeleteMarker: false,
 	}
@@ -84,6 +111,12 @@ func (c *controller) CopyObject(r *http.Request, srcBucketName, srcFile string,
 	if strings.HasSuffix(destFile, "/") {
 		return "", invalidFilePathError(r)
 	}
+	if err := checkStorageClass(r); err != nil {
+		return "", err
+	}
+	if err := checkACL(r); err != nil {
+		return "", err
+	}
 
 	srcBucket, err := c.driver.bucket(pc, r, srcBucketName)
 	if err != nil {
@@ -104,7 +137,28 @@ func (c *controller) CopyObject(r *http.Request, srcBucketName, srcFile string,
 		return "", s2.NotImplementedError(r)
 	}
 
-	if err = pc.CopyFile(srcBucket.Repo, srcBucket.Commit, srcFile, destBucket.Repo, destBucket.Commit, destFile, true); err != nil {
+	gzipped := false
+	if c.gzipContentEncoding {
+		if gzipped, err = c.isGzipped(pc, srcBucket, srcFile); err != nil {
+			return "", err
+		}
+	}
+
+	if err = c.withCommit(pc, r, destBucket, destBucketCaps, "CopyObject", destFile, func(commitID string) error {
+		if err := pc.CopyFile(srcBucket.Repo, srcBucket.Commit, srcFile, destBucket.Repo, commitID, destFile, true); err != nil {
+			return err
+		}
+		// compressed objects are flagged before their commit is finished, so
+		// that they're never served without the flag
+		if gzipped {
+			if err := c.setGzipped(pc, destBucket, destFile, true); err != nil {
+				return err
+			}
+		}
+		// copies are private, like the content of any write that doesn't
+		// set an ACL
+		return c.setObjectACL(pc, destBucket, destFile, "")
+	}); err != nil {
 		if errutil.IsWriteToOutputBranchError(err) {
 			return "", writeToOutputBranchError(r)
 		} else if errutil.IsNotADirectoryError(err) {
@@ -114,6 +168,11 @@ func (c *controller) CopyObject(r *http.Request, srcBucketName, srcFile string,
 		}
 		return "", err
 	}
+	if c.gzipContentEncoding && !gzipped {
+		if err := c.setGzipped(pc, destBucket, destFile, false); err != nil {
+			return "", err
+		}
+	}
 
 	fileInfo, err := pc.InspectFile(destBucket.Repo, destBucket.Commit, destFile)
 	if err != nil && !pfsServer.IsOutputCommitNotFinishedErr(err) {
@@ -127,6 +186,13 @@ func (c *controller) CopyObject(r *http.Request, srcBucketName, srcFile string,
 	return version, nil
 }
 
+// PutObject writes an object. Each write to a branch is made in its own
+// commit, whose parent is the head of the branch when the commit starts, so
+// when writes to the same key race, the one that started last wins, unless
+// the gateway was made with `WithLastFinishWins`, in which case the one that
+// finished last does. Writers that need to detect conflicts can make their
+// writes conditional with `If-Match` or `If-None-Match: *`, which are
+// checked against the content of the write's commit.
 func (c *controller) PutObject(r *http.Request, bucketName, file string, reader io.Reader) (*s2.PutObjectResult, error) {
 	c.logger.Debugf("PutObject: bucketName=%+v, file=%+v", bucketName, file)
 
@@ -138,11 +204,23 @@ func (c *controller) PutObject(r *http.Request, bucketName, file string, reader
 	if strings.HasSuffix(file, "/") {
 		return nil, invalidFilePathError(r)
 	}
+	if err := checkStorageClass(r); err != nil {
+		return nil, err
+	}
+	acl, err := c.requestedACL(r)
+	if err != nil {
+		return nil, err
+	}
 
 	bucket, err := c.driver.bucket(pc, r, bucketName)
 	if err != nil {
 		return nil, err
 	}
+	if c.autoCreateBranches && c.driver.canModifyBuckets() {
+		if err := c.ensureBranch(pc, r, bucket); err != nil {
+			return nil, err
+		}
+	}
 	bucketCaps, err := c.driver.bucketCapabilities(pc, r, bucket)
 	if err != nil {
 		return nil, err
@@ -151,8 +229,105 @@ func (c *controller) PutObject(r *http.Request, bucketName, file string, reader
 		return nil, s2.NotImplementedError(r)
 	}
 
-	_, err = pc.PutFileOverwrite(bucket.Repo, bucket.Commit, file, reader, 0)
+	// s2 only limits the size of bodies with a known length, so the limit is
+	// enforced here for chunked bodies as they're read
+	var limited *bodyLimitReader
+	if r.ContentLength < 0 {
+		limited = &bodyLimitReader{reader: reader, remaining: maxRequestBodyLength}
+		reader = limited
+	}
+	// likewise, s2 only checks the Content-MD5 of bodies with a known length,
+	// so chunked bodies are hashed here as they're read
+	var digest *bodyDigestReader
+	if expectedMD5 := r.Header.Get("Content-Md5"); r.ContentLength < 0 && expectedMD5 != "" {
+		expected, err := base64.StdEncoding.DecodeString(expectedMD5)
+		if err != nil || len(expected) != md5.Size {
+			return nil, s2.InvalidDigestError(r)
+		}
+		digest = &bodyDigestReader{reader: reader, hash: md5.New(), expected: expected}
+		reader = digest
+	}
+	// if the client goes away mid-upload, the write fails rather than
+	// storing a truncated object, and its commit is deleted
+	reader = &contextReader{ctx: r.Context(), reader: reader}
+
+	// conditional writes are checked against the commit they're made in, so
+	// they're never skipped
+	if c.skipUnchangedPuts && r.Header.Get("If-Match") == "" && r.Header.Get("If-None-Match") == "" {
+		fileInfo, incoming, cleanup, err := c.checkUnchanged(pc, r, bucket, file, reader)
+		if err != nil {
+			return nil, err
+		}
+		defer cleanup()
+		if fileInfo != nil {
+			if c.gzipContentEncoding {
+				if err := c.setGzipped(pc, bucket, file, gzipRequested(r)); err != nil {
+					return nil, err
+				}
+			}
+			if err := c.setObjectACL(pc, bucket, file, acl); err != nil {
+				return nil, err
+			}
+			return &s2.PutObjectResult{
+				ETag:    fileETag(fileInfo),
+				Version: fileInfo.File.Commit.ID,
+			}, nil
+		}
+		reader = incoming
+	}
+	// the body is received before the commit is started when the write's
+	// commit is only ordered once it's finished uploading, or when the write
+	// goes to an open commit, where a body that fails its digest check can't
+	// be dropped with the write's own commit
+	_, spooled := reader.(*os.File)
+	if !spooled && ((c.lastFinishWins && bucketCaps.commitPerWrite) || (digest != nil && !bucketCaps.commitPerWrite)) {
+		tmp, cleanup, err := c.spoolBody(reader)
+		if err != nil {
+			if limited != nil && limited.exceeded {
+				return nil, s2.EntityTooLargeError(r)
+			}
+			return nil, err
+		}
+		defer cleanup()
+		reader = tmp
+		if digest != nil && !digest.matches() {
+			return nil, s2.BadDigestError(r)
+		}
+	}
+
+	// compressed objects are flagged before their commit is finished, so
+	// that they're never served without the flag. A flag left behind by a
+	// failed write is harmless, as content is checked for the gzip header
+	// before it's treated as compressed.
+	gzipped := c.gzipContentEncoding && gzipRequested(r)
+	err = c.withCommit(pc, r, bucket, bucketCaps, "PutObject", file, func(commitID string) error {
+		if err := checkWritePreconditions(pc, r, bucket.Repo, commitID, file); err != nil {
+			return err
+		}
+		if _, err := pc.PutFileOverwrite(bucket.Repo, commitID, file, reader, 0); err != nil {
+			return err
+		}
+		// failing here deletes the write's commit rather than finishing it
+		if digest != nil && !digest.matches() {
+			return s2.BadDigestError(r)
+		}
+		if gzipped {
+			if err := c.setGzipped(pc, bucket, file, true); err != nil {
+				return err
+			}
+		}
+		// new content is never public unless it's made so once it's
+		// written, so a public ACL is only set after the write succeeds,
+		// and an old one is cleared before
+		if acl == "" {
+			return c.setObjectACL(pc, bucket, file, "")
+		}
+		return nil
+	})
 	if err != nil {
+		if limited != nil && limited.exceeded {
+			return nil, s2.EntityTooLargeError(r)
+		}
 		if errutil.IsWriteToOutputBranchError(err) {
 			return nil, writeToOutputBranchError(r)
 		} else if errutil.IsNotADirectoryError(err) {
@@ -162,6 +337,16 @@ func (c *controller) PutObject(r *http.Request, bucketName, file string, reader
 		}
 		return nil, err
 	}
+	if c.gzipContentEncoding && !gzipped {
+		if err := c.setGzipped(pc, bucket, file, false); err != nil {
+			return nil, err
+		}
+	}
+	if acl != "" {
+		if err := c.setObjectACL(pc, bucket, file, acl); err != nil {
+			return nil, err
+		}
+	}
 
 	fileInfo, err := pc.InspectFile(bucket.Repo, bucket.Commit, file)
 	if err != nil && !pfsServer.IsOutputCommitNotFinishedErr(err) {
@@ -170,16 +355,204 @@ func (c *controller) PutObject(r *http.Request, bucketName, file string, reader
 
 	result := s2.PutObjectResult{}
 	if fileInfo != nil {
-		result.ETag = fmt.Sprintf("%x", fileInfo.Hash)
+		result.ETag = fileETag(fileInfo)
 		result.Version = fileInfo.File.Commit.ID
 	}
 
 	return &result, nil
 }
 
+// ensureBranch creates the branch of a bucket if its repo exists but the
+// branch doesn't. The branch is created without a head; the write that
+// follows makes its first commit.
+func (c *controller) ensureBranch(pc *client.APIClient, r *http.Request, bucket *Bucket) error {
+	_, err := pc.InspectBranch(bucket.Repo, bucket.Commit)
+	if err == nil || !pfsServer.IsBranchNotFoundErr(err) {
+		// other errors are left for bucketCapabilities to report
+		return nil
+	}
+	if err := pc.CreateBranch(bucket.Repo, bucket.Commit, "", nil); err != nil {
+		if pfsServer.IsRepoNotFoundErr(err) {
+			return s2.NoSuchBucketError(r)
+		}
+		return err
+	}
+	return nil
+}
+
+// checkWritePreconditions returns an error if the `If-Match`,
+// `If-None-Match` or `If-Unmodified-Since` headers of a write or delete don't
+// hold for the existing object in commitID. `If-Unmodified-Since` always
+// holds for objects that don't exist, and is ignored if it isn't a valid
+// date.
+func checkWritePreconditions(pc *client.APIClient, r *http.Request, repo, commitID, file string) error {
+	ifMatch := r.Header.Get("If-Match")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	ifUnmodifiedSince := r.Header.Get("If-Unmodified-Since")
+	if ifMatch == "" && ifNoneMatch == "" && ifUnmodifiedSince == "" {
+		return nil
+	}
+	fileInfo, err := pc.InspectFile(repo, commitID, file)
+	if err != nil && !pfsServer.IsFileNotFoundErr(err) {
+		return err
+	}
+	if ifNoneMatch != "" && fileInfo != nil && matchesETag(ifNoneMatch, fileETag(fileInfo)) {
+		return s2.PreconditionFailedError(r)
+	}
+	if since, err := http.ParseTime(ifUnmodifiedSince); err == nil && fileInfo != nil {
+		modTime, err := types.TimestampFromProto(fileInfo.Committed)
+		if err != nil {
+			return err
+		}
+		// dates in headers have a resolution of a second
+		if modTime.Truncate(time.Second).After(since) {
+			return s2.PreconditionFailedError(r)
+		}
+	}
+	if ifMatch != "" {
+		if fileInfo == nil {
+			return s2.NoSuchKeyError(r)
+		}
+		if !matchesETag(ifMatch, fileETag(fileInfo)) {
+			return s2.PreconditionFailedError(r)
+		}
+	}
+	return nil
+}
+
+// matchesETag returns whether a comma-separated list of ETags from a
+// conditional header includes etag, or is `*`
+func matchesETag(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.Trim(strings.TrimPrefix(strings.TrimSpace(candidate), "W/"), "\"")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// bodyLimitReader reads a request body of unknown length, failing once more
+// than remaining bytes have been read
+type bodyLimitReader struct {
+	reader    io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+func (l *bodyLimitReader) Read(p []byte) (int, error) {
+	n, err := l.reader.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		l.exceeded = true
+		return n, errors.Errorf("request body is larger than %d bytes", maxRequestBodyLength)
+	}
+	return n, err
+}
+
+// bodyDigestReader hashes a request body as it's read, so that it can be
+// checked against the body's Content-MD5 once it's been read in full
+type bodyDigestReader struct {
+	reader   io.Reader
+	hash     hash.Hash
+	expected []byte
+}
+
+func (d *bodyDigestReader) Read(p []byte) (int, error) {
+	n, err := d.reader.Read(p)
+	d.hash.Write(p[:n])
+	return n, err
+}
+
+// matches returns whether the body read so far matches its Content-MD5
+func (d *bodyDigestReader) matches() bool {
+	return bytes.Equal(d.hash.Sum(nil), d.expected)
+}
+
+// contextReader reads a request body until the request's context is done
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
+
+// checkUnchanged compares the incoming content of an object with the content
+// of the existing object. If they're the same, the existing file is returned.
+// Otherwise, a reader of the incoming content is returned to be written in its
+// place, along with a function that releases the resources it holds.
+func (c *controller) checkUnchanged(pc *client.APIClient, r *http.Request, bucket *Bucket, file string, reader io.Reader) (*pfs.FileInfo, io.Reader, func(), error) {
+	noop := func() {}
+
+	fileInfo, err := pc.InspectFile(bucket.Repo, bucket.Commit, file)
+	if err != nil || r.ContentLength < 0 || fileInfo.SizeBytes != uint64(r.ContentLength) {
+		// the object is missing or has a different size, so the write can't
+		// be skipped
+		return nil, reader, noop, nil
+	}
+
+	existing := md5.New()
+	if err := pc.GetFile(bucket.Repo, bucket.Commit, file, 0, 0, existing); err != nil {
+		return nil, nil, noop, err
+	}
+
+	incoming := md5.New()
+	tmp, cleanup, err := c.spoolBody(io.TeeReader(reader, incoming))
+	if err != nil {
+		return nil, nil, noop, err
+	}
+
+	if bytes.Equal(existing.Sum(nil), incoming.Sum(nil)) {
+		cleanup()
+		return fileInfo, nil, noop, nil
+	}
+	return nil, tmp, cleanup, nil
+}
+
+// spoolBody copies the rest of a request body to a temporary file, and
+// returns the file, rewound, along with a function that removes it
+func (c *controller) spoolBody(reader io.Reader) (*os.File, func(), error) {
+	tmp, err := ioutil.TempFile("", "pachyderm-s3gateway-put-")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		if err := tmp.Close(); err != nil {
+			c.logger.Errorf("could not close temporary file %s: %v", tmp.Name(), err)
+		}
+		if err := os.Remove(tmp.Name()); err != nil {
+			c.logger.Errorf("could not remove temporary file %s: %v", tmp.Name(), err)
+		}
+	}
+	if _, err := io.Copy(tmp, reader); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return tmp, cleanup, nil
+}
+
 func (c *controller) DeleteObject(r *http.Request, bucketName, file, version string) (*s2.DeleteObjectResult, error) {
 	c.logger.Debugf("DeleteObject: bucketName=%+v, file=%+v, version=%+v", bucketName, file, version)
 
+	if mux.Vars(r)["key"] == "" {
+		// keys of multi-object deletes come from the request body, so they
+		// haven't been folded by routeMiddleware, and the request has only
+		// been authorized as a whole
+		file = c.foldKey(r, bucketName, file)
+		if err := c.authorizeKey(r, "DeleteObject", bucketName, file); err != nil {
+			return nil, err
+		}
+	}
+
 	pc, err := c.requestClient(r)
 	if err != nil {
 		return nil, err
@@ -188,9 +561,6 @@ func (c *controller) DeleteObject(r *http.Request, bucketName, file, version str
 	if strings.HasSuffix(file, "/") {
 		return nil, invalidFilePathError(r)
 	}
-	if version != "" {
-		return nil, s2.NotImplementedError(r)
-	}
 
 	bucket, err := c.driver.bucket(pc, r, bucketName)
 	if err != nil {
@@ -203,18 +573,230 @@ func (c *controller) DeleteObject(r *http.Request, bucketName, file, version str
 	if !bucketCaps.writable {
 		return nil, s2.NotImplementedError(r)
 	}
+	if version != "" {
+		if !bucketCaps.historicVersions {
+			return nil, s2.NotImplementedError(r)
+		}
+		return c.deleteObjectVersion(pc, r, bucket, file, version)
+	}
 
-	if err = pc.DeleteFile(bucket.Repo, bucket.Commit, file); err != nil {
+	if err = c.withCommit(pc, r, bucket, bucketCaps, "DeleteObject", file, func(commitID string) error {
+		if err := checkWritePreconditions(pc, r, bucket.Repo, commitID, file); err != nil {
+			return err
+		}
+		return pc.DeleteFile(bucket.Repo, commitID, file)
+	}); err != nil {
+		if s2Err, ok := err.(*s2.Error); ok {
+			// a precondition failed
+			return nil, s2Err
+		}
 		if errutil.IsWriteToOutputBranchError(err) {
 			return nil, writeToOutputBranchError(r)
 		}
 		return nil, maybeNotFoundError(r, err)
 	}
+	if c.gzipContentEncoding {
+		if err := c.setGzipped(pc, bucket, file, false); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.setObjectACL(pc, bucket, file, ""); err != nil {
+		return nil, err
+	}
 
 	result := s2.DeleteObjectResult{
 		Version:      "",
 		DeleteMarker: false,
 	}
+	if bucketCaps.historicVersions {
+		// the commit that deleted the file acts as a delete marker: reads
+		// of the object fail, but its earlier versions remain readable
+		branchInfo, err := pc.InspectBranch(bucket.Repo, bucket.Commit)
+		if err != nil {
+			return nil, maybeNotFoundError(r, err)
+		}
+		if branchInfo.Head != nil {
+			result.Version = branchInfo.Head.ID
+			result.DeleteMarker = true
+		}
+	}
 
 	return &result, nil
 }
+
+// deleteObjectVersion permanently deletes a version of an object, by
+// deleting the commit that wrote it. PFS can't remove a commit from the
+// middle of a branch's history, so only the latest version can be deleted,
+// and only if its commit changed nothing else.
+func (c *controller) deleteObjectVersion(pc *client.APIClient, r *http.Request, bucket *Bucket, file, version string) (*s2.DeleteObjectResult, error) {
+	commitInfo, err := pc.InspectCommit(bucket.Repo, version)
+	if err != nil {
+		if pfsServer.IsCommitNotFoundErr(err) {
+			return nil, s2.NoSuchVersionError(r)
+		}
+		return nil, maybeNotFoundError(r, err)
+	}
+	if commitInfo.Branch.Name != bucket.Commit {
+		return nil, s2.NoSuchVersionError(r)
+	}
+
+	newFiles, oldFiles, err := pc.DiffFile(bucket.Repo, commitInfo.Commit.ID, "", "", "", "", false)
+	if err != nil {
+		return nil, err
+	}
+	changed := false
+	for _, fileInfo := range append(newFiles, oldFiles...) {
+		if fileInfo.FileType != pfs.FileType_FILE {
+			continue
+		}
+		if strings.TrimPrefix(fileInfo.File.Path, "/") != file {
+			return nil, s2.NotImplementedError(r)
+		}
+		changed = true
+	}
+	if !changed {
+		// the commit isn't a version of this object
+		return nil, s2.NoSuchVersionError(r)
+	}
+
+	branchInfo, err := pc.InspectBranch(bucket.Repo, bucket.Commit)
+	if err != nil {
+		return nil, maybeNotFoundError(r, err)
+	}
+	if branchInfo.Head == nil || branchInfo.Head.ID != commitInfo.Commit.ID {
+		return nil, s2.NotImplementedError(r)
+	}
+
+	if err := pc.DeleteCommit(bucket.Repo, commitInfo.Commit.ID); err != nil {
+		if errutil.IsWriteToOutputBranchError(err) {
+			return nil, writeToOutputBranchError(r)
+		}
+		return nil, err
+	}
+
+	// the version is a delete marker if it deleted the object, rather than
+	// writing it
+	result := s2.DeleteObjectResult{
+		Version:      commitInfo.Commit.ID,
+		DeleteMarker: len(newFiles) == 0,
+	}
+	return &result, nil
+}
+
+// StatDirectory handles HEAD requests for keys with a trailing slash, which
+// some clients use to check whether a directory exists. It returns the time
+// the directory was last modified if it contains any files, and NoSuchKey
+// otherwise. Directories still aren't objects, so GET requests for these
+// keys fail.
+func (c *controller) StatDirectory(r *http.Request, bucketName, key string) (time.Time, error) {
+	c.logger.Debugf("StatDirectory: bucketName=%+v, key=%+v", bucketName, key)
+
+	pc, err := c.requestClient(r)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	bucket, err := c.driver.bucket(pc, r, bucketName)
+	if err != nil {
+		return time.Time{}, err
+	}
+	bucketCaps, err := c.driver.bucketCapabilities(pc, r, bucket)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !bucketCaps.readable {
+		return time.Time{}, s2.NoSuchKeyError(r)
+	}
+
+	dir := strings.TrimSuffix(key, "/")
+	fileInfo, err := pc.InspectFile(bucket.Repo, bucket.Commit, dir)
+	if err != nil {
+		return time.Time{}, maybeNotFoundError(r, err)
+	}
+	if fileInfo.FileType != pfs.FileType_DIR {
+		return time.Time{}, s2.NoSuchKeyError(r)
+	}
+
+	populated := false
+	if err := pc.GlobFileF(bucket.Repo, bucket.Commit, fmt.Sprintf("%s/**", glob.QuoteMeta(dir)), func(fileInfo *pfs.FileInfo) error {
+		if fileInfo.FileType == pfs.FileType_FILE {
+			populated = true
+			return errutil.ErrBreak
+		}
+		return nil
+	}); err != nil {
+		return time.Time{}, err
+	}
+	if !populated {
+		return time.Time{}, s2.NoSuchKeyError(r)
+	}
+
+	modTime, err := types.TimestampFromProto(fileInfo.Committed)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return modTime, nil
+}
+
+// RestoreObject handles restore requests for archived objects. PFS content
+// is never archived (it's always reported with the `STANDARD` storage
+// class), so this only verifies that the object exists.
+func (c *controller) RestoreObject(r *http.Request, bucketName, file string) error {
+	c.logger.Debugf("RestoreObject: bucketName=%+v, file=%+v", bucketName, file)
+
+	pc, err := c.requestClient(r)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(file, "/") {
+		return invalidFilePathError(r)
+	}
+
+	bucket, err := c.driver.bucket(pc, r, bucketName)
+	if err != nil {
+		return err
+	}
+	bucketCaps, err := c.driver.bucketCapabilities(pc, r, bucket)
+	if err != nil {
+		return err
+	}
+	if !bucketCaps.readable {
+		return s2.NoSuchKeyError(r)
+	}
+
+	if _, err := pc.InspectFile(bucket.Repo, bucket.Commit, file); err != nil {
+		return maybeNotFoundError(r, err)
+	}
+	return nil
+}
+
+// checkDeleteObjects returns an error if a multi-object delete request asks
+// to delete more than maxDeleteObjects objects. Bodies that can't be parsed
+// are left for s2 to reject.
+func checkDeleteObjects(r *http.Request) error {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	payload := struct {
+		Objects []struct{} `xml:"Object"`
+	}{}
+	if err := xml.Unmarshal(body, &payload); err != nil {
+		return nil
+	}
+	if len(payload.Objects) > maxDeleteObjects {
+		return s2.MalformedXMLError(r)
+	}
+	return nil
+}
+
+// checkStorageClass returns an error if a request asks for a storage class
+// that S3 doesn't have
+func checkStorageClass(r *http.Request) error {
+	if storageClass := r.Header.Get("x-amz-storage-class"); storageClass != "" && !storageClasses[storageClass] {
+		return invalidStorageClassError(r)
+	}
+	return nil
+}
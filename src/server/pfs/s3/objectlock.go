@@ -0,0 +1,67 @@
+package s3
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strconv"
+
+	"github.com/pachyderm/pachyderm/src/client"
+	"github.com/pachyderm/s2"
+)
+
+// objectLockConfiguration is the response body of a GetObjectLockConfiguration
+// request
+type objectLockConfiguration struct {
+	XMLName           xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ObjectLockConfiguration"`
+	ObjectLockEnabled string   `xml:"ObjectLockEnabled"`
+}
+
+// objectLockRequested returns whether a CreateBucket request asks for object
+// lock to be enabled on the new bucket
+func objectLockRequested(r *http.Request) (bool, error) {
+	s := r.Header.Get("x-amz-bucket-object-lock-enabled")
+	if s == "" {
+		return false, nil
+	}
+	enabled, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, s2.InvalidArgumentError(r)
+	}
+	return enabled, nil
+}
+
+// setObjectLock records whether a bucket has object lock enabled. The flag is
+// advisory: PFS never overwrites committed content, so every bucket already
+// retains each version of its objects.
+func (c *controller) setObjectLock(pc *client.APIClient, bucket *Bucket, enabled bool) error {
+	if !enabled {
+		return c.clearMetadata(pc, objectLockMetadata, bucket, "")
+	}
+	return c.setMetadata(pc, objectLockMetadata, bucket, "", nil)
+}
+
+// GetObjectLockConfiguration returns the object lock configuration of a
+// bucket, which only reports whether object lock was enabled when the bucket
+// was created. Retention rules aren't supported.
+func (c *controller) GetObjectLockConfiguration(r *http.Request, bucketName string) (*objectLockConfiguration, error) {
+	c.logger.Debugf("GetObjectLockConfiguration: %+v", bucketName)
+
+	pc, err := c.requestClient(r)
+	if err != nil {
+		return nil, err
+	}
+
+	bucket, err := c.existingBucket(pc, r, bucketName)
+	if err != nil {
+		return nil, err
+	}
+
+	_, enabled, err := c.getMetadata(pc, objectLockMetadata, bucket, "")
+	if err != nil {
+		return nil, err
+	}
+	if !enabled {
+		return nil, objectLockConfigurationNotFoundError(r)
+	}
+	return &objectLockConfiguration{ObjectLockEnabled: "Enabled"}, nil
+}
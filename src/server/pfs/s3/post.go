@@ -0,0 +1,137 @@
+package s3
+
+import (
+	"encoding/xml"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pachyderm/pachyderm/src/client/pkg/errors"
+	"github.com/pachyderm/s2"
+)
+
+// postResponse is the response body of a PostObject request that asks for a
+// 201 status
+type postResponse struct {
+	XMLName  xml.Name `xml:"PostResponse"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+// isPostObjectRequest returns whether a request is a browser form upload,
+// which is a `POST` of a multipart form to a bucket
+func isPostObjectRequest(r *http.Request) bool {
+	vars := mux.Vars(r)
+	if r.Method != http.MethodPost || vars["bucket"] == "" || vars["key"] != "" {
+		return false
+	}
+	if _, ok := r.URL.Query()["delete"]; ok {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// servePostObject serves a browser form upload. The form's fields are read
+// until the `file` field, whose content is written to the object named by
+// the `key` field, as PutObject would. Any fields after `file` are ignored,
+// as in S3. Upload policies aren't checked.
+func (c *controller) servePostObject(w http.ResponseWriter, r *http.Request) {
+	bucketName := mux.Vars(r)["bucket"]
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		s2.WriteError(c.logger, w, r, malformedPOSTRequestError(r))
+		return
+	}
+	fields := make(map[string]string)
+	var result *s2.PutObjectResult
+	var key string
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			s2.WriteError(c.logger, w, r, malformedPOSTRequestError(r))
+			return
+		}
+		name := strings.ToLower(part.FormName())
+		if name != "file" {
+			value := new(strings.Builder)
+			if _, err := io.Copy(value, part); err != nil {
+				s2.WriteError(c.logger, w, r, malformedPOSTRequestError(r))
+				return
+			}
+			fields[name] = value.String()
+			continue
+		}
+
+		key = c.foldKey(r, bucketName, strings.Replace(fields["key"], "${filename}", part.FileName(), -1))
+		if key == "" {
+			s2.WriteError(c.logger, w, r, s2.InvalidArgumentError(r))
+			return
+		}
+		// the request has only been authorized as a whole, since its key is
+		// in its body
+		if err := c.authorizeKey(r, "PutObject", bucketName, key); err != nil {
+			s2.WriteError(c.logger, w, r, err)
+			return
+		}
+		c.logger.Debugf("PostObject: bucketName=%+v, key=%+v", bucketName, key)
+		if result, err = c.PutObject(r, bucketName, key, part); err != nil {
+			s2.WriteError(c.logger, w, r, err)
+			return
+		}
+		break
+	}
+	if result == nil {
+		// the form has no file
+		s2.WriteError(c.logger, w, r, s2.InvalidArgumentError(r))
+		return
+	}
+
+	etag := addETagQuotes(result.ETag)
+	if result.ETag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if result.Version != "" {
+		w.Header().Set("x-amz-version-id", result.Version)
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	location := c.objectURL(r, scheme, bucketName, key)
+	w.Header().Set("Location", location)
+
+	if redirect := fields["success_action_redirect"]; redirect != "" {
+		if u, err := url.Parse(redirect); err == nil {
+			query := u.Query()
+			query.Set("bucket", bucketName)
+			query.Set("key", key)
+			query.Set("etag", etag)
+			u.RawQuery = query.Encode()
+			http.Redirect(w, r, u.String(), http.StatusSeeOther)
+			return
+		}
+	}
+	switch fields["success_action_status"] {
+	case "200":
+		w.WriteHeader(http.StatusOK)
+	case "201":
+		writeXML(c.logger, w, r, http.StatusCreated, &postResponse{
+			Location: location,
+			Bucket:   bucketName,
+			Key:      key,
+			ETag:     etag,
+		})
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
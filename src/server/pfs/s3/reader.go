@@ -0,0 +1,235 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pachyderm/pachyderm/src/client/pkg/errors"
+)
+
+const (
+	// readChunkSize is the size of each of the ranges that a parallel reader
+	// requests from PFS
+	readChunkSize = 8 * 1024 * 1024
+
+	// readParallelism is the maximum number of ranges that a parallel reader
+	// fetches from PFS at once
+	readParallelism = 4
+
+	// streamedChunks is the number of chunks below which a read is streamed
+	// from PFS in one request rather than fetched in parallel ranges, which
+	// would only buffer data ahead of the client for little gain
+	streamedChunks = 2
+)
+
+// fetchFunc writes `size` bytes of a file, starting at `offset`, to `w`
+type fetchFunc func(ctx context.Context, offset, size int64, w io.Writer) error
+
+// chunkResult is the outcome of fetching a single chunk
+type chunkResult struct {
+	data []byte
+	size int64
+	err  error
+}
+
+// parallelReader is an `io.ReadSeeker` over a file of a known size, which
+// fetches upcoming chunks of the file concurrently and yields them in order.
+// Fetching starts on the first read after construction or a seek, so the
+// seeks that `http.ServeContent` makes to find the file's size and the start
+// of a requested range don't waste any fetches. Reads of fewer than
+// streamedChunks chunks are streamed instead, and nothing past limit, if it's
+// set, is fetched until it's read, so that range requests only fetch the
+// range.
+type parallelReader struct {
+	ctx         context.Context
+	fetch       fetchFunc
+	size        int64
+	offset      int64
+	chunkSize   int64
+	parallelism int
+	// limit, if it's non-zero, is where reads are expected to stop, e.g.
+	// the end of a requested range
+	limit int64
+
+	// end is where the current fetches stop
+	end int64
+	// chunks is the queue of in-flight chunk fetches, in file order
+	chunks chan chan chunkResult
+	// stream is the content of a streamed read, if the current fetch is one
+	stream  io.ReadCloser
+	cancel  context.CancelFunc
+	current []byte
+}
+
+func newParallelReader(ctx context.Context, size int64, fetch fetchFunc) *parallelReader {
+	return &parallelReader{
+		ctx:         ctx,
+		fetch:       fetch,
+		size:        size,
+		chunkSize:   readChunkSize,
+		parallelism: readParallelism,
+	}
+}
+
+// requestedRangeEnd returns the end of the single, bounded byte range that
+// `r` requests from a file of `size` bytes, or 0 if it requests anything else
+func requestedRangeEnd(r *http.Request, size int64) int64 {
+	spec := r.Header.Get("Range")
+	if !strings.HasPrefix(spec, "bytes=") || strings.Contains(spec, ",") {
+		return 0
+	}
+	parts := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(spec, "bytes=")), "-", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		// suffix ranges are already served from the end of the file
+		return 0
+	}
+	start, err := strconv.ParseInt(strings.TrimSpace(parts[0]), 10, 64)
+	if err != nil {
+		return 0
+	}
+	last, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+	if err != nil || last < start || last+1 >= size {
+		return 0
+	}
+	return last + 1
+}
+
+func (p *parallelReader) Read(b []byte) (int, error) {
+	if p.offset >= p.size {
+		return 0, io.EOF
+	}
+	if p.offset >= p.end {
+		// nothing is being fetched from here yet
+		p.stop()
+		p.start()
+	}
+	if p.stream != nil {
+		n, err := p.stream.Read(b)
+		p.offset += int64(n)
+		if errors.Is(err, io.EOF) {
+			if p.offset < p.end {
+				err = io.ErrUnexpectedEOF
+			} else {
+				err = nil
+			}
+		}
+		if err != nil {
+			p.stop()
+		}
+		return n, err
+	}
+	if len(p.current) == 0 {
+		var result chunkResult
+		select {
+		case resultChan := <-p.chunks:
+			result = <-resultChan
+		case <-p.ctx.Done():
+			return 0, p.ctx.Err()
+		}
+		if result.err != nil {
+			p.stop()
+			return 0, result.err
+		}
+		if int64(len(result.data)) != result.size {
+			// the chunks are fetched at fixed offsets, so a short chunk
+			// can't be made up for by the following ones
+			p.stop()
+			return 0, io.ErrUnexpectedEOF
+		}
+		p.current = result.data
+	}
+	n := copy(b, p.current)
+	p.current = p.current[n:]
+	p.offset += int64(n)
+	return n, nil
+}
+
+func (p *parallelReader) Seek(offset int64, whence int) (int64, error) {
+	var newOffset int64
+	switch whence {
+	case io.SeekStart:
+		newOffset = offset
+	case io.SeekCurrent:
+		newOffset = p.offset + offset
+	case io.SeekEnd:
+		newOffset = p.size + offset
+	default:
+		return p.offset, errors.Errorf("invalid whence: %d", whence)
+	}
+	if newOffset < 0 {
+		return p.offset, errors.Errorf("negative offset: %d", newOffset)
+	}
+	if newOffset != p.offset {
+		p.stop()
+		p.offset = newOffset
+	}
+	return p.offset, nil
+}
+
+// start begins fetching from the current offset to the limit, if it's
+// ahead, or else to the end of the file
+func (p *parallelReader) start() {
+	ctx, cancel := context.WithCancel(p.ctx)
+	p.cancel = cancel
+	start, end, chunkSize, fetch := p.offset, p.size, p.chunkSize, p.fetch
+	if p.limit > start && p.limit < end {
+		end = p.limit
+	}
+	p.end = end
+	if end-start < streamedChunks*chunkSize {
+		r, w := io.Pipe()
+		p.stream = r
+		go func() {
+			w.CloseWithError(fetch(ctx, start, end-start, w))
+		}()
+		return
+	}
+	// the queue's capacity, plus the chunk that's currently being waited on,
+	// bounds the number of concurrent fetches
+	chunks := make(chan chan chunkResult, p.parallelism-1)
+	p.chunks = chunks
+	go func() {
+		for offset := start; offset < end; offset += chunkSize {
+			size := chunkSize
+			if offset+size > end {
+				size = end - offset
+			}
+			resultChan := make(chan chunkResult, 1)
+			select {
+			case chunks <- resultChan:
+			case <-ctx.Done():
+				return
+			}
+			go func(offset, size int64) {
+				buf := bytes.NewBuffer(make([]byte, 0, size))
+				err := fetch(ctx, offset, size, buf)
+				resultChan <- chunkResult{data: buf.Bytes(), size: size, err: err}
+			}(offset, size)
+		}
+	}()
+}
+
+// stop cancels any in-flight fetches and discards buffered data
+func (p *parallelReader) stop() {
+	if p.cancel != nil {
+		p.cancel()
+	}
+	if p.stream != nil {
+		p.stream.Close()
+	}
+	p.chunks = nil
+	p.stream = nil
+	p.cancel = nil
+	p.current = nil
+	p.end = 0
+}
+
+// Close cancels any in-flight fetches
+func (p *parallelReader) Close() error {
+	p.stop()
+	return nil
+}
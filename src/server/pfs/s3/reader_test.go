@@ -0,0 +1,180 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pachyderm/pachyderm/src/client/pkg/errors"
+	"github.com/pachyderm/pachyderm/src/client/pkg/require"
+)
+
+// testFetch serves ranges of data, optionally sleeping to simulate latency,
+// and records the maximum number of concurrent fetches
+func testFetch(data []byte, latency time.Duration, maxConcurrent *int64) fetchFunc {
+	var concurrent int64
+	return func(ctx context.Context, offset, size int64, w io.Writer) error {
+		n := atomic.AddInt64(&concurrent, 1)
+		defer atomic.AddInt64(&concurrent, -1)
+		for {
+			max := atomic.LoadInt64(maxConcurrent)
+			if n <= max || atomic.CompareAndSwapInt64(maxConcurrent, max, n) {
+				break
+			}
+		}
+		select {
+		case <-time.After(latency):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		_, err := w.Write(data[offset : offset+size])
+		return err
+	}
+}
+
+func TestParallelReader(t *testing.T) {
+	data := make([]byte, 1000)
+	rand.Read(data)
+	var maxConcurrent int64
+	p := newParallelReader(context.Background(), int64(len(data)), testFetch(data, time.Millisecond, &maxConcurrent))
+	p.chunkSize = 64
+	defer p.Close()
+
+	result, err := ioutil.ReadAll(p)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, result))
+	require.True(t, maxConcurrent <= int64(p.parallelism))
+
+	// seeking should restart reads from the new offset, as a range request
+	// would
+	offset, err := p.Seek(-300, io.SeekEnd)
+	require.NoError(t, err)
+	require.Equal(t, int64(700), offset)
+	result = make([]byte, 100)
+	_, err = io.ReadFull(p, result)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data[700:800], result))
+	offset, err = p.Seek(50, io.SeekCurrent)
+	require.NoError(t, err)
+	result, err = ioutil.ReadAll(p)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data[offset:], result))
+}
+
+func TestParallelReaderError(t *testing.T) {
+	p := newParallelReader(context.Background(), 1000, func(ctx context.Context, offset, size int64, w io.Writer) error {
+		if offset > 0 {
+			return errors.Errorf("fetch failed")
+		}
+		_, err := w.Write(make([]byte, size))
+		return err
+	})
+	p.chunkSize = 64
+	defer p.Close()
+
+	_, err := ioutil.ReadAll(p)
+	require.YesError(t, err)
+}
+
+func TestParallelReaderRange(t *testing.T) {
+	data := make([]byte, 1000)
+	rand.Read(data)
+	var mu sync.Mutex
+	var fetches [][2]int64
+	var maxConcurrent int64
+	fetch := testFetch(data, 0, &maxConcurrent)
+	recordingFetch := func(ctx context.Context, offset, size int64, w io.Writer) error {
+		mu.Lock()
+		fetches = append(fetches, [2]int64{offset, size})
+		mu.Unlock()
+		return fetch(ctx, offset, size, w)
+	}
+	p := newParallelReader(context.Background(), int64(len(data)), recordingFetch)
+	p.chunkSize = 64
+	p.limit = 300
+	defer p.Close()
+
+	// a range shorter than a couple of chunks should be fetched in one
+	// request, and nothing past it should be fetched
+	_, err := p.Seek(200, io.SeekStart)
+	require.NoError(t, err)
+	result := make([]byte, 100)
+	_, err = io.ReadFull(p, result)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data[200:300], result))
+	mu.Lock()
+	require.Equal(t, [][2]int64{{200, 100}}, fetches)
+	mu.Unlock()
+
+	// reading on past the limit should still work
+	result, err = ioutil.ReadAll(p)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data[300:], result))
+
+	// small files should be streamed whole
+	p.Close()
+	mu.Lock()
+	fetches = nil
+	mu.Unlock()
+	small := newParallelReader(context.Background(), 100, recordingFetch)
+	small.chunkSize = 64
+	defer small.Close()
+	result, err = ioutil.ReadAll(small)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data[:100], result))
+	mu.Lock()
+	require.Equal(t, [][2]int64{{0, 100}}, fetches)
+	mu.Unlock()
+}
+
+func TestRequestedRangeEnd(t *testing.T) {
+	for spec, end := range map[string]int64{
+		"":              0,
+		"bytes=0-99":    100,
+		"bytes=100-":    0,
+		"bytes=-100":    0,
+		"bytes=0-9,20-": 0,
+		"bytes=0-999":   0,
+		"bytes=50-10":   0,
+		"items=0-99":    0,
+	} {
+		r, err := http.NewRequest("GET", "/", nil)
+		require.NoError(t, err)
+		if spec != "" {
+			r.Header.Set("Range", spec)
+		}
+		require.Equal(t, end, requestedRangeEnd(r, 1000), spec)
+	}
+}
+
+func BenchmarkParallelReader(b *testing.B) {
+	data := make([]byte, 100*1024*1024)
+	for _, bench := range []struct {
+		name        string
+		parallelism int
+	}{
+		{"Sequential", 1},
+		{"Parallel", readParallelism},
+	} {
+		parallelism := bench.parallelism
+		b.Run(bench.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				var maxConcurrent int64
+				p := newParallelReader(context.Background(), int64(len(data)), testFetch(data, 10*time.Millisecond, &maxConcurrent))
+				p.parallelism = parallelism
+				if _, err := io.Copy(ioutil.Discard, p); err != nil {
+					b.Fatal(err)
+				}
+				p.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,374 @@
+package s3
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pachyderm/s2"
+	"github.com/sirupsen/logrus"
+)
+
+// routeMiddleware intercepts requests that the gateway serves itself rather
+// than through s2's controllers: S3 subresources that s2 routes to its
+// not-implemented endpoint, or doesn't route at all, multipart parts copied from existing objects,
+// browser form uploads, reads of gzip-compressed objects, HEAD requests for
+// directories, and object listings, which are streamed. Object reads are
+// flushed as they're written. It also adds pachyderm-specific extensions
+// and bucket default headers to some responses. It's attached after s2's own
+// middleware, so by the time a request gets here it has already been
+// authenticated and its body has been read; it's then checked with the
+// controller's Authorizer before anything else is done with it, once its span
+// has been tagged with its operation. Keys in case-insensitive buckets are
+// folded once the request is authorized, and checked again if that changed
+// them.
+func (c *controller) routeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tagSpan(r)
+		if err := c.authorize(r); err != nil {
+			s2.WriteError(c.logger, w, r, err)
+			return
+		}
+		if c.foldRequestKeys(r) {
+			if err := c.authorize(r); err != nil {
+				s2.WriteError(c.logger, w, r, err)
+				return
+			}
+		}
+		if unsupportedSubresource(r) {
+			s2.WriteError(c.logger, w, r, s2.NotImplementedError(r))
+			return
+		}
+		vars := mux.Vars(r)
+		bucketName := vars["bucket"]
+		key := vars["key"]
+		query := r.URL.Query()
+
+		if _, ok := query["restore"]; ok && r.Method == http.MethodPost && key != "" {
+			if err := c.RestoreObject(r, bucketName, key); err != nil {
+				s2.WriteError(c.logger, w, r, err)
+				return
+			}
+			// all PFS content is always available, so the object is reported
+			// as already restored
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if _, ok := query["delete"]; ok && r.Method == http.MethodPost && bucketName != "" && key == "" {
+			// s2 serves multi-object deletes, but doesn't limit their size
+			if err := checkDeleteObjects(r); err != nil {
+				s2.WriteError(c.logger, w, r, err)
+				return
+			}
+		}
+
+		if _, ok := query["acl"]; ok && key != "" {
+			switch r.Method {
+			case http.MethodGet:
+				policy, err := c.GetObjectACL(r, bucketName, key)
+				if err != nil {
+					s2.WriteError(c.logger, w, r, err)
+					return
+				}
+				writeXML(c.logger, w, r, http.StatusOK, policy)
+				return
+			case http.MethodPut:
+				if err := c.PutObjectACL(r, bucketName, key); err != nil {
+					s2.WriteError(c.logger, w, r, err)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+		}
+
+		if _, ok := query["uploadId"]; ok && r.Method == http.MethodPut && key != "" && r.Header.Get("x-amz-copy-source") != "" {
+			// s2 always reads parts from the request body, so parts copied
+			// from existing objects are handled here
+			partNumber, err := strconv.Atoi(query.Get("partNumber"))
+			if err != nil || partNumber < 0 || partNumber > c.maxAllowedParts {
+				s2.WriteError(c.logger, w, r, s2.InvalidArgumentError(r))
+				return
+			}
+			result, err := c.UploadMultipartChunkCopy(r, bucketName, key, query.Get("uploadId"), partNumber)
+			if err != nil {
+				s2.WriteError(c.logger, w, r, err)
+				return
+			}
+			writeXML(c.logger, w, r, http.StatusOK, result)
+			return
+		}
+
+		if _, ok := query["notification"]; ok && bucketName != "" && key == "" {
+			switch r.Method {
+			case http.MethodGet:
+				config, err := c.GetBucketNotification(r, bucketName)
+				if err != nil {
+					s2.WriteError(c.logger, w, r, err)
+					return
+				}
+				writeXML(c.logger, w, r, http.StatusOK, config)
+				return
+			case http.MethodPut:
+				if err := c.PutBucketNotification(r, bucketName); err != nil {
+					s2.WriteError(c.logger, w, r, err)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+		}
+
+		if _, ok := query["object-lock"]; ok && r.Method == http.MethodGet && bucketName != "" && key == "" {
+			config, err := c.GetObjectLockConfiguration(r, bucketName)
+			if err != nil {
+				s2.WriteError(c.logger, w, r, err)
+				return
+			}
+			writeXML(c.logger, w, r, http.StatusOK, config)
+			return
+		}
+
+		if r.Method == http.MethodHead && bucketName != "" && key == "" && r.Header.Get("x-pach-head-commit") != "" {
+			// the head commit lets clients pin subsequent reads to it, as
+			// object versions. It's only looked up when asked for, so that
+			// other HEAD requests stay cheap. Errors are left for s2 to
+			// report.
+			if commitID, err := c.bucketHead(r, bucketName); err == nil && commitID != "" {
+				w.Header().Set("x-pach-head-commit", commitID)
+			}
+		}
+
+		if r.Method == http.MethodHead && bucketName != "" && key == "" && r.Header.Get("x-pach-stats") != "" {
+			// stats are an extension for monitoring tools, and are added to
+			// the usual response when asked for
+			count, size, err := c.bucketStats(r, bucketName)
+			if err != nil {
+				s2.WriteError(c.logger, w, r, err)
+				return
+			}
+			w.Header().Set("x-pach-file-count", strconv.FormatUint(count, 10))
+			w.Header().Set("x-pach-size-bytes", strconv.FormatUint(size, 10))
+		}
+
+		if r.Method == http.MethodHead && strings.HasSuffix(key, "/") && len(query) == 0 {
+			modTime, err := c.StatDirectory(r, bucketName, key)
+			if err != nil {
+				s2.WriteError(c.logger, w, r, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/x-directory")
+			w.Header().Set("Content-Length", "0")
+			w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if isGetObjectRequest(r) {
+			c.setObjectHeaders(w, r)
+			if flusher, ok := w.(http.Flusher); ok && r.Method == http.MethodGet {
+				w = &flushWriter{ResponseWriter: w, flusher: flusher}
+			}
+			if r.Header.Get("Range") != "" {
+				w = &rangeErrorWriter{ResponseWriter: w, r: r, logger: c.logger}
+			}
+			if c.gzipContentEncoding && c.serveGetObject(w, r) {
+				return
+			}
+		}
+
+		if isPostObjectRequest(r) {
+			c.servePostObject(w, r)
+			return
+		}
+
+		if isListObjectsRequest(r) {
+			c.serveListObjects(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveReservedPath answers requests for reserved root paths, and browser
+// requests for `/favicon.ico` and `/robots.txt`, without authenticating
+// them. It returns false for any other request.
+func (c *controller) serveReservedPath(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if r.URL.RawQuery != "" || r.Header.Get("Authorization") != "" {
+		return false
+	}
+	if !c.reservedPaths[r.URL.Path] && !c.isBrowserRequest(r) {
+		return false
+	}
+	c.logger.Debugf("reserved path request: %s %s", r.Method, r.RequestURI)
+	if r.URL.Path == "/robots.txt" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write([]byte("User-agent: *\nDisallow: /\n"))
+		}
+		return true
+	}
+	http.NotFound(w, r)
+	return true
+}
+
+// isBrowserRequest returns whether r is a browser's request for one of
+// `browserPaths`. S3 clients set `x-amz-*` headers, and a request for a
+// bucket that exists is always left to it, so that buckets with these names
+// can still be used.
+func (c *controller) isBrowserRequest(r *http.Request) bool {
+	if !browserPaths[r.URL.Path] {
+		return false
+	}
+	for name := range r.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-") {
+			return false
+		}
+	}
+	// the request hasn't been authenticated, so this is a client of its own
+	// rather than the request's
+	pc, err := c.clientFactory()
+	if err != nil {
+		return false
+	}
+	bucket, err := c.driver.bucket(pc, r, strings.TrimPrefix(r.URL.Path, "/"))
+	if err != nil {
+		return true
+	}
+	_, err = c.driver.bucketCapabilities(pc, r, bucket)
+	s2Err, ok := err.(*s2.Error)
+	return ok && s2Err.Code == "NoSuchBucket"
+}
+
+// flushWriter flushes the headers of an object read as soon as they're
+// written, and its content as soon as each piece of it has been read from
+// PFS, rather than when net/http's buffer fills up. This gets the first
+// bytes to clients promptly when PFS is slow, so that they don't time out
+// waiting for them.
+type flushWriter struct {
+	http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (w *flushWriter) WriteHeader(code int) {
+	w.ResponseWriter.WriteHeader(code)
+	w.flusher.Flush()
+}
+
+func (w *flushWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	if err != nil {
+		return n, err
+	}
+	w.flusher.Flush()
+	return n, nil
+}
+
+func (w *flushWriter) Flush() {
+	w.flusher.Flush()
+}
+
+// rangeErrorWriter replaces the plain text body that `http.ServeContent`
+// serves for unsatisfiable ranges with an S3 `InvalidRange` error. The
+// `Content-Range: bytes */<size>` header that it sets is kept.
+type rangeErrorWriter struct {
+	http.ResponseWriter
+	r      *http.Request
+	logger *logrus.Entry
+	failed bool
+}
+
+func (w *rangeErrorWriter) WriteHeader(code int) {
+	if code != http.StatusRequestedRangeNotSatisfiable {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.failed = true
+	w.Header().Del("X-Content-Type-Options")
+	s2.WriteError(w.logger, w.ResponseWriter, w.r, invalidRangeError(w.r))
+}
+
+func (w *rangeErrorWriter) Write(p []byte) (int, error) {
+	if w.failed {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// supportedSubresources are the subresources that the gateway or s2 serves.
+// s2 itself answers some other subresources, e.g. `?torrent`, with
+// `NotImplemented`.
+var supportedSubresources = map[string]bool{
+	"acl":          true,
+	"delete":       true,
+	"location":     true,
+	"notification": true,
+	"object-lock":  true,
+	"restore":      true,
+	"uploads":      true,
+	"versioning":   true,
+	"versions":     true,
+}
+
+// emptyParameters are the query parameters that may legitimately be given
+// without a value, and so aren't mistaken for subresources
+var emptyParameters = map[string]bool{
+	"continuation-token": true,
+	"delimiter":          true,
+	"encoding-type":      true,
+	"key-marker":         true,
+	"marker":             true,
+	"prefix":             true,
+	"start-after":        true,
+	"upload-id-marker":   true,
+	"version-id-marker":  true,
+	"versionId":          true,
+}
+
+// unsupportedSubresource returns whether a request is for a subresource that
+// isn't supported. S3 subresources are query parameters without a value,
+// e.g. `?ownershipControls`; ones that s2 doesn't route would otherwise be
+// ignored, so that the request would be served as a read of the bucket or
+// object instead.
+func unsupportedSubresource(r *http.Request) bool {
+	for _, param := range strings.Split(r.URL.RawQuery, "&") {
+		if param == "" || strings.Contains(param, "=") {
+			continue
+		}
+		name, err := url.QueryUnescape(param)
+		if err != nil {
+			continue
+		}
+		if !supportedSubresources[name] && !emptyParameters[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// writeXMLPrelude writes the HTTP headers and XML header of a response
+func writeXMLPrelude(w http.ResponseWriter, r *http.Request, code int) {
+	requestID := mux.Vars(r)["requestID"]
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("x-amz-id-2", requestID)
+	w.Header().Set("x-amz-request-id", requestID)
+	w.WriteHeader(code)
+	w.Write([]byte(xml.Header))
+}
+
+// writeXML writes an XML response
+func writeXML(logger *logrus.Entry, w http.ResponseWriter, r *http.Request, code int, v interface{}) {
+	writeXMLPrelude(w, r, code)
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		logger.Errorf("could not encode xml response: %v", err)
+	}
+}
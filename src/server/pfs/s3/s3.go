@@ -1,13 +1,20 @@
 package s3
 
 import (
+	"context"
 	"fmt"
 	stdlog "log"
 	"net/http"
+	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/gorilla/mux"
+	lru "github.com/hashicorp/golang-lru"
+	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/pachyderm/pachyderm/src/client"
+	"github.com/pachyderm/pachyderm/src/client/pkg/errors"
 
 	"github.com/pachyderm/s2"
 	"github.com/sirupsen/logrus"
@@ -20,6 +27,7 @@ type ClientFactory = func() (*client.APIClient, error)
 const (
 	multipartRepo        = "_s3gateway_multipart_"
 	maxAllowedParts      = 10000
+	maxDeleteObjects     = 1000
 	maxRequestBodyLength = 128 * 1024 * 1024 //128mb
 	requestTimeout       = 10 * time.Second
 	readBodyTimeout      = 5 * time.Second
@@ -29,9 +37,32 @@ const (
 
 	// The S3 location served back
 	globalLocation = "PACHYDERM"
+
+	// The number of commits whose file counts are kept for bucket stats
+	fileCountCacheSize = 1024
 )
 
-// The S3 user associated with all PFS content
+// The S3 storage classes that clients may request. PFS has only one tier, so
+// all of them are accepted, and content is always reported to be stored in
+// `globalStorageClass`.
+var storageClasses = map[string]bool{
+	"STANDARD":            true,
+	"REDUCED_REDUNDANCY":  true,
+	"STANDARD_IA":         true,
+	"ONEZONE_IA":          true,
+	"INTELLIGENT_TIERING": true,
+	"GLACIER":             true,
+	"DEEP_ARCHIVE":        true,
+	"OUTPOSTS":            true,
+}
+
+// The root paths that browsers request on their own. These are valid bucket
+// names, so they're only answered directly when no bucket by that name
+// exists.
+var browserPaths = map[string]bool{"/favicon.ico": true, "/robots.txt": true}
+
+// The S3 user associated with all PFS content, unless another is set with
+// `WithOwner`
 var defaultUser = s2.User{ID: "00000000000000000000000000000000", DisplayName: "pachyderm"}
 
 type controller struct {
@@ -47,15 +78,332 @@ type controller struct {
 	driver Driver
 
 	clientFactory ClientFactory
+
+	// the template for the descriptions of commits made by writes, and the
+	// source it's parsed from
+	commitMessage         *template.Template
+	commitMessageTemplate string
+
+	// the maximum number of buckets returned by ListBuckets, or 0 for no
+	// limit
+	maxBuckets int
+
+	// whether PutObject compares incoming content with the existing object,
+	// and skips the write if it's unchanged
+	skipUnchangedPuts bool
+
+	// whether concurrent writes to a branch resolve to the one that finishes
+	// last, and the locks that order the commits of each branch when they do
+	lastFinishWins bool
+	branchLocks    sync.Map // map[string]*sync.Mutex
+
+	// the S3 user reported as the owner of all buckets and objects
+	owner s2.User
+
+	// the maximum number of multipart uploads that can be in progress, and
+	// the maximum total size of their parts, or 0 for no limit
+	maxMultipartUploads int
+	maxMultipartBytes   uint64
+	multipartUploads    multipartCount
+
+	// root paths that are answered directly, without going through s2
+	reservedPaths map[string]bool
+
+	// whether PutObject creates the branch of a bucket whose repo exists but
+	// whose branch doesn't
+	autoCreateBranches bool
+
+	// whether buckets can be created case-insensitive, which is looked up
+	// for each request when they can
+	caseInsensitiveBuckets bool
+
+	// whether objects written with `Content-Encoding: gzip` are flagged as
+	// such, which is looked up for each object read when they are
+	gzipContentEncoding bool
+
+	// whether objects can be made public with the `public-read` canned ACL
+	cannedACLs bool
+
+	// decides whether authenticated requests may perform their operations
+	authorizer Authorizer
+
+	// buckets whose requests aren't logged
+	unloggedBuckets map[string]bool
+
+	// the domain whose subdomains address buckets in virtual-hosted style,
+	// or "" if only path-style addressing is used
+	baseDomain string
+
+	// the tracer that starts a span for each request
+	tracer opentracing.Tracer
+
+	// the number of files in recently inspected commits, by
+	// `repo@commitID`, for bucket stats
+	fileCounts *lru.Cache
+}
+
+// Option configures optional behavior of the S3 gateway
+type Option func(c *controller)
+
+// WithCommitMessage sets the template for the descriptions of commits made by
+// writes to branches. The template is parsed with `text/template`, and may
+// reference `{{.Operation}}`, `{{.Bucket}}`, `{{.Key}}`, `{{.RemoteAddr}}`
+// and `{{.Time}}`.
+func WithCommitMessage(template string) Option {
+	return func(c *controller) {
+		c.commitMessageTemplate = template
+	}
+}
+
+// WithMaxBuckets caps the number of buckets returned by ListBuckets. When
+// set, the newest buckets are returned first. S3 has no bucket pagination, so
+// this is only a guard for clusters with very many repos. A limit of 0 (the
+// default) returns every bucket.
+func WithMaxBuckets(n int) Option {
+	return func(c *controller) {
+		c.maxBuckets = n
+	}
+}
+
+// WithMaxMultipartUploads limits the multipart uploads that can be in
+// progress at once, across all buckets, to n uploads whose parts total at
+// most maxBytes. Once either limit is reached, new uploads are rejected with
+// `503 SlowDown` until some are completed or aborted. Parts are stored in
+// PFS rather than in memory, so this bounds the storage that abandoned
+// uploads take. The limits are approximate: each gateway keeps its own count
+// of uploads, which is only recounted from PFS once a minute, so uploads
+// started through several gateways at once can exceed them. A limit of 0
+// (the default) is no limit.
+func WithMaxMultipartUploads(n int, maxBytes uint64) Option {
+	return func(c *controller) {
+		c.maxMultipartUploads = n
+		c.maxMultipartBytes = maxBytes
+	}
+}
+
+// WithAutoCreateBranches makes PutObject create the branch of a bucket whose
+// repo exists but whose branch doesn't, so that the write becomes the
+// branch's first commit. By default, such writes fail with `NoSuchBucket`,
+// as reads do. Repos are never created this way. This only applies when
+// all branches are served as buckets.
+func WithAutoCreateBranches() Option {
+	return func(c *controller) {
+		c.autoCreateBranches = true
+	}
+}
+
+// WithCaseInsensitiveBuckets lets buckets be created case-insensitive, by
+// setting `x-pach-case-insensitive: true` on CreateBucket. Whether a bucket
+// is case-insensitive is looked up on every request that names it, so it's
+// only done when this is set. By default, requests to create
+// case-insensitive buckets fail with `NotImplemented`.
+func WithCaseInsensitiveBuckets() Option {
+	return func(c *controller) {
+		c.caseInsensitiveBuckets = true
+	}
+}
+
+// WithGzipContentEncoding makes the gateway keep track of objects written
+// with `Content-Encoding: gzip`, and serve them with that encoding to clients
+// that accept it, and decompressed to others. Whether an object was written
+// compressed is looked up on every object read, and updated by writes that
+// replace a flagged object, so it's only done when this is set. By default,
+// the content of such writes is stored and served as it's sent, without an
+// encoding.
+func WithGzipContentEncoding() Option {
+	return func(c *controller) {
+		c.gzipContentEncoding = true
+	}
+}
+
+// WithCannedACLs lets objects be made public, by writing them or setting
+// their ACL with `x-amz-acl: public-read`. Public objects are reported as
+// such by GetObjectAcl, and unsigned requests may read them even if the
+// Authorizer denies it. Unsigned requests are only accepted at all when
+// Pachyderm auth isn't active, as PFS has no anonymous identity to read
+// with. ACLs are kept per key, not per version, and are reset by any write
+// to the key that doesn't set one, which needs a lookup for every write, so
+// they're only stored when this is set. By default, `public-read` is
+// rejected with `NotImplemented`.
+func WithCannedACLs() Option {
+	return func(c *controller) {
+		c.cannedACLs = true
+	}
+}
+
+// WithAuthorizer sets the Authorizer that decides, for each request, whether
+// its principal may perform the requested operation. It's consulted after
+// the request has been authenticated, so it can integrate the gateway with
+// external policy engines. Rejected requests fail with `AccessDenied`. By
+// default, every operation is allowed.
+func WithAuthorizer(authorizer Authorizer) Option {
+	return func(c *controller) {
+		c.authorizer = authorizer
+	}
+}
+
+// WithUnloggedBuckets turns off the logging of requests to the given
+// buckets, e.g. high-traffic buckets whose request logs would drown out
+// everything else. Requests to all other buckets, and service-level
+// requests, are still logged. By default, every request is logged. Buckets
+// are matched by the branch they serve, so e.g. `repo` also covers requests
+// to `master.repo`.
+func WithUnloggedBuckets(buckets ...string) Option {
+	return func(c *controller) {
+		c.unloggedBuckets = make(map[string]bool)
+		for _, bucket := range buckets {
+			c.unloggedBuckets[bucket] = true
+		}
+	}
+}
+
+// WithBaseDomain enables virtual-hosted addressing of buckets, where the
+// bucket is named by the `Host` header rather than the path. A request to a
+// subdomain of domain, e.g. `master.repo.s3.example.com` for a domain of
+// `s3.example.com`, addresses the bucket `master.repo`, and its whole path is
+// the key. Requests to any other host, including domain itself, are
+// path-style, as they are by default.
+func WithBaseDomain(domain string) Option {
+	return func(c *controller) {
+		c.baseDomain = strings.TrimPrefix(domain, ".")
+	}
+}
+
+// WithTracer sets the tracer that starts a span for each request. Spans are
+// named after the request's S3 operation, e.g. `s3gateway/GetObject`, and
+// tagged with its bucket, key, request ID, status and byte counts. They're
+// propagated to PFS through the request's pachyderm client, so its calls
+// show up as child spans when the client traces RPCs. By default, requests
+// aren't traced.
+func WithTracer(tracer opentracing.Tracer) Option {
+	return func(c *controller) {
+		c.tracer = tracer
+	}
+}
+
+// WithSkipUnchangedPuts makes PutObject compare the content of each write
+// with the object it replaces, and skip the write if the content is the same,
+// so that re-uploading identical files doesn't create new commits. This
+// requires reading the existing object and spooling the incoming content to a
+// temporary file, so it's only done for objects whose size is unchanged.
+func WithSkipUnchangedPuts() Option {
+	return func(c *controller) {
+		c.skipUnchangedPuts = true
+	}
+}
+
+// WithLastFinishWins makes concurrent writes to a branch resolve to the one
+// that finishes last. The body of each PutObject is spooled to a temporary
+// file before its commit is started, and the gateway makes its commits to a
+// branch one at a time, so each write's commit is parented on the commit of
+// the write that finished before it, and the winner of a race is the write
+// whose commit has the latest finish time. By default, a write's commit is
+// started as soon as its request arrives, so the write that started last
+// wins, however long its upload takes. Writes made through other gateways or
+// directly to PFS aren't ordered with these.
+func WithLastFinishWins() Option {
+	return func(c *controller) {
+		c.lastFinishWins = true
+	}
+}
+
+// WithOwner sets the canonical ID and display name of the S3 user reported as
+// the owner of all buckets and objects. All PFS content has a single logical
+// owner, which some clients expect to be non-empty.
+func WithOwner(id, displayName string) Option {
+	return func(c *controller) {
+		c.owner = s2.User{ID: id, DisplayName: displayName}
+	}
+}
+
+// WithReservedPaths sets root paths, e.g. `/.well-known/status`, that are
+// answered with `404` rather than being treated as bucket operations. Only
+// unsigned GET and HEAD requests without query parameters are reserved.
+// Paths whose first element could be a bucket name, like `/status`, are
+// rejected by `Server`, since they'd hide that bucket.
+func WithReservedPaths(paths ...string) Option {
+	return func(c *controller) {
+		c.reservedPaths = make(map[string]bool)
+		for _, p := range paths {
+			c.reservedPaths[p] = true
+		}
+	}
+}
+
+// validateReservedPath returns an error if p could be the path of a bucket or
+// object, which it can't be reserved over
+func validateReservedPath(p string) error {
+	if !strings.HasPrefix(p, "/") || p == "/" {
+		return errors.Errorf("reserved path %q is not a root path", p)
+	}
+	bucket := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 2)[0]
+	if _, _, ok := (&defaultBucketResolver{}).Resolve(bucket); ok {
+		return errors.Errorf("reserved path %q could be a bucket", p)
+	}
+	return nil
+}
+
+// requestStateKey is the context key under which a request's requestState
+// is kept
+type requestStateKey struct{}
+
+// requestState holds what's looked up for a request, so that each thing is
+// looked up once per request, however many of the request's handlers need
+// it
+type requestState struct {
+	mu sync.Mutex
+	// the request's pachyderm client
+	pc *client.APIClient
+	// values looked up by requestCached
+	cache map[string]interface{}
+}
+
+// withRequestState returns r with an empty requestState
+func withRequestState(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestStateKey{}, &requestState{
+		cache: make(map[string]interface{}),
+	}))
+}
+
+// requestCached returns the value looked up under key for a request, calling
+// lookup the first time it's needed. Requests that didn't go through the
+// server, e.g. in tests, have nothing cached.
+func requestCached(r *http.Request, key string, lookup func() interface{}) interface{} {
+	state, ok := r.Context().Value(requestStateKey{}).(*requestState)
+	if !ok {
+		return lookup()
+	}
+	state.mu.Lock()
+	value, ok := state.cache[key]
+	state.mu.Unlock()
+	if ok {
+		return value
+	}
+	value = lookup()
+	state.mu.Lock()
+	state.cache[key] = value
+	state.mu.Unlock()
+	return value
 }
 
 // requestPachClient uses the clientFactory to construct a request-scoped
-// pachyderm client
+// pachyderm client. It's constructed once per request, and shared by all of
+// the request's handlers.
 func (c *controller) requestClient(r *http.Request) (*client.APIClient, error) {
+	state, ok := r.Context().Value(requestStateKey{}).(*requestState)
+	if ok {
+		state.mu.Lock()
+		defer state.mu.Unlock()
+		if state.pc != nil {
+			return state.pc, nil
+		}
+	}
+
 	pc, err := c.clientFactory()
 	if err != nil {
 		return nil, err
 	}
+	pc = withRequestSpan(pc, r)
 
 	vars := mux.Vars(r)
 	if vars["s3gAuth"] != "disabled" {
@@ -65,9 +413,46 @@ func (c *controller) requestClient(r *http.Request) (*client.APIClient, error) {
 		}
 	}
 
+	if ok {
+		state.pc = pc
+	}
 	return pc, nil
 }
 
+// logsRequest returns whether a request is logged, which it is unless it's
+// to one of the buckets set with `WithUnloggedBuckets`. Requests haven't been
+// routed yet when they're logged, so the bucket is taken from the first
+// element of the path. Names are compared by the branch they resolve to, so
+// e.g. `repo` and `master.repo` are the same bucket.
+func (c *controller) logsRequest(r *http.Request) bool {
+	if len(c.unloggedBuckets) == 0 {
+		return true
+	}
+	bucket := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+	if bucket == "" {
+		return true
+	}
+	identity := c.bucketIdentity(r, bucket)
+	for unlogged := range c.unloggedBuckets {
+		if c.bucketIdentity(r, unlogged) == identity {
+			return false
+		}
+	}
+	return true
+}
+
+// bucketIdentity returns the branch that the bucket called name serves, as
+// `repo@branch`, so that different names for one bucket compare equal. Names
+// that the driver doesn't resolve to a branch are returned as they are. This
+// doesn't touch PFS, since the driver only maps the name.
+func (c *controller) bucketIdentity(r *http.Request, name string) string {
+	bucket, err := c.driver.bucket(nil, r, name)
+	if err != nil || bucket.Repo == "" {
+		return name
+	}
+	return fmt.Sprintf("%s@%s", bucket.Repo, bucket.Commit)
+}
+
 // Server runs an HTTP server with an S3-like API for PFS. This allows you to
 // use s3 clients to access PFS contents.
 //
@@ -90,18 +475,40 @@ func (c *controller) requestClient(r *http.Request) (*client.APIClient, error) {
 // Note: In `s3cmd`, you must set the access key and secret key, even though
 // this API will ignore them - otherwise, you'll get an opaque config error:
 // https://github.com/s3tools/s3cmd/issues/845#issuecomment-464885959
-func Server(port uint16, driver Driver, clientFactory ClientFactory) (*http.Server, error) {
+func Server(port uint16, driver Driver, clientFactory ClientFactory, opts ...Option) (*http.Server, error) {
 	logger := logrus.WithFields(logrus.Fields{
 		"source": "s3gateway",
 	})
 
 	c := &controller{
-		logger:          logger,
-		repo:            multipartRepo,
-		maxAllowedParts: maxAllowedParts,
-		driver:          driver,
-		clientFactory:   clientFactory,
+		logger:                logger,
+		repo:                  multipartRepo,
+		maxAllowedParts:       maxAllowedParts,
+		driver:                driver,
+		clientFactory:         clientFactory,
+		commitMessageTemplate: defaultCommitMessage,
+		owner:                 defaultUser,
+		authorizer:            allowAll{},
+		tracer:                opentracing.NoopTracer{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	for p := range c.reservedPaths {
+		if err := validateReservedPath(p); err != nil {
+			return nil, err
+		}
+	}
+	fileCounts, err := lru.New(fileCountCacheSize)
+	if err != nil {
+		return nil, err
+	}
+	c.fileCounts = fileCounts
+	commitMessage, err := template.New("commitMessage").Parse(c.commitMessageTemplate)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse commit message template")
 	}
+	c.commitMessage = commitMessage
 
 	s3Server := s2.NewS2(logger, maxRequestBodyLength, readBodyTimeout)
 	s3Server.Auth = c
@@ -110,15 +517,23 @@ func Server(port uint16, driver Driver, clientFactory ClientFactory) (*http.Serv
 	s3Server.Object = c
 	s3Server.Multipart = c
 	router := s3Server.Router()
+	router.Use(c.signedHeadersMiddleware)
+	router.Use(c.routeMiddleware)
 
 	server := &http.Server{
 		Addr:         fmt.Sprintf(":%d", port),
 		ReadTimeout:  requestTimeout,
 		WriteTimeout: requestTimeout,
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r = withRequestState(c.rewriteVirtualHost(r))
+			if c.serveReservedPath(w, r) {
+				return
+			}
 			// Log that a request was made
-			logger.Infof("http request: %s %s", r.Method, r.RequestURI)
-			router.ServeHTTP(w, r)
+			if c.logsRequest(r) {
+				logger.Infof("http request: %s %s", r.Method, r.RequestURI)
+			}
+			c.serveTraced(w, r, router)
 		}),
 		// NOTE: this is not closed. If the standard logger gets customized, this will need to be fixed
 		ErrorLog: stdlog.New(logger.Writer(), "", 0),
@@ -2,6 +2,7 @@ package s3
 
 import (
 	"net/http"
+	"sort"
 
 	"github.com/pachyderm/s2"
 )
@@ -15,12 +16,19 @@ func (c *controller) ListBuckets(r *http.Request) (*s2.ListBucketsResult, error)
 	}
 
 	result := s2.ListBucketsResult{
-		Owner:   &defaultUser,
+		Owner:   &c.owner,
 		Buckets: []*s2.Bucket{},
 	}
 	if err = c.driver.listBuckets(pc, r, &result.Buckets); err != nil {
 		return nil, err
 	}
 
+	if c.maxBuckets > 0 && len(result.Buckets) > c.maxBuckets {
+		sort.SliceStable(result.Buckets, func(i, j int) bool {
+			return result.Buckets[i].CreationDate.After(result.Buckets[j].CreationDate)
+		})
+		result.Buckets = result.Buckets[:c.maxBuckets]
+	}
+
 	return &result, nil
 }
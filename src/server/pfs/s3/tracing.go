@@ -0,0 +1,101 @@
+package s3
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/pachyderm/pachyderm/src/client"
+)
+
+// tracingWriter records the status code and number of bytes of a response,
+// so that they can be tagged on the request's span once it's been served
+type tracingWriter struct {
+	http.ResponseWriter
+	status       int
+	bytesWritten int64
+}
+
+func (w *tracingWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *tracingWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytesWritten += int64(n)
+	return n, err
+}
+
+// Flush forwards to the underlying writer, if it can be flushed, so that
+// object reads are still flushed as they're written
+func (w *tracingWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// serveTraced serves a request within a span started with the controller's
+// tracer. The span is put in the request's context, where routeMiddleware
+// names it after the request's S3 operation, and pachyderm clients made for
+// the request carry it to PFS, whose calls then show up as its children.
+func (c *controller) serveTraced(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	span := c.tracer.StartSpan("s3gateway")
+	defer span.Finish()
+	ext.SpanKindRPCServer.Set(span)
+	ext.HTTPMethod.Set(span, r.Method)
+	ext.HTTPUrl.Set(span, r.URL.String())
+	if r.ContentLength > 0 {
+		span.SetTag("bytes_read", r.ContentLength)
+	}
+
+	tw := &tracingWriter{ResponseWriter: w}
+	next.ServeHTTP(tw, r.WithContext(opentracing.ContextWithSpan(r.Context(), span)))
+
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	ext.HTTPStatusCode.Set(span, uint16(tw.status))
+	if tw.status >= http.StatusInternalServerError {
+		ext.Error.Set(span, true)
+	}
+	span.SetTag("bytes_written", tw.bytesWritten)
+}
+
+// tagSpan names the span of a routed request after its S3 operation, and
+// tags it with the bucket and key that it addresses, and with its request
+// ID, so that it can be correlated with the request's logs and responses
+func tagSpan(r *http.Request) {
+	span := opentracing.SpanFromContext(r.Context())
+	if span == nil {
+		return
+	}
+	vars := mux.Vars(r)
+	op := requestOperation(r)
+	span.SetOperationName("s3gateway/" + op)
+	span.SetTag("s3.operation", op)
+	span.SetTag("s3.request_id", vars["requestID"])
+	if vars["bucket"] != "" {
+		span.SetTag("s3.bucket", vars["bucket"])
+	}
+	if vars["key"] != "" {
+		span.SetTag("s3.key", vars["key"])
+	}
+}
+
+// withRequestSpan returns a pachyderm client whose calls carry the span of
+// a request, if it has one. The request's own context isn't used, since
+// that's canceled as soon as the client goes away.
+func withRequestSpan(pc *client.APIClient, r *http.Request) *client.APIClient {
+	span := opentracing.SpanFromContext(r.Context())
+	if span == nil {
+		return pc
+	}
+	return pc.WithCtx(opentracing.ContextWithSpan(pc.Ctx(), span))
+}
@@ -1,12 +1,15 @@
 package s3
 
 import (
+	"bytes"
 	"context"
 	"crypto/md5"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime/multipart"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
 	"sort"
@@ -111,6 +114,12 @@ func notImplementedError(t *testing.T, err error) {
 	require.Equal(t, "This functionality is not implemented.", err.Error())
 }
 
+func accessDeniedError(t *testing.T, err error) {
+	t.Helper()
+	require.YesError(t, err)
+	require.Equal(t, "Access Denied", err.Error())
+}
+
 func fileHash(t *testing.T, name string) (int64, []byte) {
 	t.Helper()
 
@@ -131,8 +140,54 @@ func fileHash(t *testing.T, name string) (int64, []byte) {
 	return fi.Size(), hashSum
 }
 
-func testRunner(t *testing.T, group string, driver Driver, runner func(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client)) {
-	server, err := Server(0, driver, client.NewForTest)
+// rawRequest issues an unsigned request directly against the gateway, for
+// functionality that the minio client doesn't support
+func rawRequest(t *testing.T, minioClient *minio.Client, method, path string, body io.Reader, header http.Header) *http.Response {
+	t.Helper()
+
+	// the minio client doesn't expose its endpoint, so derive it from a
+	// presigned URL
+	u, err := minioClient.Presign(method, "bucket", "key", time.Minute, nil)
+	require.NoError(t, err)
+	u.Path = path
+	u.RawPath = ""
+	u.RawQuery = ""
+	if i := strings.Index(path, "?"); i >= 0 {
+		u.Path = path[:i]
+		u.RawQuery = path[i+1:]
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	require.NoError(t, err)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	return res
+}
+
+// postObject makes a browser form upload of content to bucket, with the
+// given form fields
+func postObject(t *testing.T, minioClient *minio.Client, bucket string, fields map[string]string, filename, content string) *http.Response {
+	t.Helper()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for name, value := range fields {
+		require.NoError(t, writer.WriteField(name, value))
+	}
+	file, err := writer.CreateFormFile("file", filename)
+	require.NoError(t, err)
+	_, err = file.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	return rawRequest(t, minioClient, "POST", "/"+bucket, body, http.Header{
+		"Content-Type": []string{writer.FormDataContentType()},
+	})
+}
+
+func testRunner(t *testing.T, group string, driver Driver, runner func(t *testing.T, pachClient *client.APIClient, minioClient *minio.Client), opts ...Option) {
+	server, err := Server(0, driver, client.NewForTest, opts...)
 	require.NoError(t, err)
 	listener, err := net.Listen("tcp", ":0")
 	require.NoError(t, err)
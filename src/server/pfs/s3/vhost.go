@@ -0,0 +1,74 @@
+package s3
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// signedPathKey is the context key under which virtual-hosted requests keep
+// the path that they were sent with
+type signedPathKey struct{}
+
+// virtualHostBucket returns the bucket that a request addresses through its
+// `Host` header, e.g. `master.repo` for `master.repo.s3.example.com` when the
+// base domain is `s3.example.com`, or "" if the request is path-style
+func (c *controller) virtualHostBucket(r *http.Request) string {
+	if c.baseDomain == "" {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		// there's no port
+		host = r.Host
+	}
+	suffix := "." + c.baseDomain
+	if len(host) <= len(suffix) || !strings.EqualFold(host[len(host)-len(suffix):], suffix) {
+		return ""
+	}
+	return host[:len(host)-len(suffix)]
+}
+
+// rewriteVirtualHost turns a virtual-hosted request into the equivalent
+// path-style request, which is what s2 routes, by prepending the bucket to
+// its path. The original path is kept in the request's context, since it's
+// the one that auth V4 signatures are computed over.
+func (c *controller) rewriteVirtualHost(r *http.Request) *http.Request {
+	bucket := c.virtualHostBucket(r)
+	if bucket == "" {
+		return r
+	}
+	r = r.WithContext(context.WithValue(r.Context(), signedPathKey{}, *r.URL))
+	u := *r.URL
+	u.Path = "/" + bucket + u.Path
+	if u.RawPath != "" {
+		u.RawPath = "/" + bucket + u.RawPath
+	}
+	r.URL = &u
+	return r
+}
+
+// restoreSignedPath puts back the path that a virtual-hosted request was sent
+// with, once it's been routed, so that its auth V4 signature can be checked.
+// Auth V2 signatures are computed over the path-style path, so requests
+// signed that way are left alone.
+func restoreSignedPath(r *http.Request) {
+	signed, ok := r.Context().Value(signedPathKey{}).(url.URL)
+	if !ok || !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		return
+	}
+	r.URL.Path = signed.Path
+	r.URL.RawPath = signed.RawPath
+}
+
+// objectURL returns the URL that an object can be read from, addressed the
+// same way as r
+func (c *controller) objectURL(r *http.Request, scheme, bucketName, key string) string {
+	objectPath := "/" + bucketName + "/" + key
+	if c.virtualHostBucket(r) != "" {
+		objectPath = "/" + key
+	}
+	return (&url.URL{Scheme: scheme, Host: r.Host, Path: objectPath}).String()
+}